@@ -97,19 +97,19 @@ async function main() {
 		  console.log(args);
 		  switch (args[0]) {
 			  case 'deliverCrude':
-				resp = await deliverCrudeRand(contract,args[1]);
+				resp = await deliverCrudeRand(contract);
 				break;
 			  case 'transferCrude':
 				resp = await transferCrude(contract,args[1]);
 				break;
 			  case 'refineRand':
-				resp = await refineRand(contract,args[1],args[1]);
+				resp = await refineRand(contract,args[1]);
 				break;
 			  case 'addFuelOrderRand':
-				resp = await addFuelOrderRand(contract,args[1],args[2]);
+				resp = await addFuelOrderRand(contract,args[1]);
 				break;
 			  case 'deliverFuelRand':
-				resp = await deliverFuelRand(contract,args[1],args.slice(2));
+				resp = await deliverFuelRand(contract,args.slice(1));
 				break;
 			  case 'transferFuel':
 				resp = await transferFuel(contract,args[1],args[2]);
@@ -117,37 +117,33 @@ async function main() {
 			  default:
 				  console.log('Command line args are not good! Usage: node issue.js <transaction> <arg0> <arg1> ... <argN> ');
 		  }
+		  //creating transactions return the ID of the new asset.
+		  console.log(resp.toString());
 		  gateway.disconnect();
 		  return;
 	  }
 
-	let init_id = 0;
 	let i;
-	let forder_count = 1;
     let resp;
 	  //submit transactions .
-	  //create Crude oil ->transfer -> refine -> create fuelOrder(s) -> deliver orders -> transfer fuel to retailers.
+	  //create Crude oil -> arrive -> transfer -> refine -> create fuelOrder(s) -> deliver orders -> arrive -> transfer fuel to retailers.
+	  //IDs of the new assets are returned by the chaincode.
 	for (i = 1;i < 3; i++) {
-		resp = await deliverCrudeRand(contract,i);
-		console.log(resp);
+		let crude_id = (await deliverCrudeRand(contract)).toString();
+		console.log(crude_id);
 	
-		resp = await transferCrude(contract,i)
-		console.log(resp);
-		resp = await refineRand(contract,i,i);
-		console.log(resp);
-		resp = await addFuelOrderRand(contract,forder_count++,i);
-		console.log(resp);
-		
-		resp = await addFuelOrderRand(contract,forder_count++,i);
-		console.log(resp);
-		resp = await addFuelOrderRand(contract,forder_count++,i);
-		console.log(resp);
-		let forders = [forder_count-3,forder_count-2,forder_count-1]
-		console.log(resp);
-		resp = await deliverFuelRand(contract,i,forders);
-		console.log(resp);
-		resp = await transferFuel(contract,forders[0],i)
+		resp = await transferCrude(contract,crude_id)
 		console.log(resp);
+		let fuel_id = (await refineRand(contract,crude_id)).toString();
+		console.log(fuel_id);
+		let forders = [];
+		forders.push((await addFuelOrderRand(contract,fuel_id)).toString());
+		forders.push((await addFuelOrderRand(contract,fuel_id)).toString());
+		forders.push((await addFuelOrderRand(contract,fuel_id)).toString());
+		console.log(forders);
+		let plan_id = (await deliverFuelRand(contract,forders)).toString();
+		console.log(plan_id);
+		resp = await transferFuel(contract,forders[0],plan_id)
 		console.log(resp);
 	}
 
@@ -215,7 +211,7 @@ async function queryHistory(contract,asset_id) {
 		return 'wrong asset_id in queryHistory';
 	}
 	try {
-	let resp = await contract.submitTransaction('queryHistoryForKey',asset_id);
+	let resp = await contract.submitTransaction('queryAssetHistory',asset_id);
 		return resp;
 	//respond to client 
 	}
@@ -245,12 +241,12 @@ async function queryAsset(contract,asset_id) {
 }
 
 
-function deliverCrude(contract,crude_num,value,quant,owner,estTime,startLoc,dest,vessel_id) {
-	return contract.submitTransaction('deliverCrude','Crude'+crude_num,value,quant,'org'+owner,estTime,dest,vessel_id)
+function deliverCrude(contract,value,quant,owner,estTime,startLoc,dest,vessel_id) {
+	return contract.submitTransaction('deliverCrude',value,quant,'org'+owner,estTime,startLoc,dest,vessel_id,(new Date()).toISOString())
 }
 
 
-function deliverCrudeRand(contract,crude_num) {
+function deliverCrudeRand(contract) {
 	let value = Math.floor(Math.random()*101) +1;
 	let quant = Math.floor(Math.random()*101) +1;
 	let owner = 'org1';
@@ -262,19 +258,19 @@ function deliverCrudeRand(contract,crude_num) {
 	let startLoc = owner;
 	let dest = 'org3';
 	let vessel_id = Math.floor(Math.random()*1001) +1;
-	return contract.submitTransaction('deliverCrude','Crude'+crude_num,value.toString(),quant.toString(),owner,estTime,startLoc,dest,vessel_id.toString(),(new Date()).toISOString())
+	return contract.submitTransaction('deliverCrude',value.toString(),quant.toString(),owner,estTime,startLoc,dest,vessel_id.toString(),(new Date()).toISOString())
 }
 
-function refineRand(contract,fuel_num,crude_num) {
+function refineRand(contract,crude_id) {
 	let value = Math.floor(Math.random()*101) +1;
 	let quant = Math.floor(Math.random()*101) +1;
 	let owner = 'org3';
 	let density = Math.floor(Math.random()*101) +1;
 	let type = 'fuel';
-	return contract.submitTransaction('refine','Fuel'+fuel_num,value.toString(),quant.toString(),owner,density.toString(),type,'Crude'+crude_num,(new Date).toISOString())
+	return contract.submitTransaction('refine',value.toString(),quant.toString(),owner,density.toString(),type,crude_id,(new Date).toISOString())
 }
 
-function addFuelOrderRand(contract,fuelOrder_num,fuel_num) {
+function addFuelOrderRand(contract,fuel_id) {
 	let value = Math.floor(Math.random()*101) +1;
 	let quant = Math.floor(Math.random()*101) +1;
 	let owner = 'org3';
@@ -284,40 +280,49 @@ function addFuelOrderRand(contract,fuelOrder_num,fuel_num) {
 		dest = 'org5';
 	else if (rcoin == 1) 
 		dest = 'org6';
-	return contract.submitTransaction('addFuelOrder','FuelOrder'+fuelOrder_num,value.toString(),quant.toString(),owner,dest,'Fuel'+fuel_num,(new Date()).toISOString())
+	return contract.submitTransaction('addFuelOrder',value.toString(),quant.toString(),owner,dest,fuel_id,(new Date()).toISOString())
 }
 
-function deliverFuelRand(contract,plan_num,fuelOrders) {
+async function deliverFuelRand(contract,fuelOrders) {
 	let trackid = Math.floor(Math.random()*10001) +1;
-	let i,dest,startLoc,time,estTime,dur;
-	startLoc = 'org3';
-	let rcoin = Math.floor(Math.random()*2);
-	if (rcoin == 0) 
-		dest = 'org5';
-	else if (rcoin == 1) 
-		dest = 'org6';
-	let args_arr = ['deliverFuel','Plan'+plan_num,trackid.toString()]
+	let i,order,time,estTime,dur;
+	//a JSON document instead of the {FuelOrderID,EstTime,Sloc,Dest} args (see args.go of the chaincode).
+	let doc = {Version: 1, TruckID: trackid.toString(), Deliveries: []};
 	for (i = 0; i < fuelOrders.length; i++) {
+		//the plan has to start at the refiner and end at the destination of each order (see plans.go of the chaincode).
+		order = JSON.parse((await queryAsset(contract,fuelOrders[i])).toString());
 		dur = Math.floor(Math.random()*101) +1;
 		time = new Date();
 		time.setSeconds(time.getSeconds() + dur)
 		estTime = time.toISOString();
-		args_arr.push('FuelOrder'+fuelOrders[i],estTime,startLoc,dest)
+		doc.Deliveries.push({FuelOrderID: fuelOrders[i], EstTime: estTime, StartingLocation: order.AD.Owner, Destination: order.Dest})
 	}
-	return contract.submitTransaction(...args_arr)
+	return contract.submitTransaction('deliverFuel',JSON.stringify(doc))
+}
+
+//the carrier declares that the asset arrived with all its quantity (see handover.go of the chaincode).
+async function arrive(contract,asset_id,plan_id) {
+	let asset = JSON.parse((await queryAsset(contract,asset_id)).toString());
+	let args = ['arrive',asset_id,asset.AD.Quantity.toString(),(new Date()).toISOString()];
+	if (plan_id)
+		args.push(plan_id);
+	return contract.submitTransaction(...args)
 }
 
-function transferFuel(contract,fuelOrder_num,plan_num) {
+//the destination accepts the order after it arrives.
+async function transferFuel(contract,fuelOrder_id,plan_id) {
+	await arrive(contract,fuelOrder_id,plan_id);
 	let rcoin = Math.floor(Math.random()*2);
 	let dest;
 	if (rcoin == 0) 
 		dest = 'org5';
 	else if (rcoin == 1) 
 		dest = 'org6';
-	return contract.submitTransaction('transfer','FuelOrder'+fuelOrder_num,dest,(new Date()).toISOString(),'Plan'+plan_num)
+	return contract.submitTransaction('transfer',fuelOrder_id,dest,(new Date()).toISOString(),plan_id)
 }
-function transferCrude(contract,crude_num) {
-	return contract.submitTransaction('transfer','Crude'+crude_num,'org3',(new Date()).toISOString())
+async function transferCrude(contract,crude_id) {
+	await arrive(contract,crude_id);
+	return contract.submitTransaction('transfer',crude_id,'org3',(new Date()).toISOString())
 }
 
 main().then(() => {
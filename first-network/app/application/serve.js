@@ -142,7 +142,7 @@ async function queryHistory(contract,asset_id) {
 		return 'wrong asset_id in queryHistory';
 	}
 	try {
-	let resp = await contract.submitTransaction('queryHistoryForKey',asset_id);
+	let resp = await contract.submitTransaction('queryAssetHistory',asset_id);
 		return resp;
 	//respond to client 
 	}
@@ -171,12 +171,12 @@ async function queryAsset(contract,asset_id) {
 }
 
 
-function deliverCrude(contract,crude_num,value,quant,owner,estTime,startLoc,dest,vessel_id) {
-	return contract.submitTransaction('deliverCrude','Crude'+crude_num,value,quant,'org'+owner,estTime,dest,vessel_id)
+function deliverCrude(contract,value,quant,owner,estTime,startLoc,dest,vessel_id) {
+	return contract.submitTransaction('deliverCrude',value,quant,'org'+owner,estTime,startLoc,dest,vessel_id,(new Date()).toISOString())
 }
 
 
-function deliverCrudeRand(contract,crude_num) {
+function deliverCrudeRand(contract) {
 	let value = Math.floor(Math.random()*101) +1;
 	let quant = Math.floor(Math.random()*101) +1;
 	let owner = 'org1';
@@ -188,19 +188,19 @@ function deliverCrudeRand(contract,crude_num) {
 	let startLoc = owner;
 	let dest = 'org3';
 	let vessel_id = Math.floor(Math.random()*1001) +1;
-	return contract.submitTransaction('deliverCrude','Crude'+crude_num,value.toString(),quant.toString(),owner,estTime,startLoc,dest,vessel_id.toString(),(new Date()).toISOString())
+	return contract.submitTransaction('deliverCrude',value.toString(),quant.toString(),owner,estTime,startLoc,dest,vessel_id.toString(),(new Date()).toISOString())
 }
 
-function refineRand(contract,fuel_num,crude_num) {
+function refineRand(contract,crude_id) {
 	let value = Math.floor(Math.random()*101) +1;
 	let quant = Math.floor(Math.random()*101) +1;
 	let owner = 'org3';
 	let density = Math.floor(Math.random()*101) +1;
 	let type = 'fuel';
-	return contract.submitTransaction('refine','Fuel'+fuel_num,value.toString(),quant.toString(),owner,density.toString(),type,'Crude'+crude_num,(new Date).toISOString())
+	return contract.submitTransaction('refine',value.toString(),quant.toString(),owner,density.toString(),type,crude_id,(new Date).toISOString())
 }
 
-function addFuelOrderRand(contract,fuelOrder_num,fuel_num) {
+function addFuelOrderRand(contract,fuel_id) {
 	let value = Math.floor(Math.random()*101) +1;
 	let quant = Math.floor(Math.random()*101) +1;
 	let owner = 'org3';
@@ -210,36 +210,48 @@ function addFuelOrderRand(contract,fuelOrder_num,fuel_num) {
 		dest = 'org5';
 	else if (rcoin == 1) 
 		dest = 'org6';
-	return contract.submitTransaction('addFuelOrder','FuelOrder'+fuelOrder_num,value.toString(),quant.toString(),owner,dest,'Fuel'+fuel_num,(new Date()).toISOString())
+	return contract.submitTransaction('addFuelOrder',value.toString(),quant.toString(),owner,dest,fuel_id,(new Date()).toISOString())
 }
 
-function deliverFuelRand(contract,plan_num,fuelOrders) {
+async function deliverFuelRand(contract,fuelOrders) {
 	let trackid = Math.floor(Math.random()*10001) +1;
-	let i,dest,rcoin,startLoc,time,estTime,dur;
-	startLoc = 'org3';
-	dest = 'org5/6';
-	let args_arr = ['deliverFuel','Plan'+plan_num,trackid.toString()]
+	let i,order,time,estTime,dur;
+	let args_arr = ['deliverFuel',trackid.toString()]
 	for (i = 0; i < fuelOrders.length; i++) {
+		//the plan has to start at the refiner and end at the destination of each order (see plans.go of the chaincode).
+		order = JSON.parse((await queryAsset(contract,fuelOrders[i])).toString());
 		dur = Math.floor(Math.random()*101) +1;
 		time = new Date();
 		time.setSeconds(time.getSeconds() + dur)
 		estTime = time.toISOString();
-		args_arr.push('FuelOrder'+fuelOrders[i],estTime,startLoc,dest)
+		args_arr.push(fuelOrders[i],estTime,order.AD.Owner,order.Dest)
 	}
 	return contract.submitTransaction(...args_arr)
 }
 
-function transferFuel(contract,fuelOrder_num,plan_num) {
-	return contract.submitTransaction('transfer','FuelOrder'+fuelOrder_num,'org5/6',(new Date()).toISOString(),'Plan'+plan_num)
+//the carrier declares that the asset arrived with all its quantity (see handover.go of the chaincode).
+async function arrive(contract,asset_id,plan_id) {
+	let asset = JSON.parse((await queryAsset(contract,asset_id)).toString());
+	let args = ['arrive',asset_id,asset.AD.Quantity.toString(),(new Date()).toISOString()];
+	if (plan_id)
+		args.push(plan_id);
+	return contract.submitTransaction(...args)
 }
-function transferCrude(contract,crude_num) {
-	return contract.submitTransaction('transfer','Crude'+crude_num,'org3',(new Date()).toISOString())
+
+//the destination accepts the order after it arrives.
+async function transferFuel(contract,fuelOrder_id,plan_id) {
+	await arrive(contract,fuelOrder_id,plan_id);
+	return contract.submitTransaction('transfer',fuelOrder_id,'org5/6',(new Date()).toISOString(),plan_id)
+}
+async function transferCrude(contract,crude_id) {
+	await arrive(contract,crude_id);
+	return contract.submitTransaction('transfer',crude_id,'org3',(new Date()).toISOString())
 }
 /* a client can make GET request to this server with URLs:
  /Plan , /Fuel, /FuelOrder , /Crude . These commands show all assets that exist e.g Crude1 , Crude2 ... CrudeN 
  /PlanID , /FuelID, /FuelOrderID , /CrudeID . Here ID is a number. These commands show the details of the specific asset e.g. Crude1 , Crude2413 , Plan2312
  /blocks . showing the last commited block.
- /history/AssetID . showing the history of changes in db of this asset (currently not available).
+ /history/AssetID . showing the history of changes in db of this asset.
  /org1 /org2 /org3 ... to see the account balance of these orgs.
 
  */
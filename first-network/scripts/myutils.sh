@@ -400,7 +400,7 @@ chaincodeInvokeDeliverCrude() {
   verifyResult $res "Invoke transaction failed on channel '$CHANNEL_NAME' due to uneven number of peer and org parameters "
 
   set -x
-  peer chaincode invoke -o orderer.example.com:7050 --tls $CORE_PEER_TLS_ENABLED --cafile $ORDERER_CA -C $CHANNEL_NAME -n $NAME $PEER_CONN_PARMS -c '{"Args":["deliverCrude","Crude1","0","200","orgDriller","2002-10-02T10:00:00-05:00","orgDriller","org1","342352","2003-10-02T10:00:00-05:00"]}' >&log.txt
+  peer chaincode invoke -o orderer.example.com:7050 --tls $CORE_PEER_TLS_ENABLED --cafile $ORDERER_CA -C $CHANNEL_NAME -n $NAME $PEER_CONN_PARMS -c '{"Args":["deliverCrude","0","200","orgDriller","2002-10-02T10:00:00-05:00","orgDriller","org1","342352","2003-10-02T10:00:00-05:00"]}' >&log.txt
   res=$?
   set +x
   cat log.txt
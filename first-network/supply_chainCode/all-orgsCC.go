@@ -1,26 +1,59 @@
 /*
 Gas & fuel supply chain management chaincode.
 
-
 org1 -> driller
 org2 -> shipper
 org3 -> refiner
 org4 -> distributor
 org5/6 -> retailer / fuel stations
 
-
+Each org is recognized by the MSP ID of the caller's certificate (Org1MSP -> org1 etc.)
+and may only call the functions of its role (see roles.go). The orgs above are registered by
+initLedger and more orgs can be onboarded later (see participants.go).
 
 API:
 
 deliverCrude
 refine
+setYieldRatio - ratio of fuel produced per crude consumed when refining.
 addFuelOrder - coupled with a retailer.
+acceptFuelOrder - the retailer accepts an order and its funds are locked in escrow.
+cancelFuelOrder - refund an order that is not on its way yet.
+reportFailedDelivery - refund an order that will not be delivered.
 deliverFuel - make a plan for distributing to different retailers. accumulate addFuelDelivery tx's.
-transfer - either crude or fuel
+arrive - the carrier declares that a crude or a fuel order has arrived with the delivered quantity.
+transfer - the destination accepts an arrived crude or fuel order and pays for it.
+rejectDelivery - the destination rejects an arrived crude or fuel order (see handover.go).
+addPlanOrders, removePlanOrder, reschedulePlanOrder, swapPlanVehicle, closePlan - the carrier amends a plan (see plans.go).
+registerVehicle, updateVehicle, queryVehicle - the fleet of the shippers and the distributors (see fleet.go).
+onboardParticipant, suspendParticipant, reinstateParticipant, offboardParticipant - the registrar org manages the participants.
+queryParticipants - the registry of the participants (see participants.go).
+proposePolicy, approvePolicy - the participants agree on the freight and the penalties of the carriers.
+queryPolicy, queryPolicyProposal - the versions of the pricing policy and their proposals (see policy.go).
+openDispute, respondDispute - a party of a delivery contests it and the other parties answer.
+resolveDispute - the arbiter org reverses or adjusts the payments of a disputed delivery.
+queryDispute - the latest or an earlier dispute of a delivery (see disputes.go).
 query asset
 query asset by range
+traceAsset - lineage of an asset from the Crude up to the FuelOrders.
+queryAssetHistory - every committed version of an asset or account.
+queryStatement - journal of the payments of an org.
+queryBalance - available and locked funds of an org.
+queryByOwner, queryByState, queryByDest - lookups through the secondary indexes (see index.go).
+rebuildIndexes - index the assets that were added before the indexes existed.
+richQuery - CouchDB selector over the assets (see richquery.go).
+queryAllowedTransitions - the state machine of an asset type or the actions the caller can take on an asset (see states.go).
+queryArgSchema - schemas of the JSON documents that can be passed instead of the positional args (see args.go).
+
+IDs of the assets are allocated by the chaincode and deliverCrude, refine, addFuelOrder
+and deliverFuel return the ID of the new asset (see ids.go).
+
+Money is stored in integer cents (see money.go).
 
+Times of the events are the transaction times. The times sent by the clients
+are only checked against them (see txtime.go and config.go).
 
+Every transaction that changes assets emits one chaincode event (see events.go).
 */
 package main
 
@@ -51,13 +84,14 @@ type DeliveryDetails struct {
 	Delay            float64
 	StartingLocation string
 	Destination      string
+	ETAVersion       int `json:",omitempty"` //version of the plan that agreed on EstTime
 }
 type TxProof struct {
 	URL  string
 	Hash string
 }
 type AssetDetails struct {
-	Value    float64
+	Value    Amount
 	Quantity int
 	Owner    string
 	State    string
@@ -65,7 +99,7 @@ type AssetDetails struct {
 
 /*
 Put in db with key CrudeID
-Crude ID should be like this: CrudeXXXX where XXXX is an ever increasing number.
+Crude ID is like this: CrudeXXXXXXXX where XXXXXXXX is an ever increasing number (see ids.go).
 */
 type Crude struct {
 	AD        AssetDetails
@@ -73,11 +107,13 @@ type Crude struct {
 	Proof     TxProof
 	Veh       Vehicle
 	Timestamp time.Time
+	Remaining int       //quantity that hasn't been refined yet
+	Handover  *Handover `json:",omitempty"` //set when the crude arrives (see handover.go)
 }
 
 /*
 Put in db with key FuelID
-Fuel ID should be like this: FuelXXXX where XXXX is an ever increasing number.
+Fuel ID is like this: FuelXXXXXXXX where XXXXXXXX is an ever increasing number.
 */
 type Fuel struct {
 	AD        AssetDetails
@@ -85,11 +121,13 @@ type Fuel struct {
 	Type      string
 	CrudeID   string //like parent ID
 	Timestamp time.Time
+	CrudeUsed int //quantity of crude consumed to produce this fuel
+	Remaining int //quantity that hasn't been ordered yet
 }
 
 /*
 Put in db with key FuelOrderID
-FuelOrder ID should be like this: FuelOrderXXXX where XXXX is an ever increasing number.
+FuelOrder ID is like this: FuelOrderXXXXXXXX where XXXXXXXX is an ever increasing number.
 */
 type FuelOrder struct {
 	AD        AssetDetails
@@ -97,46 +135,76 @@ type FuelOrder struct {
 	Proof     TxProof
 	FuelID    string //like parent ID
 	Timestamp time.Time
+	Retailer  string    //the retailer that placed the order
+	Handover  *Handover `json:",omitempty"` //set when the order arrives (see handover.go)
 }
 
 type FuelOrderID = string
 
 /*
-ID form : 'PlanXXXX'
+ID form : 'PlanXXXXXXXX'
 A delivery plan from refinary towards the gas stations.
 Contains the vehicle that will deliver the fuels at many fueling stations
 A map for easy access to delivery details with key the orders that org2 has added.
 */
 type FuelDeliveryPlan struct {
-	Veh  Vehicle
-	Plan map[FuelOrderID]DeliveryDetails
+	Veh        Vehicle
+	Plan       map[FuelOrderID]DeliveryDetails
+	Carrier    string      `json:",omitempty"` //distributor that made the plan
+	Version    int         //1 when it's made and +1 for every amendment (see plans.go)
+	Closed     bool        `json:",omitempty"`
+	Amendments []Amendment `json:",omitempty"`
 }
 
 type OrgAmount struct {
-	amount float64
+	amount Amount
 	org    string
+	reason string
 }
 
 func (s *SmartContract) Init(APIstub shim.ChaincodeStubInterface) sc.Response {
+	_, args := APIstub.GetFunctionAndParameters()
+	//the upgrade from the first version moves its balances and values to cents (see migrate.go).
+	if err := MigrateLedger(APIstub); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := ApplyConfigArgs(APIstub, args); err != nil {
+		return shim.Error(err.Error())
+	}
 	return shim.Success(nil)
 }
 
 /*
- * The Invoke method *
- called when an application requests to run any Smart Contract
- The app also specifies the specific smart contract function to call with args
+* The Invoke method *
+called when an application requests to run any Smart Contract
+The app also specifies the specific smart contract function to call with args
 */
 func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response {
 
 	// Retrieve the requested Smart Contract function and arguments
 	function, args := APIstub.GetFunctionAndParameters()
+	//a single JSON document is translated to the positional args (see args.go).
+	if IsJSONArgs(args) {
+		var err error
+		if args, err = ParseJSONArgs(function, args[0]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
 	// Route to the appropriate handler function to interact with the ledger
 	if function == "deliverCrude" {
 		return s.deliverCrude(APIstub, args)
 	} else if function == "refine" {
 		return s.refine(APIstub, args)
+	} else if function == "setYieldRatio" {
+		return s.setYieldRatio(APIstub, args)
 	} else if function == "addFuelOrder" {
 		return s.addFuelOrder(APIstub, args)
+	} else if function == "acceptFuelOrder" {
+		return s.acceptFuelOrder(APIstub, args)
+	} else if function == "cancelFuelOrder" {
+		return s.cancelFuelOrder(APIstub, args)
+	} else if function == "reportFailedDelivery" {
+		return s.reportFailedDelivery(APIstub, args)
 	} else if function == "deliverFuel" {
 		return s.deliverFuel(APIstub, args)
 	} else if function == "transfer" {
@@ -145,6 +213,74 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 		return s.queryAsset(APIstub, args)
 	} else if function == "queryAssetByRange" {
 		return s.queryAssetByRange(APIstub, args)
+	} else if function == "traceAsset" {
+		return s.traceAsset(APIstub, args)
+	} else if function == "queryAssetHistory" {
+		return s.queryAssetHistory(APIstub, args)
+	} else if function == "queryStatement" {
+		return s.queryStatement(APIstub, args)
+	} else if function == "queryBalance" {
+		return s.queryBalance(APIstub, args)
+	} else if function == "queryByOwner" {
+		return s.queryByOwner(APIstub, args)
+	} else if function == "queryByState" {
+		return s.queryByState(APIstub, args)
+	} else if function == "queryByDest" {
+		return s.queryByDest(APIstub, args)
+	} else if function == "rebuildIndexes" {
+		return s.rebuildIndexes(APIstub, args)
+	} else if function == "richQuery" {
+		return s.richQuery(APIstub, args)
+	} else if function == "arrive" {
+		return s.arrive(APIstub, args)
+	} else if function == "rejectDelivery" {
+		return s.rejectDelivery(APIstub, args)
+	} else if function == "addPlanOrders" {
+		return s.addPlanOrders(APIstub, args)
+	} else if function == "removePlanOrder" {
+		return s.removePlanOrder(APIstub, args)
+	} else if function == "reschedulePlanOrder" {
+		return s.reschedulePlanOrder(APIstub, args)
+	} else if function == "swapPlanVehicle" {
+		return s.swapPlanVehicle(APIstub, args)
+	} else if function == "closePlan" {
+		return s.closePlan(APIstub, args)
+	} else if function == "registerVehicle" {
+		return s.registerVehicle(APIstub, args)
+	} else if function == "updateVehicle" {
+		return s.updateVehicle(APIstub, args)
+	} else if function == "queryVehicle" {
+		return s.queryVehicle(APIstub, args)
+	} else if function == "onboardParticipant" {
+		return s.onboardParticipant(APIstub, args)
+	} else if function == "suspendParticipant" {
+		return s.suspendParticipant(APIstub, args)
+	} else if function == "reinstateParticipant" {
+		return s.reinstateParticipant(APIstub, args)
+	} else if function == "offboardParticipant" {
+		return s.offboardParticipant(APIstub, args)
+	} else if function == "queryParticipants" {
+		return s.queryParticipants(APIstub, args)
+	} else if function == "proposePolicy" {
+		return s.proposePolicy(APIstub, args)
+	} else if function == "approvePolicy" {
+		return s.approvePolicy(APIstub, args)
+	} else if function == "queryPolicy" {
+		return s.queryPolicy(APIstub, args)
+	} else if function == "queryPolicyProposal" {
+		return s.queryPolicyProposal(APIstub, args)
+	} else if function == "openDispute" {
+		return s.openDispute(APIstub, args)
+	} else if function == "respondDispute" {
+		return s.respondDispute(APIstub, args)
+	} else if function == "resolveDispute" {
+		return s.resolveDispute(APIstub, args)
+	} else if function == "queryDispute" {
+		return s.queryDispute(APIstub, args)
+	} else if function == "queryAllowedTransitions" {
+		return s.queryAllowedTransitions(APIstub, args)
+	} else if function == "queryArgSchema" {
+		return s.queryArgSchema(APIstub, args)
 	} else if function == "initLedger" {
 		return s.initLedger(APIstub, args)
 	}
@@ -153,133 +289,268 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 }
 
 /*
-args[0] = crudeID like 'CrudeXXXX'
-arg1 = value,arg2 = quantity, arg3 = owner
-arg4 = estTime, arg5 = startLoc, arg6 = dest
-arg7 = vesselID , arg8 = timestamp
+arg0 = value,arg1 = quantity, arg2 = owner
+arg3 = estTime, arg4 = startLoc, arg5 = dest
+arg6 = vesselID , arg7 = timestamp
+Returns the ID of the new Crude (see ids.go). A CrudeID sent first, as in the first version, is ignored.
 */
 func (s *SmartContract) deliverCrude(stub shim.ChaincodeStubInterface, args []string) sc.Response {
-	//check if creator is org1-shipper??
-	if len(args) != 9 {
-		return shim.Error("Incorrect number of arguments. Expecting 9")
+	caller, created, err := RequireCreation(stub, "Crude", "deliverCrude")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if args, err = DropLegacyID("Crude", args, 8); err != nil {
+		return shim.Error(err.Error())
 	}
-	AD, err := NewAssetDetails(args[1], args[2], args[3], "ON_WAY")
+	if len(args) != 8 {
+		return shim.Error("Incorrect number of arguments. Expecting 8")
+	}
+	AD, err := NewAssetDetails(args[0], args[1], args[2], created.To)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = caller.IsOrg(AD.Owner); err != nil {
+		return shim.Error(err.Error())
+	}
+	DD, err := NewDeliveryDetails(args[3], args[4], args[5])
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	DD, err := NewDeliveryDetails(args[4], args[5], args[6])
+	//the destination is looked up in the registry of the participants.
+	destRole, err := RoleOfOrg(stub, DD.Destination)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	crudeAsBytes, _ := stub.GetState(args[0])
-	if crudeAsBytes != nil {
-		return shim.Error(fmt.Sprintf("Crude with id %s already exists", args[0]))
+	if destRole != RoleRefiner {
+		return shim.Error(fmt.Sprintf("Crude should be delivered to a refiner and not to %s", DD.Destination))
 	}
-
-	Proof := NewProof()
-	//hardcoded vehID.TODO: construct base on the Hash(args[1]+args[2]...+)
-	Veh := NewVehicle("Vessel", args[7])
-	Timestamp, err := RFCtoTime(args[8])
+	Timestamp, err := TrustedTime(stub, args[7])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	//any shipper can carry the crude, but its vessel has to be registered (see fleet.go).
+	vessel, err := GetVehicle(stub, "Vessel", args[6])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	problems, err := CheckVehicle(stub, vessel, "Vessel", args[6], "", load{AD.Quantity, 1}, "")
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	crude := Crude{AD, DD, Proof, Veh, Timestamp}
-	crudeAsBytes, _ = json.Marshal(crude)
-	err = stub.PutState(args[0], crudeAsBytes) //if an crude with the same ID already exists, this will override it.
+	if problems != nil {
+		return shim.Error(strings.Join(problems, ". "))
+	}
+	id, err := NextID(stub, "Crude")
 	if err != nil {
-		return shim.Error(fmt.Sprintf("Failed to add crude: %s", args[0]))
+		return shim.Error(err.Error())
+	}
+	if err = AssignVehicle(stub, vessel, id); err != nil {
+		return shim.Error(err.Error())
 	}
 
-	return shim.Success(nil)
+	Proof := NewProof()
+	//hardcoded vehID.TODO: construct base on the Hash(args[0]+args[1]...+)
+	Veh := NewVehicle("Vessel", args[6])
+	crude := Crude{AD, DD, Proof, Veh, Timestamp, AD.Quantity, nil}
+	crudeAsBytes, _ := json.Marshal(crude)
+	err = PutAsset(stub, id, crudeAsBytes)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to add crude: %s", id))
+	}
+	ev := NewEvent(stub, EventCrudeDispatched)
+	ev.AddChange(id, "", AD.State, AD.Owner)
+	if err = ev.Emit(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(id))
 }
 
 /*
 Transform Crude oil into something useful (e.g. Fuel)
-args[0] = fuelID like 'FuelXXXX'
-arg1 = value,arg2 = quantity, arg3 = owner
-arg4 = density,arg5 = type_of_fuel, arg6 = CrudeID (ancestor ID)
-arg7 = timestamp.
+The crude consumed is quantity/yield ratio of the type of fuel (see yield.go)
+and it should not exceed the remaining quantity of the crude.
+arg0 = value,arg1 = quantity, arg2 = owner
+arg3 = density,arg4 = type_of_fuel, arg5 = CrudeID (ancestor ID)
+arg6 = timestamp.
+Returns the ID of the new Fuel. A FuelID sent first is ignored.
 */
 func (s *SmartContract) refine(stub shim.ChaincodeStubInterface, args []string) sc.Response {
-	if len(args) != 8 {
-		return shim.Error("Incorrect number of arguments. Expecting 8")
+	caller, created, err := RequireCreation(stub, "Fuel", "refine")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if args, err = DropLegacyID("Fuel", args, 7); err != nil {
+		return shim.Error(err.Error())
 	}
-	AD, err := NewAssetDetails(args[1], args[2], args[3], "REFINED")
+	if len(args) != 7 {
+		return shim.Error("Incorrect number of arguments. Expecting 7")
+	}
+	AD, err := NewAssetDetails(args[0], args[1], args[2], created.To)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	Density, err := strconv.ParseFloat(args[4], 64)
+	if err = caller.IsOrg(AD.Owner); err != nil {
+		return shim.Error(err.Error())
+	}
+	Density, err := strconv.ParseFloat(args[3], 64)
 	if err != nil {
 		return shim.Error("Density should be a float number!")
 	}
-	Timestamp, err := RFCtoTime(args[7])
+	Timestamp, err := TrustedTime(stub, args[6])
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 	//ensure crudeID exists in db.
-	crudebytes, _ := stub.GetState(args[6])
+	if AssetType(args[5]) != "Crude" {
+		return shim.Error(fmt.Sprintf("%s is not a Crude", args[5]))
+	}
+	crudebytes, err := stub.GetState(args[5])
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to get %s: %s", args[5], err.Error()))
+	}
 	if crudebytes == nil {
 		return shim.Error("ID of crude doesn't exist!")
 	}
-	if fuelbytes, _ := stub.GetState(args[0]); fuelbytes != nil {
-		return shim.Error("ID of fuel already exists.")
+	crude := Crude{}
+	if err = json.Unmarshal(crudebytes, &crude); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to decode %s", args[5]))
+	}
+	if _, err = CheckTransition(caller, "Crude", "refine", crude.AD.State, crude.AD.Owner, crude.DD.Destination); err != nil {
+		return shim.Error(err.Error())
+	}
+	ratio, err := GetYieldRatio(stub, args[4])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	crudeUsed := CrudeNeeded(AD.Quantity, ratio)
+	if crudeUsed > crude.Remaining {
+		return shim.Error(fmt.Sprintf("Refining %d of %s needs %d of crude but only %d remains in %s",
+			AD.Quantity, args[4], crudeUsed, crude.Remaining, args[5]))
+	}
+	crude.Remaining -= crudeUsed
+	crudebytes, _ = json.Marshal(crude)
+	err = PutAsset(stub, args[5], crudebytes)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to update crude: %s", args[5]))
+	}
+	id, err := NextID(stub, "Fuel")
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	fuel := Fuel{AD, Density, args[5], args[6], Timestamp}
+	fuel := Fuel{AD, Density, args[4], args[5], Timestamp, crudeUsed, AD.Quantity}
 	fuelAsBytes, _ := json.Marshal(fuel)
-	err = stub.PutState(args[0], fuelAsBytes)
+	err = PutAsset(stub, id, fuelAsBytes)
 	if err != nil {
-		return shim.Error(fmt.Sprintf("Failed to add fuel: %s", args[0]))
+		return shim.Error(fmt.Sprintf("Failed to add fuel: %s", id))
 	}
-	return shim.Success(nil)
+	ev := NewEvent(stub, EventFuelRefined)
+	ev.AddChange(id, "", AD.State, AD.Owner)
+	if err = ev.Emit(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(id))
 }
 
 /*
 Refiner adds this when a fueling station asks for an order of fuel.
-arg1-3 = asset_details
-arg4 = dest, arg5 = fuelID
-arg6 = timestamp
+The fuel should be REFINED and owned by the caller. The quantity of the order is reserved
+from the remaining quantity of the fuel and the order is OFFERED to dest, which locks its funds
+when it accepts the order with acceptFuelOrder (see escrow.go). Dest is recorded as the retailer that placed the order.
+arg0-2 = asset_details
+arg3 = dest (the retailer), arg4 = fuelID
+arg5 = timestamp
+Returns the ID of the new FuelOrder. A FuelOrderID sent first is ignored.
 */
 func (s *SmartContract) addFuelOrder(stub shim.ChaincodeStubInterface, args []string) sc.Response {
-	if len(args) != 7 {
-		return shim.Error("Incorrect number of arguments. Expecting 7")
+	caller, created, err := RequireCreation(stub, "FuelOrder", "addFuelOrder")
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	AD, err := NewAssetDetails(args[1], args[2], args[3], "READY_FOR_DISTRIBUTION")
+	if args, err = DropLegacyID("FuelOrder", args, 6); err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args) != 6 {
+		return shim.Error("Incorrect number of arguments. Expecting 6")
+	}
+	AD, err := NewAssetDetails(args[0], args[1], args[2], created.To)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	if HasPrefixOrg(args[4]) == false {
+	if err = caller.IsOrg(AD.Owner); err != nil {
+		return shim.Error(err.Error())
+	}
+	if HasPrefixOrg(args[3]) == false {
 		return shim.Error("Destination doesn't start with org!")
 	}
+	destRole, err := RoleOfOrg(stub, args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if destRole != RoleRetailer {
+		return shim.Error(fmt.Sprintf("Destination %s is not a retailer", args[3]))
+	}
+	if AD.Quantity <= 0 {
+		return shim.Error("Quantity of the order should be positive")
+	}
 	Proof := NewProof()
-	//check that fuelID exists
-
-	if fuelbytes, _ := stub.GetState(args[5]); fuelbytes == nil {
+	//check that fuelID exists and can be sold by the caller.
+	if AssetType(args[4]) != "Fuel" {
+		return shim.Error(fmt.Sprintf("%s is not a Fuel", args[4]))
+	}
+	fuelbytes, err := stub.GetState(args[4])
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to get %s: %s", args[4], err.Error()))
+	}
+	if fuelbytes == nil {
 		return shim.Error("FuelID doens't exist!")
 	}
-	Timestamp, err := RFCtoTime(args[6])
+	fuel := Fuel{}
+	if err = json.Unmarshal(fuelbytes, &fuel); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to decode %s", args[4]))
+	}
+	if _, err = CheckTransition(caller, "Fuel", "addFuelOrder", fuel.AD.State, fuel.AD.Owner, ""); err != nil {
+		return shim.Error(err.Error())
+	}
+	if AD.Quantity > fuel.Remaining {
+		return shim.Error(fmt.Sprintf("Order of %d exceeds the remaining quantity %d of %s", AD.Quantity, fuel.Remaining, args[4]))
+	}
+	Timestamp, err := TrustedTime(stub, args[5])
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	//check that fuelOrderID doens't exist
-	if fuelOrderbytes, _ := stub.GetState(args[1]); fuelOrderbytes != nil {
-		return shim.Error("FuelOrderID already exists")
+	//NextID rejects an ID that is already taken, so an existing order is never overwritten.
+	id, err := NextID(stub, "FuelOrder")
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	fuelOrder := FuelOrder{AD, args[4], Proof, args[5], Timestamp}
+	fuel.Remaining -= AD.Quantity
+	fuelbytes, _ = json.Marshal(fuel)
+	err = PutAsset(stub, args[4], fuelbytes)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to update fuel: %s", args[4]))
+	}
+	fuelOrder := FuelOrder{AD, args[3], Proof, args[4], Timestamp, args[3], nil}
 	fuelAsBytes, _ := json.Marshal(fuelOrder)
-	err = stub.PutState(args[0], fuelAsBytes)
+	err = PutAsset(stub, id, fuelAsBytes)
 	if err != nil {
-		return shim.Error(fmt.Sprintf("Failed to add fuelOrder: %s", args[0]))
+		return shim.Error(fmt.Sprintf("Failed to add fuelOrder: %s", id))
 	}
-	return shim.Success(nil)
+	ev := NewEvent(stub, EventFuelOrderAdded)
+	ev.AddChange(id, "", AD.State, AD.Owner)
+	if err = ev.Emit(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(id))
 
 }
 
 /*
 Make a Fuel Delivery Plan based on existing FuelOrders. A track should deliver fuel to all fueling stations mentioned in the
-Delivery Plan.
+Delivery Plan. The plan has to match the FuelOrders and the truck of the caller or it's rejected
+with a PlanError (see plans.go and fleet.go).
 args of this invokation:
-	PlanID
+
 	TruckID
 	{FuelOrderID,EstTime,Sloc,Dest}
 	{FuelOrderID,EstTime,Sloc,Dest}
@@ -287,186 +558,284 @@ args of this invokation:
 	.
 	.
 	{FuelOrderID,EstTime,Sloc,Dest}
+
+Returns the ID of the new Plan. A PlanID sent before the TruckID is ignored.
 */
 func (s *SmartContract) deliverFuel(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	caller, err := GetCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	//the PlanID that the first version took before the TruckID is dropped (see DropLegacyID).
+	if len(args)%4 == 2 && AssetType(args[0]) == "Plan" {
+		args = args[1:]
+	}
 	//check that client supplied properly the # of args
-	if len(args) < 2 {
+	if len(args) < 1 {
 		return shim.Error("Expecting more args")
 	}
-	Veh := NewVehicle("Truck", args[1])
-	orders := args[2:]
+	Veh := NewVehicle("Truck", args[0])
+	orders := args[1:]
 	if len(orders) == 0 {
 		return shim.Error("At least one delivery should be specified")
 	} else if len(orders)%4 != 0 {
 		return shim.Error(fmt.Sprintf("Arguments dont match!Pattern should be {FuelOrderID,EstTime,Sloc,Dest}... Instead args are %d", len(orders)))
 	}
-	Plan := make(map[FuelOrderID]DeliveryDetails)
 	//orders[i] = FuelorderID , orders[i+1] = estTime , i+2 = sloc , i+3 = dest
+	planned, err := ValidatePlan(stub, caller, "deliverFuel", args[0], orders, load{}, "")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	Plan := make(map[FuelOrderID]DeliveryDetails)
+	ev := NewEvent(stub, EventFuelDispatched)
 	//change everys FuelOrder's state to ON_WAY and create a new DeliveryDetail for it.
-	for i := 0; i < len(orders); i += 4 {
-		var id FuelOrderID = orders[i]
-		fuelOrderbytes, _ := stub.GetState(id)
-		if fuelOrderbytes == nil {
-			return shim.Error(fmt.Sprintf("FuelOrderID %s does not exist", id))
-		}
-		fuelOrder := FuelOrder{}
-		json.Unmarshal(fuelOrderbytes, &fuelOrder)
-		fuelOrder.AD.State = "ON_WAY"
+	for _, p := range planned {
+		fuelOrder := p.FuelOrder
+		ev.AddChange(p.ID, fuelOrder.AD.State, p.To, fuelOrder.AD.Owner)
+		fuelOrder.AD.State = p.To
 		newFuelOrderbytes, _ := json.Marshal(fuelOrder)
-		err := stub.PutState(id, newFuelOrderbytes)
+		err = PutAsset(stub, p.ID, newFuelOrderbytes)
 		if err != nil {
-			return shim.Error(fmt.Sprint("Failed to add %s with different state", id))
+			return shim.Error(fmt.Sprintf("Failed to add %s with different state", p.ID))
 
 		}
-		DD, err := NewDeliveryDetails(orders[i+1], orders[i+2], orders[i+3])
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		Plan[id] = DD
+		p.DD.ETAVersion = 1
+		Plan[p.ID] = p.DD
 	}
 
-	fuelDeliveryPlan := FuelDeliveryPlan{Veh, Plan}
+	planID, err := NextID(stub, "Plan")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	truck, err := GetVehicle(stub, "Truck", args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = AssignVehicle(stub, truck, planID); err != nil {
+		return shim.Error(err.Error())
+	}
+	fuelDeliveryPlan := FuelDeliveryPlan{Veh: Veh, Plan: Plan, Carrier: caller.Org, Version: 1}
 	fuelDeliveryPlanAsBytes, _ := json.Marshal(fuelDeliveryPlan)
-	err := stub.PutState(args[0], fuelDeliveryPlanAsBytes)
+	err = PutAsset(stub, planID, fuelDeliveryPlanAsBytes)
 	if err != nil {
-		return shim.Error(fmt.Sprint("Failed to add Plan %s in db", args[0]))
+		return shim.Error(fmt.Sprintf("Failed to add Plan %s in db", planID))
 
 	}
-
-	return shim.Success(nil)
+	ev.SetPlan(planID, fuelDeliveryPlan.Version)
+	if err = ev.Emit(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(planID))
 
 }
 
 /*
-if we want to transfer FuelOrder then we should supply {FuelOrderID,owner,curtime,PlanID}
-if we want to transfer Crude then we should supply {Crude,owner,curtime}
+if we want to transfer FuelOrder then we should supply {FuelOrderID,owner,curtime,PlanID,received}
+if we want to transfer Crude then we should supply {Crude,owner,curtime,"",received}
+received is the quantity that the destination received and is optional. If it's not given,
+the quantity declared by the carrier is received.
+Only the destination of the delivery can accept the transfer after the carrier has declared
+its arrival (see handover.go), so owner must be the caller's org.
 
 Transportation orgs get paid based on the quantity of fuel or crude oil they are delivering.
-
+The carrier and the supplier are paid for the received quantity only and a shortfall above
+the tolerance opens a dispute (see disputes.go).
 */
 func (s *SmartContract) transfer(stub shim.ChaincodeStubInterface, args []string) sc.Response {
-	if len(args) != 4 && len(args) != 3 {
+	if len(args) < 3 || len(args) > 5 {
 		return shim.Error("Wrong # of arguments.")
 	}
 	if ok := HasPrefixOrg(args[1]); ok == false {
 		return shim.Error("Owner is not an org")
 	}
-	Timestamp, err := RFCtoTime(args[2])
+	caller, err := GetCaller(stub)
 	if err != nil {
-		return shim.Error("Timestamp not in RFC3339 format.")
+		return shim.Error(err.Error())
+	}
+	if err = caller.IsOrg(args[1]); err != nil {
+		return shim.Error(err.Error())
+	}
+	Timestamp, err := TrustedTime(stub, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	assetAsBytes, err := stub.GetState(args[0])
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to get %s: %s", args[0], err.Error()))
 	}
-	assetAsBytes, _ := stub.GetState(args[0])
 	if assetAsBytes == nil {
 		return shim.Error("Could not locate Asset")
 	}
+	received := ""
+	if len(args) == 5 {
+		received = args[4]
+	}
+	//the freight of the carrier is set by the current policy (see policy.go).
+	policy, err := GetPolicy(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var ev *Event
+	var dispute *Dispute
 	switch id := args[0]; {
 	case strings.HasPrefix(id, "Crude"):
 		crude := Crude{}
-		json.Unmarshal(assetAsBytes, &crude)
-
-		logger := shim.NewLogger("myloger")
-
-		fmt.Println("OK BEFORE dd transfer")
-		logger.Critical("OK BEFORE dd transfer")
-		timePenalty := crude.DD.transfer(Timestamp)
-		fmt.Println("OK BEFORE ad transfer")
-		logger.Critical("OK BEFORE ad transfer")
-		err := crude.AD.transfer(args[1])
-		fmt.Println("OK AFTER ad transfer")
+		if err = json.Unmarshal(assetAsBytes, &crude); err != nil {
+			return shim.Error(fmt.Sprintf("Failed to decode %s", id))
+		}
+		t, err := CheckTransition(caller, "Crude", "transfer", crude.AD.State, crude.AD.Owner, crude.DD.Destination)
 		if err != nil {
 			return shim.Error(err.Error())
 		}
+		ev = NewEvent(stub, EventCrudeDelivered)
+		ev.AddChange(id, crude.AD.State, t.To, args[1])
+		crude.AD.transfer(args[1], t)
+		if err = crude.Handover.accept(Timestamp, received, crude.AD.Quantity); err != nil {
+			return shim.Error(err.Error())
+		}
+		if dispute, err = CheckShortfall(stub, delivery{id, &crude.AD, crude.Handover, crude.DD.Destination, &crude}); err != nil {
+			return shim.Error(err.Error())
+		}
+		crude.Remaining = crude.Handover.Received
 
 		//the new owner shall pay shipper based on the quantity he delivered
-		//and driller based on the value of the crude oil.
-		shipperPayment := float64(crude.AD.Quantity)/10.0 - timePenalty
-		if shipperPayment < 0 {
-			shipperPayment = 0
-		}
-		drillerPayment := crude.AD.Value
-		payments := []OrgAmount{{shipperPayment, "org2"}, {drillerPayment, "org1"}}
-		logger.Critical("OK BEFORE PAY")
-		err = Pay(stub, crude.AD, payments)
-		logger.Critical("OK AFTER PAY")
+		//and driller based on the value of the crude oil that was received.
+		//both are resolved through the registry of the participants.
+		shipper, err := PayeeOf(stub, crude.Handover.Carrier, RoleShipper)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		driller, err := PayeeOf(stub, crude.Handover.Supplier, RoleDriller)
 		if err != nil {
 			return shim.Error(err.Error())
 		}
+		applied := policy.Apply(shipper, crude.DD.StartingLocation, crude.DD.Destination, crude.Handover.Received, crude.DD.Delay)
+		crude.Handover.Pricing = &applied
+		drillerPayment := crude.AD.Value.ProRata(crude.Handover.Received, crude.AD.Quantity)
+		payments := []OrgAmount{{applied.Freight, shipper, ReasonFreight}, {drillerPayment, driller, ReasonGoods}}
+		if err = Pay(stub, id, crude.AD, payments); err != nil {
+			return shim.Error(err.Error())
+		}
+		ev.AddPayments(crude.AD.Owner, payments)
 
 		assetAsBytes, _ = json.Marshal(crude)
-		err = stub.PutState(id, assetAsBytes)
-		fmt.Println("OK AFTER pputstate")
-		if err != nil {
+		if err = PutAsset(stub, id, assetAsBytes); err != nil {
 			return shim.Error(fmt.Sprintf("Failed to put %s in db", id))
 		}
 	//change state of fuel and compute delay in deliveryPlan struct
 	case strings.HasPrefix(id, "FuelOrder"):
+		if len(args) < 4 || args[3] == "" {
+			return shim.Error("PlanID of the FuelOrder is missing")
+		}
 		fuelOrder := FuelOrder{}
-		json.Unmarshal(assetAsBytes, &fuelOrder)
-		err := fuelOrder.AD.transfer(args[1])
+		if err = json.Unmarshal(assetAsBytes, &fuelOrder); err != nil {
+			return shim.Error(fmt.Sprintf("Failed to decode %s", id))
+		}
+		t, err := CheckTransition(caller, "FuelOrder", "transfer", fuelOrder.AD.State, fuelOrder.AD.Owner, fuelOrder.Dest)
 		if err != nil {
 			return shim.Error(err.Error())
 		}
-		if strings.HasPrefix(args[3], "Plan") == false {
-			return shim.Error("PlanID is not of the form 'PlanXXX'")
+		ev = NewEvent(stub, EventFuelOrderDelivered)
+		ev.AddChange(id, fuelOrder.AD.State, t.To, args[1])
+		fuelOrder.AD.transfer(args[1], t)
+		if err = fuelOrder.Handover.accept(Timestamp, received, fuelOrder.AD.Quantity); err != nil {
+			return shim.Error(err.Error())
 		}
-		dplanAsBytes, _ := stub.GetState(args[3])
-		if dplanAsBytes == nil {
-			return shim.Error("Could not locate Plan")
+		//the delay was computed when the order arrived.
+		_, dd, err := GetPlanDelivery(stub, args[3], id)
+		if err != nil {
+			return shim.Error(err.Error())
 		}
-		dplan := FuelDeliveryPlan{}
-		json.Unmarshal(dplanAsBytes, &dplan)
-		dd, ok := dplan.Plan[id]
-		if ok == false {
-			return shim.Error("FuelOrderID didn't exist in any plan")
+		if dispute, err = CheckShortfall(stub, delivery{id, &fuelOrder.AD, fuelOrder.Handover, fuelOrder.Dest, &fuelOrder}); err != nil {
+			return shim.Error(err.Error())
 		}
 
-		timePenalty := dd.transfer(Timestamp)
-		dplan.Plan[id] = dd
-		dplanAsBytes, _ = json.Marshal(dplan)
-		err = stub.PutState(args[3], dplanAsBytes)
+		//the new owner shall pay tracker based on the quantity he delivered
+		//and refiner based on the value of the fuel that was received.
+		//both are resolved through the registry of the participants.
+		tracker, err := PayeeOf(stub, fuelOrder.Handover.Carrier, RoleDistributor)
 		if err != nil {
-			return shim.Error(fmt.Sprintf("Failed to put %s in db", args[3]))
+			return shim.Error(err.Error())
+		}
+		refiner, err := PayeeOf(stub, fuelOrder.Handover.Supplier, RoleRefiner)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		applied := policy.Apply(tracker, dd.StartingLocation, dd.Destination, fuelOrder.Handover.Received, dd.Delay)
+		fuelOrder.Handover.Pricing = &applied
+		refinerPayment := fuelOrder.AD.Value.ProRata(fuelOrder.Handover.Received, fuelOrder.AD.Quantity)
+		payments := []OrgAmount{{applied.Freight, tracker, ReasonFreight}, {refinerPayment, refiner, ReasonGoods}}
+		//orders with an escrow have been paid in advance.
+		escrow, err := GetEscrow(stub, id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if escrow != nil {
+			err = ReleaseEscrow(stub, *escrow, payments)
+		} else {
+			err = Pay(stub, id, fuelOrder.AD, payments)
 		}
-
-		//the new owner shall pay tracker based on the quantity he delivered
-		//and refiner based on the value of the fuel order.
-		trackPayment := float64(fuelOrder.AD.Quantity)/10.0 - timePenalty
-		if trackPayment < 0 {
-			trackPayment = 0
-		}
-		refinerPayment := fuelOrder.AD.Value
-		payments := []OrgAmount{{trackPayment, "org4"}, {refinerPayment, "org3"}}
-		err = Pay(stub, fuelOrder.AD, payments)
 		if err != nil {
 			return shim.Error(err.Error())
 		}
+		ev.AddPayments(fuelOrder.AD.Owner, payments)
 
 		assetAsBytes, _ = json.Marshal(fuelOrder)
-		err = stub.PutState(id, assetAsBytes)
+		err = PutAsset(stub, id, assetAsBytes)
 		if err != nil {
 			return shim.Error(fmt.Sprintf("Failed to put %s in db", id))
 		}
 	default:
 		return shim.Error("Either this is not a valid ID or it's not deliverable")
 	}
+	//the delivery is frozen by the dispute of its shortfall.
+	if dispute != nil {
+		ev.AddChange(dispute.AssetID, dispute.FrozenState, StateDisputed, args[1])
+		ev.AddDispute(dispute.AssetID)
+	}
+	if err = ev.Emit(stub); err != nil {
+		return shim.Error(err.Error())
+	}
 	return shim.Success(nil)
 }
 
+/*
+args[0] = ID of an asset or an org (its account is returned)
+*/
 func (s *SmartContract) queryAsset(stub shim.ChaincodeStubInterface, args []string) sc.Response {
 	if len(args) != 1 {
 		return shim.Error("Incorect # of args")
 	}
-	assetAsBytes, _ := stub.GetState(args[0])
+	key := args[0]
+	if HasPrefixOrg(key) {
+		var err error
+		if key, err = AccountKey(stub, args[0]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	assetAsBytes, _ := stub.GetState(key)
 	if assetAsBytes == nil {
 		return shim.Error("Could not locate asset")
 	}
 	return shim.Success(assetAsBytes)
 }
 
+/*
+args[0] = type, one of {Crude,Fuel,FuelOrder,Plan}
+optional args:
+args[1] = page size (0 means all the assets in one page)
+args[2] = bookmark returned by the previous page ("" for the first page)
+args[3:] = filters of the form field=value, where field is one of {owner,state,dest,from,to}.
+from and to are RFC3339 times compared with the Timestamp of the asset.
+
+With only args[0] an array of {Key,Record} is returned, otherwise a page of the
+form {Records:[{Key,Record}...],FetchedRecordsCount,Bookmark}. With filters, pages are read
+until page size records match or the range ends, so only the last page can be shorter.
+FetchedRecordsCount is the number of records of the page and Bookmark is empty after the last page.
+*/
 func (s *SmartContract) queryAssetByRange(stub shim.ChaincodeStubInterface, args []string) sc.Response {
-	var startKey, endKey string
-	if len(args) != 1 {
-		return shim.Error("Expecting 1 arg")
+	if len(args) != 1 && len(args) < 3 {
+		return shim.Error("Expecting 1 arg or at least 3 args")
 	}
 	switch id := args[0]; id {
 	case "Crude":
@@ -476,76 +845,128 @@ func (s *SmartContract) queryAssetByRange(stub shim.ChaincodeStubInterface, args
 	default:
 		return shim.Error("Arg should be one of {Crude,Fuel,FuelOrder,Plan}")
 	}
-	startKey = args[0] + "0"
-	endKey = args[0] + "999"
+	startKey, endKey := AssetRange(args[0])
+	page := &assetPage{typ: args[0]}
+	page.buffer.WriteString("[")
+	if len(args) == 1 {
+		resultsIterator, err := stub.GetStateByRange(startKey, endKey)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		defer resultsIterator.Close()
+		if _, err = page.read(resultsIterator); err != nil {
+			return shim.Error(err.Error())
+		}
+		page.buffer.WriteString("]")
+		return shim.Success(page.buffer.Bytes())
+	}
 
-	resultsIterator, err := stub.GetStateByRange(startKey, endKey)
-	if err != nil {
+	pageSize, err := strconv.ParseInt(args[1], 10, 32)
+	if err != nil || pageSize < 0 {
+		return shim.Error("Page size should be a non negative int number")
+	}
+	if page.filter, err = NewAssetFilter(args[0], args[3:]); err != nil {
 		return shim.Error(err.Error())
 	}
-	defer resultsIterator.Close()
+	page.size = int(pageSize)
+	bookmark := args[2]
+	for {
+		resultsIterator, metadata, err := stub.GetStateByRangeWithPagination(startKey, endKey, int32(pageSize), bookmark)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		next, err := page.read(resultsIterator)
+		resultsIterator.Close()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		//the page got full before the records that were read ran out, so the next page starts at the first record left.
+		if next != "" {
+			bookmark = next
+			break
+		}
+		bookmark = metadata.Bookmark
+		if bookmark == "" || page.full() {
+			break
+		}
+	}
+	page.buffer.WriteString("]")
+	page.buffer.WriteString(fmt.Sprintf(", \"FetchedRecordsCount\":%d, \"Bookmark\":\"%s\"}", page.count, bookmark))
+	return shim.Success(append([]byte("{\"Records\":"), page.buffer.Bytes()...))
+}
+
+//records of a range query that match the type and the filter, up to size records (0 means all).
+type assetPage struct {
+	typ    string
+	filter AssetFilter
+	size   int
+	count  int
+	buffer bytes.Buffer
+}
+
+func (page *assetPage) full() bool {
+	return page.size > 0 && page.count == page.size
+}
 
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-	bArrayMemberAlreadyWritten := false
+//add the matching records of the iterator to the page. Returns the key of the first record left when the page is full.
+func (page *assetPage) read(resultsIterator shim.StateQueryIteratorInterface) (string, error) {
 	for resultsIterator.HasNext() {
 		queryResponse, err := resultsIterator.Next()
 		if err != nil {
-			return shim.Error(err.Error())
+			return "", err
+		}
+		//keep only the keys of the requested type.
+		if AssetType(queryResponse.Key) != page.typ {
+			continue
+		}
+		if page.full() {
+			return queryResponse.Key, nil
+		}
+		if ok, err := page.filter.Match(queryResponse.Value); err != nil {
+			return "", fmt.Errorf("Failed to decode %s", queryResponse.Key)
+		} else if ok == false {
+			continue
 		}
 		// Add comma before array members,suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
-		}
-		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
-		buffer.WriteString("\"")
-		buffer.WriteString(", \"Record\":")
+		if page.count > 0 {
+			page.buffer.WriteString(",")
+		}
+		page.buffer.WriteString("{\"Key\":")
+		page.buffer.WriteString("\"")
+		page.buffer.WriteString(queryResponse.Key)
+		page.buffer.WriteString("\"")
+		page.buffer.WriteString(", \"Record\":")
 		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+		page.buffer.WriteString(string(queryResponse.Value))
+		page.buffer.WriteString("}")
+		page.count++
 	}
-	buffer.WriteString("]")
-	fmt.Printf("- query:\n%s\n", buffer.String())
-	return shim.Success(buffer.Bytes())
+	return "", nil
 }
 
 /*
-Create accounts for each organization.
-Form of accounts : key=org_name (e.g 'org1') and value=100000 (arbitrary starting amount)
-An adversary can call initLedger multiple times in order to eliminate his debt,
+Register the orgs of the network as participants (see participants.go) and create accounts for each organization.
+Form of accounts : key=Account~org_name (e.g 'org1') and value=Account with 100000.00 EUR (arbitrary starting amount)
+Buyers get the credit limit of CreditLimits (see money.go).
+Orgs that join later are onboarded by the registrar with onboardParticipant.
+An adversary can call initLedger multiple times in order to eliminate their debt,
 so we make a check before proceeding into actions.
 */
 func (s *SmartContract) initLedger(stub shim.ChaincodeStubInterface, args []string) sc.Response {
-	if bytes, _ := stub.GetState("org1"); bytes != nil {
+	if _, err := GetAccount(stub, "org1"); err == nil {
 		return shim.Error("initLedger has been called already and should be called only once!")
 	}
-	jbytes, _ := json.Marshal(100000.0)
-	err := stub.PutState("org1", jbytes)
-	if err != nil {
-		return shim.Error("Failed to create account for org1")
-	}
-	err = stub.PutState("org2", jbytes)
-	if err != nil {
-		return shim.Error("Failed to create account for org2")
-	}
-	err = stub.PutState("org3", jbytes)
-	if err != nil {
-		return shim.Error("Failed to create account for org3")
-	}
-	err = stub.PutState("org4", jbytes)
-	if err != nil {
-		return shim.Error("Failed to create account for org4")
-	}
-	err = stub.PutState("org5", jbytes)
-	if err != nil {
-		return shim.Error("Failed to create account for org5")
+	//the accounts of the first version are migrated by Init, not replaced.
+	if legacy, err := IsLegacyLedger(stub); err != nil {
+		return shim.Error(err.Error())
+	} else if legacy {
+		return shim.Error("initLedger has been called already by the previous version. Upgrade the chaincode to migrate its accounts")
 	}
-	err = stub.PutState("org6", jbytes)
-	if err != nil {
-		return shim.Error("Failed to create account for org6")
+	for _, p := range defaultParticipants {
+		err := Onboard(stub, p, NewAccount(100000*MinorUnits, CreditLimits[p.Org]))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
 	}
 	return shim.Success(nil)
 }
@@ -554,30 +975,23 @@ func HasPrefixOrg(s string) bool {
 	return strings.HasPrefix(s, "org")
 }
 
-func (ad *AssetDetails) transfer(own string) error {
-	if ad.State != "ON_WAY" {
-		return errors.New("Cannot transfer asset if it's state is not ON_WAY")
-	}
-	ad.State = "DELIVERED"
+//the new owner after a transfer that was checked with CheckTransition.
+func (ad *AssetDetails) transfer(own string, t Transition) {
+	ad.State = t.To
 	ad.Owner = own
-	return nil
 }
 
-func (dd *DeliveryDetails) transfer(tstamp time.Time) float64 {
+//record the delay of a delivery that arrived at tstamp.
+func (dd *DeliveryDetails) arrive(tstamp time.Time) {
 	dd.Delay = tstamp.Sub(dd.EstTime).Seconds()
-	timePenalty := dd.Delay / 100.0
-	if timePenalty < 0 {
-		return 0
-	}
-	return timePenalty
 }
 
 //construct a new AssetDetails type based on supplied args
 func NewAssetDetails(val, quant, own, st string) (AssetDetails, error) {
 	//value can be zero if shipper doesn't want to make it public.
-	value, err := strconv.ParseFloat(val, 64)
+	value, err := ParseAmount(val)
 	if err != nil || value < 0 {
-		return AssetDetails{}, errors.New("Value is not a float number")
+		return AssetDetails{}, errors.New("Value is not a decimal number with at most 2 decimal digits")
 	}
 	quantity, err := strconv.ParseInt(quant, 10, 64)
 	if err != nil || quantity < 0 {
@@ -602,7 +1016,7 @@ func NewDeliveryDetails(est, sloc, dest string) (DeliveryDetails, error) {
 	if HasPrefixOrg(dest) == false {
 		return DeliveryDetails{}, errors.New("Destination value is not prefixed with 'org'")
 	}
-	return DeliveryDetails{estTime, 0, sloc, dest}, nil
+	return DeliveryDetails{estTime, 0, sloc, dest, 0}, nil
 }
 
 /*
@@ -610,48 +1024,41 @@ OrgAmount slice contains which orgs the current owner should pay from the asset
 and how much (the amount).Amounts should be always non negative.
 oa[0].org = organization who delivers (e.g. shipper)
 oa[1].org = organization who supplies (e.g. refiner or driller)
+All accounts should exist and the buyer's balance can't go below -CreditLimit.
+If Pay returns an error nothing should be committed, so the caller must abort the transaction.
+Every payment is written in the journal with assetID as its source (see journal.go).
+Pay doesn't emit an event itself. The caller adds the payments to the event of its
+transaction (see Event.AddPayments), since only one event per transaction is kept.
 */
-func Pay(stub shim.ChaincodeStubInterface, ad AssetDetails, oa []OrgAmount) error {
-	//get the current account amounts
-	orgBuyAccBytes, err := stub.GetState(ad.Owner)
-	if err != nil {
-		return errors.New("Please call initLedger before transfer")
-	}
-	orgSell1AccBytes, err := stub.GetState(oa[0].org)
-	if err != nil {
-		return errors.New("Please call initLedger before transfer")
+func Pay(stub shim.ChaincodeStubInterface, assetID string, ad AssetDetails, oa []OrgAmount) error {
+	//get the current accounts. The buyer may also be one of the sellers.
+	orgs := []string{ad.Owner}
+	for _, p := range oa {
+		if p.amount < 0 {
+			return errors.New("Amounts to be paid should be positive")
+		}
+		orgs = append(orgs, p.org)
 	}
-	orgSell2AccBytes, err := stub.GetState(oa[1].org)
+	accounts, orgs, err := GetAccounts(stub, orgs)
 	if err != nil {
-		return errors.New("Please call initLedger before transfer")
-	}
-	if oa[0].amount < 0 || oa[1].amount < 0 {
-		return errors.New("Amounts to be paid should be positive")
+		return err
 	}
-	var orgBuyAmount, orgSell1Amount, orgSell2Amount float64
-	json.Unmarshal(orgBuyAccBytes, &orgBuyAmount)
-	json.Unmarshal(orgSell1AccBytes, &orgSell1Amount)
-	json.Unmarshal(orgSell2AccBytes, &orgSell2Amount)
 	//update the accounts
-	orgBuyAmount -= oa[0].amount + oa[1].amount //buyer should pay both the dristributor and supplier
-	orgSell1Amount += oa[0].amount              //distributor gets paid by buyer
-	orgSell2Amount += oa[1].amount              //supplier gets paid by buyer
-	orgBuyAccBytes, err = json.Marshal(orgBuyAmount)
-	orgSell1AccBytes, err = json.Marshal(orgSell1Amount)
-	orgSell2AccBytes, err = json.Marshal(orgSell2Amount)
-	err = stub.PutState(ad.Owner, orgBuyAccBytes)
-	if err != nil {
-		errors.New(fmt.Sprintf("Failed to add new amount for %s org", ad.Owner))
+	var total Amount
+	for _, p := range oa {
+		total += p.amount
+		accounts[p.org].Balance += p.amount //distributor and supplier get paid by buyer
 	}
-	err = stub.PutState(oa[0].org, orgSell1AccBytes)
-	if err != nil {
-		errors.New(fmt.Sprintf("Failed to add new amount for %s org", oa[0].org))
+	buyer := accounts[ad.Owner]
+	buyer.Balance -= total //buyer should pay both the dristributor and supplier
+	if buyer.Balance < -buyer.CreditLimit {
+		return fmt.Errorf("%s can't pay %s. Balance would be %s and the credit limit is %s",
+			ad.Owner, total, buyer.Balance, buyer.CreditLimit)
 	}
-	err = stub.PutState(oa[1].org, orgSell2AccBytes)
-	if err != nil {
-		errors.New(fmt.Sprintf("Failed to add new amount for %s org", oa[1].org))
+	if err = PutAccounts(stub, accounts, orgs); err != nil {
+		return err
 	}
-	return nil
+	return WriteJournal(stub, assetID, ad.Owner, oa)
 }
 
 /*
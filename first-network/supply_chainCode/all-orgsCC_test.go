@@ -0,0 +1,649 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+//MSP ID of the caller of the next invocation. MockStub has no creator, so GetCaller reads it from here.
+var testMSPID string
+
+func init() {
+	getMSPID = func(stub cid.ChaincodeStubInterface) (string, error) {
+		return testMSPID, nil
+	}
+}
+
+var testTxCount int
+
+//a new ledger with the accounts of initLedger.
+func newTestStub(t *testing.T) *shim.MockStub {
+	t.Helper()
+	stub := shim.NewMockStub("supplychain", new(SmartContract))
+	if res := stub.MockInit("init", [][]byte{[]byte("init")}); res.Status != shim.OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+	mustInvoke(t, stub, "Org1MSP", "initLedger")
+	registerTestFleet(t, stub)
+	return stub
+}
+
+//the vessels of org2 and the trucks of org4 that the tests use.
+func registerTestFleet(t *testing.T, stub *shim.MockStub) {
+	t.Helper()
+	expiry := time.Now().UTC().AddDate(1, 0, 0).Format(time.RFC3339)
+	for _, id := range []string{"V1", "V2", "V3"} {
+		mustInvoke(t, stub, "Org2MSP", "registerVehicle", "Vessel", id, "1000", "0", expiry)
+	}
+	for _, id := range []string{"T1", "T2", "T3", "T9"} {
+		mustInvoke(t, stub, "Org4MSP", "registerVehicle", "Truck", id, "40000", "6", expiry)
+	}
+}
+
+//invoke the chaincode as a client of msp and drop the emitted event.
+func invoke(stub *shim.MockStub, msp string, args ...string) sc.Response {
+	testMSPID = msp
+	testTxCount++
+	bargs := make([][]byte, len(args))
+	for i, arg := range args {
+		bargs[i] = []byte(arg)
+	}
+	res := stub.MockInvoke(fmt.Sprintf("tx%d", testTxCount), bargs)
+	//the events channel is buffered, so it has to be drained.
+	for len(stub.ChaincodeEventsChannel) > 0 {
+		<-stub.ChaincodeEventsChannel
+	}
+	return res
+}
+
+//invoke and fail the test if the invocation fails. Returns the payload.
+func mustInvoke(t *testing.T, stub *shim.MockStub, msp string, args ...string) string {
+	t.Helper()
+	res := invoke(stub, msp, args...)
+	if res.Status != shim.OK {
+		t.Fatalf("%s failed: %s", args[0], res.Message)
+	}
+	return string(res.Payload)
+}
+
+//invoke and fail the test unless the invocation fails with an error that contains msg.
+func mustFail(t *testing.T, stub *shim.MockStub, msg string, msp string, args ...string) {
+	t.Helper()
+	res := invoke(stub, msp, args...)
+	if res.Status == shim.OK {
+		t.Fatalf("%s should fail with '%s' but succeeded", args[0], msg)
+	}
+	if strings.Contains(res.Message, msg) == false {
+		t.Fatalf("%s should fail with '%s' but failed with '%s'", args[0], msg, res.Message)
+	}
+}
+
+//put a value in db outside of the chaincode, e.g. to prepare a broken state.
+func putTestState(t *testing.T, stub *shim.MockStub, key string, value interface{}) {
+	t.Helper()
+	valueAsBytes, _ := json.Marshal(value)
+	stub.MockTransactionStart("prepare")
+	defer stub.MockTransactionEnd("prepare")
+	if err := stub.PutState(key, valueAsBytes); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getTestState(t *testing.T, stub *shim.MockStub, key string, value interface{}) {
+	t.Helper()
+	valueAsBytes := stub.State[key]
+	if valueAsBytes == nil {
+		t.Fatalf("%s doesn't exist", key)
+	}
+	if err := json.Unmarshal(valueAsBytes, value); err != nil {
+		t.Fatalf("Failed to decode %s: %s", key, err.Error())
+	}
+}
+
+func testNow() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+//an estimated time of arrival that can't cause a delay penalty.
+func testLater() string {
+	return time.Now().UTC().Add(time.Hour).Format(time.RFC3339)
+}
+
+//a ledger with 100 of crude delivered at org3 and 80 of fuel refined from it.
+func newTestFuel(t *testing.T) (*shim.MockStub, string) {
+	t.Helper()
+	stub := newTestStub(t)
+	now := testNow()
+	crudeID := mustInvoke(t, stub, "Org1MSP", "deliverCrude", "50", "100", "org1", testLater(), "org1", "org3", "V1", now)
+	mustInvoke(t, stub, "Org2MSP", "arrive", crudeID, "100", now)
+	mustInvoke(t, stub, "Org3MSP", "transfer", crudeID, "org3", now)
+	fuelID := mustInvoke(t, stub, "Org3MSP", "refine", "40", "80", "org3", "0.8", "diesel", crudeID, now)
+	return stub, fuelID
+}
+
+func TestAddFuelOrder(t *testing.T) {
+	now := testNow()
+	old := time.Now().UTC().Add(-time.Hour).Format(time.RFC3339)
+	cases := []struct {
+		name    string
+		prepare func(t *testing.T, stub *shim.MockStub, fuelID string)
+		msp     string
+		//FUEL is replaced by the ID of the fuel.
+		args []string
+		err  string
+	}{
+		{"ok", nil, "Org3MSP", []string{"20.50", "30", "org3", "org5", "FUEL", now}, ""},
+		{"all the remaining fuel", nil, "Org3MSP", []string{"20.50", "80", "org3", "org6", "FUEL", now}, ""},
+		{"caller is not a refiner", nil, "Org5MSP", []string{"20.50", "30", "org3", "org5", "FUEL", now}, "is not allowed"},
+		{"owner is not the caller", nil, "Org3MSP", []string{"20.50", "30", "org4", "org5", "FUEL", now}, "doesn't match the caller"},
+		{"dest is not a retailer", nil, "Org3MSP", []string{"20.50", "30", "org3", "org4", "FUEL", now}, "is not a retailer"},
+		{"zero quantity", nil, "Org3MSP", []string{"20.50", "0", "org3", "org5", "FUEL", now}, "should be positive"},
+		{"quantity exceeds the fuel", nil, "Org3MSP", []string{"20.50", "81", "org3", "org5", "FUEL", now}, "exceeds the remaining quantity"},
+		{"parent is not a fuel", nil, "Org3MSP", []string{"20.50", "30", "org3", "org5", "Crude00000001", now}, "is not a Fuel"},
+		{"fuel doesn't exist", nil, "Org3MSP", []string{"20.50", "30", "org3", "org5", "Fuel99999999", now}, "doens't exist"},
+		{"fuel is not refined", func(t *testing.T, stub *shim.MockStub, fuelID string) {
+			fuel := Fuel{}
+			getTestState(t, stub, fuelID, &fuel)
+			fuel.AD.State = "DELIVERED"
+			putTestState(t, stub, fuelID, fuel)
+		}, "Org3MSP", []string{"20.50", "30", "org3", "org5", "FUEL", now}, "Cannot addFuelOrder a Fuel that is DELIVERED"},
+		{"fuel owned by another org", func(t *testing.T, stub *shim.MockStub, fuelID string) {
+			fuel := Fuel{}
+			getTestState(t, stub, fuelID, &fuel)
+			fuel.AD.Owner = "org1"
+			putTestState(t, stub, fuelID, fuel)
+		}, "Org3MSP", []string{"20.50", "30", "org3", "org5", "FUEL", now}, "is not allowed to addFuelOrder a Fuel. Allowed: the owner (org1)"},
+		{"client time is off", nil, "Org3MSP", []string{"20.50", "30", "org3", "org5", "FUEL", old}, "differs from the transaction time"},
+		{"wrong number of args", nil, "Org3MSP", []string{"20.50", "30", "org3", "org5", "FUEL"}, "Expecting 6"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stub, fuelID := newTestFuel(t)
+			if c.prepare != nil {
+				c.prepare(t, stub, fuelID)
+			}
+			args := []string{"addFuelOrder"}
+			for _, arg := range c.args {
+				if arg == "FUEL" {
+					arg = fuelID
+				}
+				args = append(args, arg)
+			}
+			if c.err != "" {
+				mustFail(t, stub, c.err, c.msp, args...)
+				return
+			}
+			orderID := mustInvoke(t, stub, c.msp, args...)
+			if orderID != "FuelOrder00000001" {
+				t.Fatalf("ID of the first order should be FuelOrder00000001 and not %s", orderID)
+			}
+			fuelOrder := FuelOrder{}
+			getTestState(t, stub, orderID, &fuelOrder)
+			if fuelOrder.FuelID != fuelID || fuelOrder.Retailer != c.args[3] || fuelOrder.Dest != c.args[3] {
+				t.Fatalf("Order is not recorded correctly: %+v", fuelOrder)
+			}
+			if fuelOrder.AD.State != StateOffered || fuelOrder.AD.Owner != "org3" {
+				t.Fatalf("Order has wrong details: %+v", fuelOrder.AD)
+			}
+			fuel := Fuel{}
+			getTestState(t, stub, fuelID, &fuel)
+			if fuel.Remaining != 80-fuelOrder.AD.Quantity {
+				t.Fatalf("Remaining of the fuel should be %d and not %d", 80-fuelOrder.AD.Quantity, fuel.Remaining)
+			}
+			//the funds of the retailer are locked only when it accepts the order.
+			if balance := getTestBalance(t, stub, c.args[3]); balance.Locked != 0 {
+				t.Fatalf("Funds of %s shouldn't be locked before it accepts the order: %+v", c.args[3], balance)
+			}
+			mustInvoke(t, stub, "Org"+strings.TrimPrefix(c.args[3], "org")+"MSP", "acceptFuelOrder", orderID)
+			getTestState(t, stub, orderID, &fuelOrder)
+			if fuelOrder.AD.State != StateReady {
+				t.Fatalf("Accepted order should be READY_FOR_DISTRIBUTION and not %s", fuelOrder.AD.State)
+			}
+			locked := fuelOrder.AD.Value + DefaultPolicy.Terms.Freight(fuelOrder.AD.Quantity)
+			if balance := getTestBalance(t, stub, c.args[3]); balance.Locked != locked {
+				t.Fatalf("Locked funds of %s should be %s and not %s", c.args[3], locked, balance.Locked)
+			}
+		})
+	}
+}
+
+//only the retailer of an order can accept it and lock its funds, or decline it.
+func TestAcceptFuelOrder(t *testing.T) {
+	stub, fuelID := newTestFuel(t)
+	now := testNow()
+	orderID := mustInvoke(t, stub, "Org3MSP", "addFuelOrder", "20.50", "30", "org3", "org5", fuelID, now)
+	expensive := mustInvoke(t, stub, "Org3MSP", "addFuelOrder", "200000", "30", "org3", "org6", fuelID, now)
+	runErrorCases(t, stub, []errorCase{
+		{"refiner accepts", "Org3MSP", []string{"acceptFuelOrder", orderID}, "is not allowed to acceptFuelOrder a FuelOrder. Allowed: the destination (org5)"},
+		{"another retailer accepts", "Org6MSP", []string{"acceptFuelOrder", orderID}, "Allowed: the destination (org5)"},
+		{"retailer can't pay", "Org6MSP", []string{"acceptFuelOrder", expensive}, "doesn't have the funds"},
+		{"not an order", "Org5MSP", []string{"acceptFuelOrder", fuelID}, "is not a FuelOrder"},
+		{"wrong number of args", "Org5MSP", []string{"acceptFuelOrder"}, "Expecting 1"},
+	})
+	mustInvoke(t, stub, "Org5MSP", "acceptFuelOrder", orderID)
+	mustFail(t, stub, "Cannot acceptFuelOrder a FuelOrder that is READY_FOR_DISTRIBUTION", "Org5MSP", "acceptFuelOrder", orderID)
+	//org6 declines the order it can't pay, which gives back its quantity without touching its account.
+	mustInvoke(t, stub, "Org6MSP", "cancelFuelOrder", expensive)
+	fuelOrder := FuelOrder{}
+	getTestState(t, stub, expensive, &fuelOrder)
+	if fuelOrder.AD.State != StateCancelled {
+		t.Fatalf("Declined order should be CANCELLED and not %s", fuelOrder.AD.State)
+	}
+	fuel := Fuel{}
+	getTestState(t, stub, fuelID, &fuel)
+	if fuel.Remaining != 50 {
+		t.Fatalf("Remaining of the fuel should be 50 and not %d", fuel.Remaining)
+	}
+	if escrow, err := GetEscrow(stub, expensive); err != nil || escrow != nil {
+		t.Fatalf("Declined order shouldn't have an escrow: %+v", escrow)
+	}
+	checkBalances(t, stub, map[string]Amount{"org1": 10005000, "org2": 10001000, "org3": 9994000, "org5": 9997650})
+}
+
+//a second order gets the next ID and the remaining quantity is shared between the orders.
+func TestAddFuelOrderSequence(t *testing.T) {
+	stub, fuelID := newTestFuel(t)
+	now := testNow()
+	first := mustInvoke(t, stub, "Org3MSP", "addFuelOrder", "10", "50", "org3", "org5", fuelID, now)
+	second := mustInvoke(t, stub, "Org3MSP", "addFuelOrder", "10", "30", "org3", "org6", fuelID, now)
+	if first != "FuelOrder00000001" || second != "FuelOrder00000002" {
+		t.Fatalf("Orders got IDs %s and %s", first, second)
+	}
+	mustFail(t, stub, "exceeds the remaining quantity 0", "Org3MSP", "addFuelOrder", "10", "1", "org3", "org5", fuelID, now)
+}
+
+//IDs taken by assets that were put in db before the sequences existed are skipped.
+func TestNextIDSkipsTakenIDs(t *testing.T) {
+	stub, fuelID := newTestFuel(t)
+	now := testNow()
+	putTestState(t, stub, "FuelOrder00000001", FuelOrder{})
+	putTestState(t, stub, "FuelOrder00000002", FuelOrder{})
+	first := mustInvoke(t, stub, "Org3MSP", "addFuelOrder", "10", "50", "org3", "org5", fuelID, now)
+	second := mustInvoke(t, stub, "Org3MSP", "addFuelOrder", "10", "30", "org3", "org6", fuelID, now)
+	if first != "FuelOrder00000003" || second != "FuelOrder00000004" {
+		t.Fatalf("Orders got IDs %s and %s", first, second)
+	}
+}
+
+//clients of the first version still send the ID of the new asset first. It's ignored and the allocated ID is returned.
+func TestLegacyIDArgs(t *testing.T) {
+	stub := newTestStub(t)
+	now := testNow()
+	mustFail(t, stub, "Expecting 8, or 9 with a Crude ID first", "Org1MSP", "deliverCrude", "V1", "50", "100", "org1", testLater(), "org1", "org3", "V1", now)
+	crudeID := mustInvoke(t, stub, "Org1MSP", "deliverCrude", "Crude1", "50", "100", "org1", testLater(), "org1", "org3", "V1", now)
+	mustInvoke(t, stub, "Org2MSP", "arrive", crudeID, "100", now)
+	mustInvoke(t, stub, "Org3MSP", "transfer", crudeID, "org3", now)
+	mustFail(t, stub, "with a Fuel ID first", "Org3MSP", "refine", "FuelOrder1", "40", "80", "org3", "0.8", "diesel", crudeID, now)
+	fuelID := mustInvoke(t, stub, "Org3MSP", "refine", "Fuel1", "40", "80", "org3", "0.8", "diesel", crudeID, now)
+	mustFail(t, stub, "with a FuelOrder ID first", "Org3MSP", "addFuelOrder", "Fuel1", "20.50", "30", "org3", "org5", fuelID, now)
+	orderID := mustInvoke(t, stub, "Org3MSP", "addFuelOrder", "FuelOrder1", "20.50", "30", "org3", "org5", fuelID, now)
+	mustInvoke(t, stub, "Org5MSP", "acceptFuelOrder", orderID)
+	mustFail(t, stub, "Pattern should be", "Org4MSP", "deliverFuel", "T0", "T1", orderID, testLater(), "org3", "org5")
+	planID := mustInvoke(t, stub, "Org4MSP", "deliverFuel", "Plan1", "T1", orderID, testLater(), "org3", "org5")
+	if crudeID != "Crude00000001" || fuelID != "Fuel00000001" || orderID != "FuelOrder00000001" || planID != "Plan00000001" {
+		t.Fatalf("Assets got IDs %s, %s, %s and %s", crudeID, fuelID, orderID, planID)
+	}
+	for _, id := range []string{"Crude1", "Fuel1", "FuelOrder1", "Plan1"} {
+		if stub.State[id] != nil {
+			t.Fatalf("The ID %s sent by the client shouldn't be used", id)
+		}
+	}
+	plan := FuelDeliveryPlan{}
+	getTestState(t, stub, planID, &plan)
+	if _, ok := plan.Plan[orderID]; ok == false || plan.Veh.ID != "T1" {
+		t.Fatalf("Plan should deliver %s with T1: %+v", orderID, plan)
+	}
+}
+
+func getTestBalance(t *testing.T, stub *shim.MockStub, org string) Balance {
+	t.Helper()
+	balance := Balance{}
+	if err := json.Unmarshal([]byte(mustInvoke(t, stub, "Org1MSP", "queryBalance", org)), &balance); err != nil {
+		t.Fatal(err)
+	}
+	return balance
+}
+
+//compare the available balances of the orgs. Orgs that are not in want should have the initial balance.
+func checkBalances(t *testing.T, stub *shim.MockStub, want map[string]Amount) {
+	t.Helper()
+	for _, org := range []string{"org1", "org2", "org3", "org4", "org5", "org6"} {
+		expected, ok := want[org]
+		if ok == false {
+			expected = 100000 * MinorUnits
+		}
+		if balance := getTestBalance(t, stub, org); balance.Available != expected {
+			t.Errorf("Balance of %s should be %s and not %s", org, expected, balance.Available)
+		}
+	}
+}
+
+//IDs of the assets created by newTestPlan.
+type testAssets struct {
+	Crude, Fuel, FuelOrder, Plan string
+}
+
+//newTestFuel plus an order of 30 (20.50 EUR) for org5 that is on its way with a plan of org4.
+func newTestPlan(t *testing.T) (*shim.MockStub, testAssets) {
+	t.Helper()
+	stub, fuelID := newTestFuel(t)
+	now := testNow()
+	est := testLater()
+	ids := testAssets{Crude: "Crude00000001", Fuel: fuelID}
+	ids.FuelOrder = mustOrder(t, stub, "20.50", "30", "org3", "org5", fuelID, now)
+	ids.Plan = mustInvoke(t, stub, "Org4MSP", "deliverFuel", "T1", ids.FuelOrder, est, "org3", "org5")
+	return stub, ids
+}
+
+//addFuelOrder of org3 accepted by the destination, so the order is READY_FOR_DISTRIBUTION.
+func mustOrder(t *testing.T, stub *shim.MockStub, args ...string) string {
+	t.Helper()
+	orderID := mustInvoke(t, stub, "Org3MSP", append([]string{"addFuelOrder"}, args...)...)
+	mustInvoke(t, stub, "Org"+strings.TrimPrefix(args[3], "org")+"MSP", "acceptFuelOrder", orderID)
+	return orderID
+}
+
+type errorCase struct {
+	name string
+	msp  string
+	args []string
+	err  string
+}
+
+//run the cases on the same ledger. A failed invocation may leave writes in a MockStub,
+//so the cases should fail before the handler writes anything that the next cases depend on.
+func runErrorCases(t *testing.T, stub *shim.MockStub, cases []errorCase) {
+	t.Helper()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mustFail(t, stub, c.err, c.msp, c.args...)
+		})
+	}
+}
+
+//initLedger -> deliverCrude -> arrive -> transfer -> refine -> addFuelOrder -> acceptFuelOrder -> deliverFuel -> arrive -> transfer.
+func TestHappyPath(t *testing.T) {
+	stub := newTestStub(t)
+	now := testNow()
+	est := testLater()
+	checkBalances(t, stub, nil)
+
+	crudeID := mustInvoke(t, stub, "Org1MSP", "deliverCrude", "50", "100", "org1", est, "org1", "org3", "V1", now)
+	if crudeID != "Crude00000001" {
+		t.Fatalf("ID of the first crude should be Crude00000001 and not %s", crudeID)
+	}
+	mustInvoke(t, stub, "Org2MSP", "arrive", crudeID, "100", now)
+	//nobody is paid before the destination accepts the delivery.
+	checkBalances(t, stub, nil)
+	mustInvoke(t, stub, "Org3MSP", "transfer", crudeID, "org3", now)
+	//org3 pays 50.00 to the driller and 10.00 (100 of crude) to the shipper.
+	checkBalances(t, stub, map[string]Amount{"org1": 10005000, "org2": 10001000, "org3": 9994000})
+	crude := Crude{}
+	getTestState(t, stub, crudeID, &crude)
+	if crude.AD.State != "DELIVERED" || crude.AD.Owner != "org3" {
+		t.Fatalf("Crude should be DELIVERED to org3: %+v", crude.AD)
+	}
+
+	fuelID := mustInvoke(t, stub, "Org3MSP", "refine", "40", "80", "org3", "0.8", "diesel", crudeID, now)
+	getTestState(t, stub, crudeID, &crude)
+	if crude.Remaining != 20 {
+		t.Fatalf("Remaining of the crude should be 20 and not %d", crude.Remaining)
+	}
+
+	orderID := mustOrder(t, stub, "20.50", "30", "org3", "org5", fuelID, now)
+	//20.50 plus 3.00 freight are locked from org5.
+	if balance := getTestBalance(t, stub, "org5"); balance.Available != 9997650 || balance.Locked != 2350 {
+		t.Fatalf("org5 should have 99976.50 available and 23.50 locked: %+v", balance)
+	}
+
+	planID := mustInvoke(t, stub, "Org4MSP", "deliverFuel", "T1", orderID, est, "org3", "org5")
+	fuelOrder := FuelOrder{}
+	getTestState(t, stub, orderID, &fuelOrder)
+	if fuelOrder.AD.State != "ON_WAY" {
+		t.Fatalf("Order should be ON_WAY and not %s", fuelOrder.AD.State)
+	}
+
+	mustInvoke(t, stub, "Org4MSP", "arrive", orderID, "30", now, planID)
+	mustInvoke(t, stub, "Org5MSP", "transfer", orderID, "org5", now, planID)
+	checkBalances(t, stub, map[string]Amount{
+		"org1": 10005000, "org2": 10001000, "org3": 9996050, "org4": 10000300, "org5": 9997650,
+	})
+	if balance := getTestBalance(t, stub, "org5"); balance.Locked != 0 {
+		t.Fatalf("Escrow of org5 should be released: %+v", balance)
+	}
+	getTestState(t, stub, orderID, &fuelOrder)
+	if fuelOrder.AD.State != "DELIVERED" || fuelOrder.AD.Owner != "org5" {
+		t.Fatalf("Order should be DELIVERED to org5: %+v", fuelOrder.AD)
+	}
+	dplan := FuelDeliveryPlan{}
+	getTestState(t, stub, planID, &dplan)
+	if dplan.Plan[orderID].Delay >= 0 {
+		t.Fatalf("Order was delivered before its estimated time but has delay %f", dplan.Plan[orderID].Delay)
+	}
+
+	lines := []StatementLine{}
+	json.Unmarshal([]byte(mustInvoke(t, stub, "Org5MSP", "queryStatement", "org5")), &lines)
+	if len(lines) != 2 {
+		t.Fatalf("org5 should have 2 statement lines and not %d", len(lines))
+	}
+	for _, line := range lines {
+		if line.Direction != "DEBIT" || line.AssetID != orderID {
+			t.Fatalf("Wrong statement line of org5: %+v", line)
+		}
+	}
+}
+
+//a late delivery reduces the freight. The penalty can't make the freight negative.
+func TestLateDelivery(t *testing.T) {
+	stub := newTestStub(t)
+	now := testNow()
+	est := time.Now().UTC().Add(-time.Hour).Format(time.RFC3339)
+	crudeID := mustInvoke(t, stub, "Org1MSP", "deliverCrude", "50", "100", "org1", est, "org1", "org3", "V1", now)
+	mustInvoke(t, stub, "Org2MSP", "arrive", crudeID, "100", now)
+	mustInvoke(t, stub, "Org3MSP", "transfer", crudeID, "org3", now)
+	//a delay of an hour costs 36.00 which is more than the freight of 10.00.
+	checkBalances(t, stub, map[string]Amount{"org1": 10005000, "org3": 9995000})
+
+	estTime, _ := time.Parse(time.RFC3339, "2019-05-01T10:00:00Z")
+	dd := DeliveryDetails{EstTime: estTime}
+	dd.arrive(estTime.Add(300 * time.Second))
+	if penalty := DefaultPolicy.Terms.DelayPenalty(dd.Delay); penalty != 300 || dd.Delay != 300 {
+		t.Fatalf("5 minutes late should cost 3.00 and not %s (delay %f)", penalty, dd.Delay)
+	}
+	dd.arrive(estTime.Add(-time.Minute))
+	if penalty := DefaultPolicy.Terms.DelayPenalty(dd.Delay); penalty != 0 {
+		t.Fatalf("Early delivery should have no penalty and not %s", penalty)
+	}
+}
+
+func TestInitAndInvoke(t *testing.T) {
+	stub := shim.NewMockStub("supplychain", new(SmartContract))
+	if res := stub.MockInit("init", [][]byte{[]byte("init"), []byte("maxClockDrift=-1")}); res.Status == shim.OK {
+		t.Fatal("Init should reject a negative maxClockDrift")
+	}
+	if res := stub.MockInit("init", [][]byte{[]byte("init"), []byte("shortfallTolerance=101")}); res.Status == shim.OK {
+		t.Fatal("Init should reject a shortfallTolerance above 100")
+	}
+	if res := stub.MockInit("init", [][]byte{[]byte("init"), []byte("foo=1")}); res.Status == shim.OK {
+		t.Fatal("Init should reject unknown config keys")
+	}
+	//args that are not key=value are ignored, like the ones of the byfn scripts.
+	if res := stub.MockInit("init", [][]byte{[]byte("init"), []byte("a"), []byte("100"), []byte("maxClockDrift=60")}); res.Status != shim.OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+	config := Config{}
+	getTestState(t, stub, ConfigKey, &config)
+	if config.MaxClockDrift != 60 {
+		t.Fatalf("maxClockDrift should be 60 and not %d", config.MaxClockDrift)
+	}
+	mustInvoke(t, stub, "Org1MSP", "initLedger")
+	runErrorCases(t, stub, []errorCase{
+		{"unknown function", "Org1MSP", []string{"foo"}, "Invalid Smart Contract function name"},
+		{"initLedger twice", "Org1MSP", []string{"initLedger"}, "should be called only once"},
+		{"unknown MSP", "Org9MSP", []string{"deliverCrude"}, "has no role"},
+	})
+}
+
+func TestDeliverCrudeErrors(t *testing.T) {
+	stub := newTestStub(t)
+	now := testNow()
+	old := time.Now().UTC().Add(-time.Hour).Format(time.RFC3339)
+	args := func(replace map[int]string) []string {
+		a := []string{"deliverCrude", "50", "100", "org1", now, "org1", "org3", "V1", now}
+		for i, v := range replace {
+			a[i] = v
+		}
+		return a
+	}
+	runErrorCases(t, stub, []errorCase{
+		{"not a driller", "Org3MSP", args(nil), "is not allowed"},
+		{"wrong number of args", "Org1MSP", args(nil)[:8], "Expecting 8"},
+		{"bad value", "Org1MSP", args(map[int]string{1: "fifty"}), "Value is not a decimal number"},
+		{"too many decimals", "Org1MSP", args(map[int]string{1: "50.001"}), "Value is not a decimal number"},
+		{"negative value", "Org1MSP", args(map[int]string{1: "-50"}), "Value is not a decimal number"},
+		{"bad quantity", "Org1MSP", args(map[int]string{2: "1.5"}), "Quantity is not an int number"},
+		{"owner is not an org", "Org1MSP", args(map[int]string{3: "driller"}), "not prefixed with string 'org'"},
+		{"owner is not the caller", "Org1MSP", args(map[int]string{3: "org2"}), "doesn't match the caller"},
+		{"bad estimated time", "Org1MSP", args(map[int]string{4: "2019-05-01 10:00"}), "RFC3339"},
+		{"start is not an org", "Org1MSP", args(map[int]string{5: "port"}), "Starting Location"},
+		{"dest is not an org", "Org1MSP", args(map[int]string{6: "refinery"}), "Destination value"},
+		{"dest is not a refiner", "Org1MSP", args(map[int]string{6: "org5"}), "should be delivered to a refiner"},
+		{"bad timestamp", "Org1MSP", args(map[int]string{8: "now"}), "RFC3339"},
+		{"timestamp is off", "Org1MSP", args(map[int]string{8: old}), "differs from the transaction time"},
+	})
+}
+
+func TestRefineErrors(t *testing.T) {
+	stub := newTestStub(t)
+	now := testNow()
+	crudeID := mustInvoke(t, stub, "Org1MSP", "deliverCrude", "50", "100", "org1", now, "org1", "org3", "V1", now)
+	args := func(replace map[int]string) []string {
+		a := []string{"refine", "40", "80", "org3", "0.8", "diesel", crudeID, now}
+		for i, v := range replace {
+			a[i] = v
+		}
+		return a
+	}
+	//the crude is still on its way, so it's owned by org1.
+	runErrorCases(t, stub, []errorCase{
+		{"crude not delivered yet", "Org3MSP", args(nil), "Cannot refine a Crude that is ON_WAY"},
+	})
+	mustInvoke(t, stub, "Org2MSP", "arrive", crudeID, "100", now)
+	mustInvoke(t, stub, "Org3MSP", "transfer", crudeID, "org3", now)
+	putTestState(t, stub, "Crude00000098", "crude")
+	runErrorCases(t, stub, []errorCase{
+		{"not a refiner", "Org1MSP", args(nil), "is not allowed"},
+		{"wrong number of args", "Org3MSP", args(nil)[:7], "Expecting 7"},
+		{"bad value", "Org3MSP", args(map[int]string{1: "x"}), "Value is not a decimal number"},
+		{"owner is not an org", "Org3MSP", args(map[int]string{3: "refiner"}), "not prefixed with string 'org'"},
+		{"owner is not the caller", "Org3MSP", args(map[int]string{3: "org1"}), "doesn't match the caller"},
+		{"bad density", "Org3MSP", args(map[int]string{4: "dense"}), "Density should be a float"},
+		{"bad timestamp", "Org3MSP", args(map[int]string{7: "today"}), "RFC3339"},
+		{"crude doesn't exist", "Org3MSP", args(map[int]string{6: "Crude99999999"}), "ID of crude doesn't exist"},
+		{"parent is not a crude", "Org3MSP", args(map[int]string{6: "Fuel00000001"}), "Fuel00000001 is not a Crude"},
+		{"broken crude", "Org3MSP", args(map[int]string{6: "Crude00000098"}), "Failed to decode Crude00000098"},
+		{"not enough crude", "Org3MSP", args(map[int]string{2: "101"}), "only 100 remains"},
+	})
+}
+
+func TestDeliverFuelErrors(t *testing.T) {
+	stub, fuelID := newTestFuel(t)
+	now := testNow()
+	orderID := mustOrder(t, stub, "20.50", "30", "org3", "org5", fuelID, now)
+	runErrorCases(t, stub, []errorCase{
+		{"not a distributor", "Org3MSP", []string{"deliverFuel", "T1", orderID, now, "org3", "org5"}, "is not allowed"},
+		{"no args", "Org4MSP", []string{"deliverFuel"}, "Expecting more args"},
+		{"no orders", "Org4MSP", []string{"deliverFuel", "T1"}, "At least one delivery"},
+		{"incomplete order", "Org4MSP", []string{"deliverFuel", "T1", orderID, now, "org3"}, "Pattern should be"},
+		{"order doesn't exist", "Org4MSP", []string{"deliverFuel", "T1", "FuelOrder99999999", now, "org3", "org5"}, "does not exist"},
+	})
+}
+
+func TestTransferErrors(t *testing.T) {
+	stub, ids := newTestPlan(t)
+	now := testNow()
+	old := time.Now().UTC().Add(-time.Hour).Format(time.RFC3339)
+	arrived := mustInvoke(t, stub, "Org1MSP", "deliverCrude", "50", "100", "org1", testLater(), "org1", "org3", "V2", now)
+	mustInvoke(t, stub, "Org2MSP", "arrive", arrived, "100", now)
+	runErrorCases(t, stub, []errorCase{
+		{"order has not arrived", "Org5MSP", []string{"transfer", ids.FuelOrder, "org5", now, ids.Plan}, "Cannot transfer a FuelOrder that is ON_WAY"},
+	})
+	mustInvoke(t, stub, "Org4MSP", "arrive", ids.FuelOrder, "30", now, ids.Plan)
+	runErrorCases(t, stub, []errorCase{
+		{"wrong number of args", "Org5MSP", []string{"transfer", ids.FuelOrder, "org5"}, "Wrong # of arguments"},
+		{"owner is not an org", "Org5MSP", []string{"transfer", ids.FuelOrder, "station", now, ids.Plan}, "Owner is not an org"},
+		{"owner is not the caller", "Org6MSP", []string{"transfer", ids.FuelOrder, "org5", now, ids.Plan}, "doesn't match the caller"},
+		{"bad timestamp", "Org5MSP", []string{"transfer", ids.FuelOrder, "org5", "now", ids.Plan}, "RFC3339"},
+		{"timestamp is off", "Org5MSP", []string{"transfer", ids.FuelOrder, "org5", old, ids.Plan}, "differs from the transaction time"},
+		{"asset doesn't exist", "Org5MSP", []string{"transfer", "FuelOrder99999999", "org5", now, ids.Plan}, "Could not locate Asset"},
+		{"fuel is not deliverable", "Org3MSP", []string{"transfer", ids.Fuel, "org3", now}, "not deliverable"},
+		{"crude is delivered already", "Org3MSP", []string{"transfer", ids.Crude, "org3", now}, "Cannot transfer a Crude that is DELIVERED"},
+		{"crude to another org", "Org6MSP", []string{"transfer", arrived, "org6", now}, "Allowed: the destination (org3)"},
+		{"order to another org", "Org6MSP", []string{"transfer", ids.FuelOrder, "org6", now, ids.Plan}, "Allowed: the destination (org5)"},
+		{"order without plan", "Org5MSP", []string{"transfer", ids.FuelOrder, "org5", now}, "PlanID of the FuelOrder is missing"},
+		{"plan is not a plan", "Org5MSP", []string{"transfer", ids.FuelOrder, "org5", now, ids.Fuel}, "PlanID is not of the form"},
+		{"plan doesn't exist", "Org5MSP", []string{"transfer", ids.FuelOrder, "org5", now, "Plan99999999"}, "Could not locate Plan"},
+	})
+
+	//an order that is not in the plan, and one that isn't on its way.
+	otherOrder := mustOrder(t, stub, "10", "10", "org3", "org5", ids.Fuel, now)
+	runErrorCases(t, stub, []errorCase{
+		{"order is not on its way", "Org5MSP", []string{"transfer", otherOrder, "org5", now, ids.Plan}, "Cannot transfer a FuelOrder that is READY_FOR_DISTRIBUTION"},
+	})
+	otherPlan := mustInvoke(t, stub, "Org4MSP", "deliverFuel", "T2", otherOrder, now, "org3", "org5")
+	mustInvoke(t, stub, "Org4MSP", "arrive", otherOrder, "10", now, otherPlan)
+	runErrorCases(t, stub, []errorCase{
+		{"order is not in the plan", "Org5MSP", []string{"transfer", otherOrder, "org5", now, ids.Plan}, "didn't exist in any plan"},
+	})
+
+	mustInvoke(t, stub, "Org5MSP", "transfer", ids.FuelOrder, "org5", now, ids.Plan)
+	mustInvoke(t, stub, "Org5MSP", "transfer", otherOrder, "org5", now, otherPlan)
+	runErrorCases(t, stub, []errorCase{
+		{"order is delivered already", "Org5MSP", []string{"transfer", ids.FuelOrder, "org5", now, ids.Plan}, "Cannot transfer a FuelOrder that is DELIVERED"},
+	})
+}
+
+//a buyer that would go beyond its credit limit can't accept a delivery.
+func TestTransferOverCreditLimit(t *testing.T) {
+	stub := newTestStub(t)
+	now := testNow()
+	//org3 has 100000.00 and a credit limit of 20000.00. The freight of 10 is 1.00.
+	crudeID := mustInvoke(t, stub, "Org1MSP", "deliverCrude", "120000", "10", "org1", testLater(), "org1", "org3", "V1", now)
+	mustInvoke(t, stub, "Org2MSP", "arrive", crudeID, "10", now)
+	mustFail(t, stub, "can't pay", "Org3MSP", "transfer", crudeID, "org3", now)
+	crudeID = mustInvoke(t, stub, "Org1MSP", "deliverCrude", "119999", "10", "org1", testLater(), "org1", "org3", "V1", now)
+	mustInvoke(t, stub, "Org2MSP", "arrive", crudeID, "10", now)
+	mustInvoke(t, stub, "Org3MSP", "transfer", crudeID, "org3", now)
+	if balance := getTestBalance(t, stub, "org3"); balance.Available != -CreditLimits["org3"] {
+		t.Fatalf("org3 should be at its credit limit and not %s", balance.Available)
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	stub, ids := newTestPlan(t)
+	if asset := mustInvoke(t, stub, "Org1MSP", "queryAsset", ids.Fuel); strings.Contains(asset, "diesel") == false {
+		t.Fatalf("queryAsset returned %s", asset)
+	}
+	account := Account{}
+	json.Unmarshal([]byte(mustInvoke(t, stub, "Org1MSP", "queryAsset", "org1")), &account)
+	if account.Currency != Currency {
+		t.Fatalf("queryAsset of org1 returned %+v", account)
+	}
+	runErrorCases(t, stub, []errorCase{
+		{"queryAsset without ID", "Org1MSP", []string{"queryAsset"}, "Incorect # of args"},
+		{"queryAsset of a missing asset", "Org1MSP", []string{"queryAsset", "Crude99999999"}, "Could not locate asset"},
+		{"queryAsset of a missing org", "Org1MSP", []string{"queryAsset", "org9"}, "Could not locate asset"},
+		{"queryAssetByRange of a bad type", "Org1MSP", []string{"queryAssetByRange", "Truck"}, "Arg should be one of"},
+		{"queryAssetByRange with 2 args", "Org1MSP", []string{"queryAssetByRange", "Fuel", "10"}, "Expecting 1 arg or at least 3 args"},
+		{"queryAssetByRange with a bad page size", "Org1MSP", []string{"queryAssetByRange", "Fuel", "-1", ""}, "Page size"},
+		{"queryAssetByRange with a bad filter", "Org1MSP", []string{"queryAssetByRange", "Fuel", "0", "", "color=red"}, "Unknown filter"},
+		{"queryStatement of a non org", "Org1MSP", []string{"queryStatement", "bank"}, "Arg should be an org"},
+	})
+}
@@ -0,0 +1,419 @@
+/*
+JSON documents as arguments.
+
+Every function can be called either with its positional args or with a single JSON document,
+which is validated against the schema of the function and translated to the positional args, e.g.
+
+	deliverFuel {"Version":1,"TruckID":"T1","Deliveries":[{"FuelOrderID":"FuelOrder00000001",
+		"EstTime":"2019-05-01T10:00:00Z","StartingLocation":"org3","Destination":"org5"}]}
+
+is the same as
+
+	deliverFuel T1 FuelOrder00000001 2019-05-01T10:00:00Z org3 org5
+
+Amounts and numbers may be JSON numbers or strings. Fields are matched by name, so their order
+doesn't matter, and unknown fields are rejected.
+
+Version is the version of the schema. A document of another version is rejected, so the
+schema can change in the future without breaking the clients silently.
+If the document is invalid, the error message is an ArgsError in JSON with one error per field.
+The schemas can be queried with queryArgSchema.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const ArgsVersion = 1
+
+//kinds of the fields.
+const (
+	KindString     = "string"
+	KindOrg        = "org"
+	KindAmount     = "amount"
+	KindInt        = "int"
+	KindFloat      = "float"
+	KindTime       = "time"
+	KindObject     = "object"     //a JSON object passed as a string (e.g. a selector)
+	KindFilters    = "filters"    //an object of field:value, passed as field=value args
+	KindDeliveries = "deliveries" //an array of objects with Fields, each one passed as len(Fields) args
+	KindStrings    = "strings"    //an array of strings, each one passed as one arg
+	KindAmounts    = "amounts"    //an object of org:amount, passed as org=amount args
+)
+
+/*
+A field of a document. Fields are translated to positional args in the order of the schema.
+If one of the optional fields is given, the missing optional fields take their Default.
+*/
+type ArgField struct {
+	Name     string
+	Kind     string
+	Optional bool       `json:",omitempty"`
+	Default  *string    `json:",omitempty"`
+	Fields   []ArgField `json:",omitempty"`
+}
+
+type FieldError struct {
+	Field string
+	Error string
+}
+
+type ArgsError struct {
+	Version  int
+	Function string
+	Errors   []FieldError
+}
+
+func (e *ArgsError) Error() string {
+	errAsBytes, _ := json.Marshal(e)
+	return string(errAsBytes)
+}
+
+func (e *ArgsError) add(field, format string, a ...interface{}) {
+	e.Errors = append(e.Errors, FieldError{field, fmt.Sprintf(format, a...)})
+}
+
+func defaultArg(s string) *string {
+	return &s
+}
+
+var (
+	valueField    = ArgField{Name: "Value", Kind: KindAmount}
+	quantityField = ArgField{Name: "Quantity", Kind: KindInt}
+	ownerField    = ArgField{Name: "Owner", Kind: KindOrg}
+	timeField     = ArgField{Name: "Timestamp", Kind: KindTime}
+	idField       = ArgField{Name: "ID", Kind: KindString}
+	orgField      = ArgField{Name: "Org", Kind: KindOrg}
+	typeField     = ArgField{Name: "Type", Kind: KindString}
+	orderField    = ArgField{Name: "FuelOrderID", Kind: KindString}
+	planField     = ArgField{Name: "PlanID", Kind: KindString}
+	//{FuelOrderID,EstTime,Sloc,Dest} of deliverFuel and addPlanOrders.
+	deliveriesField = ArgField{Name: "Deliveries", Kind: KindDeliveries, Fields: []ArgField{orderField,
+		{Name: "EstTime", Kind: KindTime}, {Name: "StartingLocation", Kind: KindOrg}, {Name: "Destination", Kind: KindOrg}}}
+)
+
+//the schema of every function in the order of its positional args.
+var argSchemas = map[string][]ArgField{
+	"deliverCrude": {valueField, quantityField, ownerField, {Name: "EstTime", Kind: KindTime},
+		{Name: "StartingLocation", Kind: KindOrg}, {Name: "Destination", Kind: KindOrg},
+		{Name: "VesselID", Kind: KindString}, timeField},
+	"refine": {valueField, quantityField, ownerField, {Name: "Density", Kind: KindFloat},
+		typeField, {Name: "CrudeID", Kind: KindString}, timeField},
+	"setYieldRatio": {typeField, {Name: "Ratio", Kind: KindFloat}},
+	"addFuelOrder": {valueField, quantityField, ownerField, {Name: "Destination", Kind: KindOrg},
+		{Name: "FuelID", Kind: KindString}, timeField},
+	"acceptFuelOrder":      {orderField},
+	"cancelFuelOrder":      {orderField},
+	"reportFailedDelivery": {orderField},
+	"deliverFuel":          {{Name: "TruckID", Kind: KindString}, deliveriesField},
+	"addPlanOrders":        {planField, timeField, deliveriesField},
+	"removePlanOrder":      {planField, orderField, {Name: "Reason", Kind: KindString}, timeField},
+	"reschedulePlanOrder": {planField, orderField, {Name: "EstTime", Kind: KindTime},
+		{Name: "ReasonCode", Kind: KindString}, timeField},
+	"swapPlanVehicle": {planField, {Name: "TruckID", Kind: KindString}, {Name: "Reason", Kind: KindString}, timeField},
+	"closePlan":       {planField, timeField},
+	"transfer": {{Name: "AssetID", Kind: KindString}, ownerField, timeField,
+		{Name: "PlanID", Kind: KindString, Optional: true, Default: defaultArg("")},
+		{Name: "ReceivedQuantity", Kind: KindInt, Optional: true, Default: defaultArg("")}},
+	"arrive": {{Name: "AssetID", Kind: KindString}, quantityField, timeField,
+		{Name: "PlanID", Kind: KindString, Optional: true}},
+	"rejectDelivery": {{Name: "AssetID", Kind: KindString}, {Name: "Reason", Kind: KindString}, timeField},
+	"queryAsset":     {idField},
+	"queryAssetByRange": {typeField,
+		{Name: "PageSize", Kind: KindInt, Optional: true, Default: defaultArg("0")},
+		{Name: "Bookmark", Kind: KindString, Optional: true, Default: defaultArg("")},
+		{Name: "Filters", Kind: KindFilters, Optional: true}},
+	"traceAsset":        {idField},
+	"queryAssetHistory": {idField},
+	"queryStatement":    {orgField},
+	"queryBalance":      {orgField},
+	"queryByOwner":      {ownerField, {Name: "Type", Kind: KindString, Optional: true}},
+	"queryByState":      {{Name: "State", Kind: KindString}, {Name: "Type", Kind: KindString, Optional: true}},
+	"queryByDest":       {{Name: "Destination", Kind: KindOrg}},
+	"rebuildIndexes":    {},
+	"richQuery": {typeField, {Name: "Selector", Kind: KindObject},
+		{Name: "PageSize", Kind: KindInt, Optional: true},
+		{Name: "Bookmark", Kind: KindString, Optional: true, Default: defaultArg("")}},
+	"initLedger":              {},
+	"queryArgSchema":          {{Name: "Function", Kind: KindString, Optional: true}},
+	"queryAllowedTransitions": {idField},
+	"queryDispute":            {{Name: "AssetID", Kind: KindString}, {Name: "Seq", Kind: KindInt, Optional: true}},
+	"registerVehicle": {typeField, {Name: "VehicleID", Kind: KindString}, {Name: "Capacity", Kind: KindInt},
+		{Name: "Compartments", Kind: KindInt}, {Name: "CertExpiry", Kind: KindTime}},
+	"updateVehicle": {typeField, {Name: "VehicleID", Kind: KindString}, {Name: "Status", Kind: KindString},
+		{Name: "CertExpiry", Kind: KindTime}},
+	"queryVehicle": {typeField, {Name: "VehicleID", Kind: KindString}},
+	"onboardParticipant": {{Name: "MSPID", Kind: KindString}, {Name: "Org", Kind: KindOrg}, {Name: "Name", Kind: KindString},
+		{Name: "Role", Kind: KindString}, {Name: "CreditLimit", Kind: KindAmount}},
+	"suspendParticipant":   {{Name: "MSPID", Kind: KindString}, {Name: "Reason", Kind: KindString}},
+	"reinstateParticipant": {{Name: "MSPID", Kind: KindString}},
+	"offboardParticipant":  {{Name: "MSPID", Kind: KindString}, {Name: "Reason", Kind: KindString}},
+	"proposePolicy":        {{Name: "Policy", Kind: KindObject}, timeField},
+	"approvePolicy":        {{Name: "ProposalID", Kind: KindString}},
+	"queryPolicy":          {{Name: "Version", Kind: KindInt, Optional: true}},
+	"queryPolicyProposal":  {{Name: "ProposalID", Kind: KindString}},
+	"openDispute": {{Name: "AssetID", Kind: KindString}, {Name: "Claim", Kind: KindString}, timeField,
+		{Name: "Evidence", Kind: KindStrings, Optional: true}},
+	"respondDispute": {{Name: "AssetID", Kind: KindString}, {Name: "Response", Kind: KindString}, timeField,
+		{Name: "Evidence", Kind: KindStrings, Optional: true}},
+	"resolveDispute": {{Name: "AssetID", Kind: KindString}, {Name: "Decision", Kind: KindString},
+		{Name: "Reasoning", Kind: KindString}, timeField, {Name: "Adjustments", Kind: KindAmounts, Optional: true}},
+}
+
+//args are a JSON document if there is only one arg and it's an object.
+func IsJSONArgs(args []string) bool {
+	return len(args) == 1 && strings.HasPrefix(strings.TrimSpace(args[0]), "{")
+}
+
+//translate the JSON document of a function to its positional args.
+func ParseJSONArgs(function, doc string) ([]string, error) {
+	argsErr := &ArgsError{Version: ArgsVersion, Function: function}
+	schema, ok := argSchemas[function]
+	if ok == false {
+		argsErr.add("", "Function %s doesn't take a JSON document", function)
+		return nil, argsErr
+	}
+	decoder := json.NewDecoder(strings.NewReader(doc))
+	decoder.UseNumber()
+	var fields map[string]interface{}
+	if err := decoder.Decode(&fields); err != nil {
+		argsErr.add("", "Not a JSON object: %s", err.Error())
+		return nil, argsErr
+	}
+	if version, ok := fields["Version"]; ok == false {
+		argsErr.add("Version", "is required")
+	} else if number, ok := version.(json.Number); ok == false || number.String() != strconv.Itoa(ArgsVersion) {
+		argsErr.add("Version", "should be %d", ArgsVersion)
+	}
+	delete(fields, "Version")
+	args := parseFields("", schema, fields, argsErr)
+	if len(argsErr.Errors) > 0 {
+		return nil, argsErr
+	}
+	return args, nil
+}
+
+//validate the fields of an object against a schema and return them as positional args.
+func parseFields(prefix string, schema []ArgField, fields map[string]interface{}, argsErr *ArgsError) []string {
+	args := []string{}
+	known := make(map[string]bool)
+	anyOptional := false
+	for _, f := range schema {
+		known[f.Name] = true
+		if _, ok := fields[f.Name]; ok && f.Optional {
+			anyOptional = true
+		}
+	}
+	//report unknown fields in a stable order.
+	unknown := []string{}
+	for name := range fields {
+		if known[name] == false {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		argsErr.add(prefix+name, "is not a field of this function")
+	}
+	for _, f := range schema {
+		name := prefix + f.Name
+		value, ok := fields[f.Name]
+		if ok == false {
+			switch {
+			case f.Optional == false:
+				argsErr.add(name, "is required")
+			case anyOptional && isList(f.Kind) == false && f.Default == nil:
+				argsErr.add(name, "is required when other optional fields are given")
+			case anyOptional && f.Default != nil:
+				args = append(args, *f.Default)
+			}
+			continue
+		}
+		args = append(args, parseField(name, f, value, argsErr)...)
+	}
+	return args
+}
+
+//fields of these kinds are passed as any number of args, so they can be left out at the end.
+func isList(kind string) bool {
+	return kind == KindFilters || kind == KindStrings || kind == KindAmounts
+}
+
+//validate a value of a field and return it as one or more positional args.
+func parseField(name string, f ArgField, value interface{}, argsErr *ArgsError) []string {
+	switch f.Kind {
+	case KindObject:
+		object, ok := value.(map[string]interface{})
+		if ok == false {
+			argsErr.add(name, "should be an object")
+			return nil
+		}
+		objectAsBytes, _ := json.Marshal(object)
+		return []string{string(objectAsBytes)}
+	case KindFilters:
+		object, ok := value.(map[string]interface{})
+		if ok == false {
+			argsErr.add(name, "should be an object of field:value")
+			return nil
+		}
+		//map order is random, but the args must be the same on every peer.
+		keys := []string{}
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		filters := []string{}
+		for _, key := range keys {
+			s, ok := object[key].(string)
+			if ok == false || s == "" {
+				argsErr.add(name+"."+key, "should be a non empty string")
+				continue
+			}
+			filters = append(filters, key+"="+s)
+		}
+		return filters
+	case KindDeliveries:
+		list, ok := value.([]interface{})
+		if ok == false || len(list) == 0 {
+			argsErr.add(name, "should be a non empty array")
+			return nil
+		}
+		args := []string{}
+		for i, item := range list {
+			itemName := fmt.Sprintf("%s[%d]", name, i)
+			object, ok := item.(map[string]interface{})
+			if ok == false {
+				argsErr.add(itemName, "should be an object")
+				continue
+			}
+			args = append(args, parseFields(itemName+".", f.Fields, object, argsErr)...)
+		}
+		return args
+	case KindStrings:
+		list, ok := value.([]interface{})
+		if ok == false {
+			argsErr.add(name, "should be an array of strings")
+			return nil
+		}
+		args := []string{}
+		for i, item := range list {
+			s, ok := item.(string)
+			if ok == false || s == "" {
+				argsErr.add(fmt.Sprintf("%s[%d]", name, i), "should be a non empty string")
+				continue
+			}
+			args = append(args, s)
+		}
+		return args
+	case KindAmounts:
+		object, ok := value.(map[string]interface{})
+		if ok == false {
+			argsErr.add(name, "should be an object of org:amount")
+			return nil
+		}
+		orgs := []string{}
+		for org := range object {
+			orgs = append(orgs, org)
+		}
+		sort.Strings(orgs)
+		amounts := []string{}
+		for _, org := range orgs {
+			var s string
+			switch v := object[org].(type) {
+			case string:
+				s = v
+			case json.Number:
+				s = v.String()
+			}
+			if HasPrefixOrg(org) == false {
+				argsErr.add(name+"."+org, "is not an org (e.g. 'org3')")
+				continue
+			}
+			if _, err := ParseAmount(s); err != nil {
+				argsErr.add(name+"."+org, "should be an amount with at most 2 decimal digits")
+				continue
+			}
+			amounts = append(amounts, org+"="+s)
+		}
+		return amounts
+	}
+
+	//the rest are scalars. Numbers are kept as they were written.
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case json.Number:
+		if f.Kind != KindAmount && f.Kind != KindInt && f.Kind != KindFloat {
+			argsErr.add(name, "should be a string")
+			return nil
+		}
+		s = v.String()
+	default:
+		argsErr.add(name, "should be a string or a number")
+		return nil
+	}
+	switch f.Kind {
+	case KindString:
+		if s == "" && f.Optional == false {
+			argsErr.add(name, "should not be empty")
+		}
+	case KindOrg:
+		if HasPrefixOrg(s) == false {
+			argsErr.add(name, "should be an org (e.g. 'org3')")
+		}
+	case KindAmount:
+		if amount, err := ParseAmount(s); err != nil || amount < 0 {
+			argsErr.add(name, "should be a non negative amount with at most 2 decimal digits")
+		}
+	case KindInt:
+		if n, err := strconv.ParseInt(s, 10, 64); err != nil || n < 0 {
+			argsErr.add(name, "should be a non negative int number")
+		}
+	case KindFloat:
+		if _, err := strconv.ParseFloat(s, 64); err != nil {
+			argsErr.add(name, "should be a float number")
+		}
+	case KindTime:
+		if _, err := time.Parse(time.RFC3339, s); err != nil {
+			argsErr.add(name, "should be an RFC3339 time (e.g. 2019-05-01T10:00:00Z)")
+		}
+	}
+	return []string{s}
+}
+
+/*
+args[0] = function (optional)
+Returns {Version,Functions:{function:[fields]}} or {Version,Function,Fields} for one function.
+*/
+func (s *SmartContract) queryArgSchema(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1")
+	}
+	if len(args) == 0 {
+		schemaAsBytes, _ := json.Marshal(struct {
+			Version   int
+			Functions map[string][]ArgField
+		}{ArgsVersion, argSchemas})
+		return shim.Success(schemaAsBytes)
+	}
+	schema, ok := argSchemas[args[0]]
+	if ok == false {
+		return shim.Error(fmt.Sprintf("Unknown function %s", args[0]))
+	}
+	schemaAsBytes, _ := json.Marshal(struct {
+		Version  int
+		Function string
+		Fields   []ArgField
+	}{ArgsVersion, args[0], schema})
+	return shim.Success(schemaAsBytes)
+}
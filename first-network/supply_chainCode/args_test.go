@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseJSONArgs(t *testing.T) {
+	cases := []struct {
+		name     string
+		function string
+		doc      string
+		args     []string
+	}{
+		{"numbers and strings", "deliverCrude",
+			`{"Version":1,"Value":20.50,"Quantity":"100","Owner":"org1","EstTime":"2019-05-01T10:00:00Z",
+			"StartingLocation":"org1","Destination":"org3","VesselID":"V1","Timestamp":"2019-05-01T08:00:00Z"}`,
+			[]string{"20.50", "100", "org1", "2019-05-01T10:00:00Z", "org1", "org3", "V1", "2019-05-01T08:00:00Z"}},
+		{"fields in any order", "transfer",
+			`{"PlanID":"Plan00000001","Timestamp":"2019-05-01T10:00:00Z","Owner":"org5","AssetID":"FuelOrder00000001","Version":1}`,
+			[]string{"FuelOrder00000001", "org5", "2019-05-01T10:00:00Z", "Plan00000001", ""}},
+		{"received quantity of a crude", "transfer",
+			`{"Version":1,"AssetID":"Crude00000001","Owner":"org3","Timestamp":"2019-05-01T10:00:00Z","ReceivedQuantity":95}`,
+			[]string{"Crude00000001", "org3", "2019-05-01T10:00:00Z", "", "95"}},
+		{"missing optional field", "transfer",
+			`{"Version":1,"AssetID":"Crude00000001","Owner":"org3","Timestamp":"2019-05-01T10:00:00Z"}`,
+			[]string{"Crude00000001", "org3", "2019-05-01T10:00:00Z"}},
+		{"deliveries", "deliverFuel",
+			`{"Version":1,"TruckID":"T1","Deliveries":[
+			{"FuelOrderID":"FuelOrder00000001","EstTime":"2019-05-01T10:00:00Z","StartingLocation":"org3","Destination":"org5"},
+			{"FuelOrderID":"FuelOrder00000002","EstTime":"2019-05-01T11:00:00Z","StartingLocation":"org3","Destination":"org6"}]}`,
+			[]string{"T1", "FuelOrder00000001", "2019-05-01T10:00:00Z", "org3", "org5",
+				"FuelOrder00000002", "2019-05-01T11:00:00Z", "org3", "org6"}},
+		{"only the type", "queryAssetByRange", `{"Version":1,"Type":"Fuel"}`, []string{"Fuel"}},
+		{"defaults of the page", "queryAssetByRange",
+			`{"Version":1,"Type":"FuelOrder","Filters":{"state":"ON_WAY","dest":"org5"}}`,
+			[]string{"FuelOrder", "0", "", "dest=org5", "state=ON_WAY"}},
+		{"selector", "richQuery", `{"Version":1,"Type":"Fuel","Selector":{"Density":{"$lt":0.8}},"PageSize":10}`,
+			[]string{"Fuel", `{"Density":{"$lt":0.8}}`, "10", ""}},
+		{"no fields", "initLedger", `{"Version":1}`, []string{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			args, err := ParseJSONArgs(c.function, c.doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reflect.DeepEqual(args, c.args) == false {
+				t.Fatalf("args should be %q and not %q", c.args, args)
+			}
+		})
+	}
+}
+
+func TestParseJSONArgsErrors(t *testing.T) {
+	cases := []struct {
+		name     string
+		function string
+		doc      string
+		errors   []FieldError
+	}{
+		{"unknown function", "foo", `{"Version":1}`,
+			[]FieldError{{"", "Function foo doesn't take a JSON document"}}},
+		{"not an object", "queryAsset", `{"Version":1`, nil},
+		{"no version", "queryAsset", `{"ID":"Crude00000001"}`, []FieldError{{"Version", "is required"}}},
+		{"wrong version", "queryAsset", `{"Version":2,"ID":"Crude00000001"}`, []FieldError{{"Version", "should be 1"}}},
+		{"every bad field", "deliverCrude",
+			`{"Version":1,"Value":"1.234","Quantity":-1,"Owner":"driller","EstTime":"tomorrow",
+			"StartingLocation":"org1","Destination":3,"Timestamp":"2019-05-01T10:00:00Z","Vessel":"V1"}`,
+			[]FieldError{
+				{"Vessel", "is not a field of this function"},
+				{"Value", "should be a non negative amount with at most 2 decimal digits"},
+				{"Quantity", "should be a non negative int number"},
+				{"Owner", "should be an org (e.g. 'org3')"},
+				{"EstTime", "should be an RFC3339 time (e.g. 2019-05-01T10:00:00Z)"},
+				{"Destination", "should be a string"},
+				{"VesselID", "is required"},
+			}},
+		{"bad delivery", "deliverFuel",
+			`{"Version":1,"TruckID":"T1","Deliveries":[{"FuelOrderID":"FuelOrder00000001","EstTime":"2019-05-01T10:00:00Z",
+			"StartingLocation":"org3","Destination":"org5"},{"FuelOrderID":"","EstTime":"2019-05-01T10:00:00Z","Destination":"org5"}]}`,
+			[]FieldError{{"Deliveries[1].FuelOrderID", "should not be empty"}, {"Deliveries[1].StartingLocation", "is required"}}},
+		{"no deliveries", "deliverFuel", `{"Version":1,"TruckID":"T1","Deliveries":[]}`,
+			[]FieldError{{"Deliveries", "should be a non empty array"}}},
+		{"bookmark without page size", "richQuery", `{"Version":1,"Type":"Fuel","Selector":{"Type":"diesel"},"Bookmark":"b"}`,
+			[]FieldError{{"PageSize", "is required when other optional fields are given"}}},
+		{"bad filter", "queryAssetByRange", `{"Version":1,"Type":"Fuel","Filters":{"owner":3}}`,
+			[]FieldError{{"Filters.owner", "should be a non empty string"}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := ParseJSONArgs(c.function, c.doc)
+			argsErr, ok := err.(*ArgsError)
+			if ok == false {
+				t.Fatalf("error should be an ArgsError and not %v", err)
+			}
+			if c.errors != nil && reflect.DeepEqual(argsErr.Errors, c.errors) == false {
+				t.Fatalf("errors should be %+v and not %+v", c.errors, argsErr.Errors)
+			}
+			if len(argsErr.Errors) == 0 {
+				t.Fatal("no field errors")
+			}
+		})
+	}
+}
+
+//the same flow as TestHappyPath with JSON documents.
+func TestJSONArgsInvoke(t *testing.T) {
+	stub := newTestStub(t)
+	now := testNow()
+	est := testLater()
+	doc := func(fields map[string]interface{}) string {
+		fields["Version"] = ArgsVersion
+		docAsBytes, _ := json.Marshal(fields)
+		return string(docAsBytes)
+	}
+	crudeID := mustInvoke(t, stub, "Org1MSP", "deliverCrude", doc(map[string]interface{}{
+		"Value": 50, "Quantity": 100, "Owner": "org1", "EstTime": est, "StartingLocation": "org1",
+		"Destination": "org3", "VesselID": "V1", "Timestamp": now}))
+	mustInvoke(t, stub, "Org2MSP", "arrive", doc(map[string]interface{}{
+		"AssetID": crudeID, "Quantity": 100, "Timestamp": now}))
+	mustInvoke(t, stub, "Org3MSP", "transfer", doc(map[string]interface{}{
+		"AssetID": crudeID, "Owner": "org3", "Timestamp": now}))
+	fuelID := mustInvoke(t, stub, "Org3MSP", "refine", doc(map[string]interface{}{
+		"Value": "40", "Quantity": 80, "Owner": "org3", "Density": 0.8, "Type": "diesel", "CrudeID": crudeID, "Timestamp": now}))
+	orderID := mustInvoke(t, stub, "Org3MSP", "addFuelOrder", doc(map[string]interface{}{
+		"Value": 20.5, "Quantity": 30, "Owner": "org3", "Destination": "org5", "FuelID": fuelID, "Timestamp": now}))
+	mustInvoke(t, stub, "Org5MSP", "acceptFuelOrder", doc(map[string]interface{}{"FuelOrderID": orderID}))
+	planID := mustInvoke(t, stub, "Org4MSP", "deliverFuel", doc(map[string]interface{}{
+		"TruckID": "T1", "Deliveries": []map[string]string{
+			{"FuelOrderID": orderID, "EstTime": est, "StartingLocation": "org3", "Destination": "org5"}}}))
+	mustInvoke(t, stub, "Org4MSP", "arrive", doc(map[string]interface{}{
+		"AssetID": orderID, "Quantity": 30, "Timestamp": now, "PlanID": planID}))
+	mustInvoke(t, stub, "Org5MSP", "transfer", doc(map[string]interface{}{
+		"AssetID": orderID, "Owner": "org5", "Timestamp": now, "PlanID": planID}))
+	checkBalances(t, stub, map[string]Amount{
+		"org1": 10005000, "org2": 10001000, "org3": 9996050, "org4": 10000300, "org5": 9997650,
+	})
+
+	//the error of an invalid document is an ArgsError.
+	res := invoke(stub, "Org3MSP", "addFuelOrder", `{"Version":1,"Value":"x"}`)
+	argsErr := ArgsError{}
+	if err := json.Unmarshal([]byte(res.Message), &argsErr); err != nil || len(argsErr.Errors) != 6 {
+		t.Fatalf("error should be an ArgsError with 6 field errors and not %s", res.Message)
+	}
+	schema := mustInvoke(t, stub, "Org1MSP", "queryArgSchema", "deliverFuel")
+	if strings.Contains(schema, `"Name":"Deliveries"`) == false {
+		t.Fatalf("schema of deliverFuel is %s", schema)
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Configuration of the chaincode, put in db with key Config.
+
+It's set by Init, so changing it needs a chaincode upgrade that the orgs agree on, e.g.
+	peer chaincode upgrade ... -c '{"Args":["init","maxClockDrift=300","shortfallTolerance=2","arbiter=org6","registrar=org1"]}'
+Init args that are not of the form key=value are ignored and keys that are
+not given keep their current (or default) value.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const ConfigKey = "Config"
+
+type Config struct {
+	MaxClockDrift      int64  //seconds that a client supplied time can differ from the transaction time
+	ShortfallTolerance int64  //percent of a delivery that may be missing without opening a dispute
+	Arbiter            string `json:",omitempty"` //org that resolves the disputes (see disputes.go)
+	Registrar          string `json:",omitempty"` //org that manages the participants (see participants.go)
+}
+
+var DefaultConfig = Config{MaxClockDrift: 300, ShortfallTolerance: 2}
+
+func GetConfig(stub shim.ChaincodeStubInterface) (Config, error) {
+	configAsBytes, err := stub.GetState(ConfigKey)
+	if err != nil {
+		return Config{}, fmt.Errorf("Failed to get config: %s", err.Error())
+	}
+	config := DefaultConfig
+	if configAsBytes == nil {
+		return config, nil
+	}
+	if err = json.Unmarshal(configAsBytes, &config); err != nil {
+		return Config{}, fmt.Errorf("Failed to decode config: %s", err.Error())
+	}
+	return config, nil
+}
+
+//update the config with the key=value args of Init.
+func ApplyConfigArgs(stub shim.ChaincodeStubInterface, args []string) error {
+	config, err := GetConfig(stub)
+	if err != nil {
+		return err
+	}
+	changed := false
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "maxClockDrift":
+			drift, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil || drift < 0 {
+				return fmt.Errorf("maxClockDrift should be a non negative number of seconds")
+			}
+			config.MaxClockDrift = drift
+		case "shortfallTolerance":
+			tolerance, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil || tolerance < 0 || tolerance > 100 {
+				return fmt.Errorf("shortfallTolerance should be a percent between 0 and 100")
+			}
+			config.ShortfallTolerance = tolerance
+		case "arbiter":
+			if HasPrefixOrg(kv[1]) == false {
+				return fmt.Errorf("arbiter should be an org (e.g. 'org6')")
+			}
+			config.Arbiter = kv[1]
+		case "registrar":
+			if HasPrefixOrg(kv[1]) == false {
+				return fmt.Errorf("registrar should be an org (e.g. 'org1')")
+			}
+			config.Registrar = kv[1]
+		default:
+			return fmt.Errorf("Unknown config key %s", kv[0])
+		}
+		changed = true
+	}
+	if changed == false {
+		return nil
+	}
+	configAsBytes, _ := json.Marshal(config)
+	if err = stub.PutState(ConfigKey, configAsBytes); err != nil {
+		return fmt.Errorf("Failed to put config in db")
+	}
+	return nil
+}
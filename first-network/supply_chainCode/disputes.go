@@ -0,0 +1,607 @@
+/*
+Disputes of the deliveries.
+
+A party of a delivery (the buyer, the carrier or the supplier) can open a dispute with
+openDispute against a Crude or FuelOrder that has arrived or has been delivered, e.g. a
+carrier that declared an order of 10 as delivered when only 8 were received.
+A dispute is also opened by transfer when the destination reports a shortfall of more than
+shortfallTolerance percent of the quantity of the asset (see config.go).
+Claims, responses and decisions carry the SHA-256 hashes of their evidence, which is kept off-chain.
+
+While a dispute is open the asset is DISPUTED, so it can't be transferred, refined etc.
+The other parties answer with respondDispute and the arbiter org of the config resolves it
+with resolveDispute, which restores the state of the asset and either
+	DISMISS - leaves the payments as they are,
+	REVERSE - refunds to the buyer everything it paid for the asset or
+	ADJUST  - moves the given amounts between the buyer and the other parties.
+An asset has at most one dispute that is not resolved. Its disputes are numbered from 1 and put in db
+with the composite key Dispute~AssetID~number, so the resolved ones are kept as its history.
+*/
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const DisputeObjectType = "Dispute"
+
+const (
+	DisputeOpen      = "OPEN"
+	DisputeResponded = "RESPONDED"
+	DisputeResolved  = "RESOLVED"
+)
+
+const (
+	DecisionDismiss = "DISMISS"
+	DecisionReverse = "REVERSE"
+	DecisionAdjust  = "ADJUST"
+)
+
+//a claim, response or decision of a dispute.
+type DisputeEntry struct {
+	Org      string
+	Text     string
+	Evidence []string `json:",omitempty"` //SHA-256 hashes (hex) of documents kept off-chain
+	Time     time.Time
+}
+
+/*
+An amount moved by the resolution of a dispute. A positive amount is paid by the buyer
+to Org and a negative one is refunded by Org to the buyer.
+*/
+type Adjustment struct {
+	Org    string
+	Amount Amount
+}
+
+type Resolution struct {
+	DisputeEntry
+	Decision    string
+	Adjustments []Adjustment `json:",omitempty"`
+}
+
+type Dispute struct {
+	AssetID     string
+	Seq         int //number of the dispute among the disputes of the asset, from 1
+	State       string
+	Buyer       string
+	Carrier     string
+	Supplier    string
+	FrozenState string //state of the asset before the dispute, restored when it's resolved
+	Claim       DisputeEntry
+	Responses   []DisputeEntry `json:",omitempty"`
+	Resolution  *Resolution    `json:",omitempty"`
+	Ordered     int            //quantity of the asset
+	Declared    int            //quantity declared by the carrier
+	Received    int            //quantity received by the destination
+}
+
+//a Crude or a FuelOrder that can be disputed. AD and Handover point into asset.
+type delivery struct {
+	ID       string
+	AD       *AssetDetails
+	Handover *Handover
+	Buyer    string
+	asset    interface{}
+}
+
+func getDelivery(stub shim.ChaincodeStubInterface, id string) (delivery, error) {
+	assetAsBytes, err := stub.GetState(id)
+	if err != nil {
+		return delivery{}, fmt.Errorf("Failed to get %s: %s", id, err.Error())
+	}
+	if assetAsBytes == nil {
+		return delivery{}, fmt.Errorf("Could not locate asset %s", id)
+	}
+	switch AssetType(id) {
+	case "Crude":
+		crude := &Crude{}
+		if err = json.Unmarshal(assetAsBytes, crude); err != nil {
+			return delivery{}, fmt.Errorf("Failed to decode %s", id)
+		}
+		return delivery{id, &crude.AD, crude.Handover, crude.DD.Destination, crude}, nil
+	case "FuelOrder":
+		fuelOrder := &FuelOrder{}
+		if err = json.Unmarshal(assetAsBytes, fuelOrder); err != nil {
+			return delivery{}, fmt.Errorf("Failed to decode %s", id)
+		}
+		return delivery{id, &fuelOrder.AD, fuelOrder.Handover, fuelOrder.Dest, fuelOrder}, nil
+	}
+	return delivery{}, fmt.Errorf("Only a Crude or a FuelOrder can be disputed")
+}
+
+func (d delivery) put(stub shim.ChaincodeStubInterface) error {
+	assetAsBytes, _ := json.Marshal(d.asset)
+	if err := PutAsset(stub, d.ID, assetAsBytes); err != nil {
+		return fmt.Errorf("Failed to put %s in db", d.ID)
+	}
+	return nil
+}
+
+//the number is zero padded so the disputes of an asset are iterated in order.
+func disputeKey(stub shim.ChaincodeStubInterface, assetID string, seq int) (string, error) {
+	key, err := stub.CreateCompositeKey(DisputeObjectType, []string{assetID, fmt.Sprintf("%08d", seq)})
+	if err != nil {
+		return "", fmt.Errorf("Failed to create dispute key of %s: %s", assetID, err.Error())
+	}
+	return key, nil
+}
+
+//returns the latest dispute of the asset or nil if it has none.
+func GetDispute(stub shim.ChaincodeStubInterface, assetID string) (*Dispute, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(DisputeObjectType, []string{assetID})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get dispute of %s: %s", assetID, err.Error())
+	}
+	defer resultsIterator.Close()
+	var disputeAsBytes []byte
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		disputeAsBytes = queryResponse.Value
+	}
+	if disputeAsBytes == nil {
+		return nil, nil
+	}
+	dispute := Dispute{}
+	if err = json.Unmarshal(disputeAsBytes, &dispute); err != nil {
+		return nil, fmt.Errorf("Failed to decode dispute of %s", assetID)
+	}
+	return &dispute, nil
+}
+
+//returns the dispute of the asset with the given number or nil if there is no such dispute.
+func GetDisputeSeq(stub shim.ChaincodeStubInterface, assetID string, seq int) (*Dispute, error) {
+	key, err := disputeKey(stub, assetID, seq)
+	if err != nil {
+		return nil, err
+	}
+	disputeAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get dispute %d of %s: %s", seq, assetID, err.Error())
+	}
+	if disputeAsBytes == nil {
+		return nil, nil
+	}
+	dispute := Dispute{}
+	if err = json.Unmarshal(disputeAsBytes, &dispute); err != nil {
+		return nil, fmt.Errorf("Failed to decode dispute %d of %s", seq, assetID)
+	}
+	return &dispute, nil
+}
+
+func putDispute(stub shim.ChaincodeStubInterface, dispute Dispute) error {
+	key, err := disputeKey(stub, dispute.AssetID, dispute.Seq)
+	if err != nil {
+		return err
+	}
+	disputeAsBytes, _ := json.Marshal(dispute)
+	if err = stub.PutState(key, disputeAsBytes); err != nil {
+		return fmt.Errorf("Failed to put dispute of %s in db", dispute.AssetID)
+	}
+	return nil
+}
+
+/*
+Open a dispute on an asset that has arrived or has been delivered and freeze the asset.
+The earlier disputes of the asset have to be resolved. The caller has to put the asset in db.
+*/
+func OpenDispute(stub shim.ChaincodeStubInterface, d delivery, claim DisputeEntry) (Dispute, error) {
+	previous, err := GetDispute(stub, d.ID)
+	if err != nil {
+		return Dispute{}, err
+	}
+	seq := 1
+	if previous != nil {
+		if previous.State != DisputeResolved {
+			return Dispute{}, fmt.Errorf("%s already has a dispute that is %s", d.ID, previous.State)
+		}
+		seq = previous.Seq + 1
+	}
+	if d.Handover == nil || (d.AD.State != StateArrived && d.AD.State != StateDelivered) {
+		return Dispute{}, fmt.Errorf("Only a delivery that has arrived can be disputed. %s is %s", d.ID, d.AD.State)
+	}
+	h := d.Handover
+	dispute := Dispute{
+		AssetID:     d.ID,
+		Seq:         seq,
+		State:       DisputeOpen,
+		Buyer:       d.Buyer,
+		Carrier:     h.Carrier,
+		Supplier:    h.Supplier,
+		FrozenState: d.AD.State,
+		Claim:       claim,
+		Ordered:     d.AD.Quantity,
+		Declared:    h.Quantity,
+		Received:    h.Received,
+	}
+	if dispute.isParty(claim.Org) == false {
+		return Dispute{}, fmt.Errorf("%s is not a party of the delivery of %s", claim.Org, d.ID)
+	}
+	if err = putDispute(stub, dispute); err != nil {
+		return Dispute{}, err
+	}
+	h.Disputed = true
+	d.AD.State = StateDisputed
+	return dispute, nil
+}
+
+/*
+Open a dispute if the shortfall of a delivery that the buyer accepted exceeds the tolerance.
+Returns the dispute or nil if none was opened.
+*/
+func CheckShortfall(stub shim.ChaincodeStubInterface, d delivery) (*Dispute, error) {
+	h := d.Handover
+	h.Shortfall = d.AD.Quantity - h.Received
+	config, err := GetConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+	if int64(h.Shortfall)*100 <= config.ShortfallTolerance*int64(d.AD.Quantity) {
+		return nil, nil
+	}
+	claim := DisputeEntry{Org: d.Buyer, Time: h.AnsweredAt,
+		Text: fmt.Sprintf("Shortfall of %d out of %d exceeds the tolerance of %d%%",
+			h.Shortfall, d.AD.Quantity, config.ShortfallTolerance)}
+	dispute, err := OpenDispute(stub, d, claim)
+	if err != nil {
+		return nil, err
+	}
+	return &dispute, nil
+}
+
+func (d Dispute) isParty(org string) bool {
+	return org != "" && (org == d.Buyer || org == d.Carrier || org == d.Supplier)
+}
+
+//the evidence hashes of args. Each one should be a hex SHA-256.
+func evidenceArgs(args []string) ([]string, error) {
+	hashes := []string{}
+	for _, arg := range args {
+		hash, err := hex.DecodeString(arg)
+		if err != nil || len(hash) != 32 {
+			return nil, fmt.Errorf("Evidence %s is not a hex SHA-256 hash", arg)
+		}
+		hashes = append(hashes, strings.ToLower(arg))
+	}
+	return hashes, nil
+}
+
+//a claim, response or decision from args {text,timestamp,evidence...}.
+func disputeEntryArgs(stub shim.ChaincodeStubInterface, org string, args []string) (DisputeEntry, error) {
+	if strings.TrimSpace(args[0]) == "" {
+		return DisputeEntry{}, fmt.Errorf("Text of the dispute is missing")
+	}
+	Timestamp, err := TrustedTime(stub, args[1])
+	if err != nil {
+		return DisputeEntry{}, err
+	}
+	evidence, err := evidenceArgs(args[2:])
+	if err != nil {
+		return DisputeEntry{}, err
+	}
+	return DisputeEntry{org, args[0], evidence, Timestamp}, nil
+}
+
+/*
+What the buyer paid to each org for the asset, from the journal of the buyer.
+The refunds and adjustments of earlier disputes are included, so the amounts are net.
+Returns the amounts by org and the orgs in the order they were paid.
+*/
+func PaidForAsset(stub shim.ChaincodeStubInterface, buyer, assetID string) (map[string]Amount, []string, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(StatementIndex, []string{buyer})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resultsIterator.Close()
+	paid := make(map[string]Amount)
+	orgs := []string{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		entry := JournalEntry{}
+		if err = json.Unmarshal(queryResponse.Value, &entry); err != nil {
+			return nil, nil, fmt.Errorf("Failed to decode journal entry")
+		}
+		if entry.AssetID != assetID {
+			continue
+		}
+		switch {
+		case entry.Payer == buyer && entry.Reason != ReasonRefund:
+			if _, ok := paid[entry.Payee]; ok == false {
+				orgs = append(orgs, entry.Payee)
+			}
+			paid[entry.Payee] += entry.Amount
+		case entry.Payee == buyer && entry.Reason == ReasonRefund:
+			paid[entry.Payer] -= entry.Amount
+		}
+	}
+	return paid, orgs, nil
+}
+
+/*
+Move the adjustments between the buyer and the other orgs in one update of the accounts
+and journal them. Returns the payments that were made.
+*/
+func Adjust(stub shim.ChaincodeStubInterface, assetID, buyer string, adjustments []Adjustment) ([]Payment, error) {
+	orgs := []string{buyer}
+	for _, a := range adjustments {
+		orgs = append(orgs, a.Org)
+	}
+	accounts, orgs, err := GetAccounts(stub, orgs)
+	if err != nil {
+		return nil, err
+	}
+	payments := []Payment{}
+	byPayer := make(map[string][]OrgAmount)
+	payers := []string{}
+	for _, a := range adjustments {
+		p := Payment{buyer, a.Org, a.Amount}
+		reason := ReasonAdjustment
+		if a.Amount < 0 {
+			p = Payment{a.Org, buyer, -a.Amount}
+			reason = ReasonRefund
+		}
+		if p.Amount == 0 {
+			continue
+		}
+		accounts[p.From].Balance -= p.Amount
+		accounts[p.To].Balance += p.Amount
+		if _, ok := byPayer[p.From]; ok == false {
+			payers = append(payers, p.From)
+		}
+		byPayer[p.From] = append(byPayer[p.From], OrgAmount{p.Amount, p.To, reason})
+		payments = append(payments, p)
+	}
+	for _, org := range orgs {
+		if acc := accounts[org]; acc.Balance < -acc.CreditLimit {
+			return nil, fmt.Errorf("%s can't pay. Balance would be %s and the credit limit is %s",
+				org, acc.Balance, acc.CreditLimit)
+		}
+	}
+	if err = PutAccounts(stub, accounts, orgs); err != nil {
+		return nil, err
+	}
+	for _, payer := range payers {
+		if err = WriteJournal(stub, assetID, payer, byPayer[payer]); err != nil {
+			return nil, err
+		}
+	}
+	return payments, nil
+}
+
+/*
+A party of the delivery opens a dispute.
+args[0] = ID of a Crude or FuelOrder
+args[1] = claim
+args[2] = timestamp
+args[3:] = SHA-256 hashes (hex) of the evidence (optional)
+*/
+func (s *SmartContract) openDispute(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) < 3 {
+		return shim.Error("Incorrect number of arguments. Expecting at least 3")
+	}
+	caller, err := GetCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	claim, err := disputeEntryArgs(stub, caller.Org, args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	d, err := getDelivery(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	dispute, err := OpenDispute(stub, d, claim)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = d.put(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	ev := NewEvent(stub, EventDisputeOpened)
+	ev.AddChange(d.ID, dispute.FrozenState, d.AD.State, d.AD.Owner)
+	ev.AddDispute(d.ID)
+	if err = ev.Emit(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+/*
+A party of the delivery, other than the one that opened the dispute, responds to it.
+args[0] = ID of a Crude or FuelOrder
+args[1] = response
+args[2] = timestamp
+args[3:] = SHA-256 hashes (hex) of the evidence (optional)
+*/
+func (s *SmartContract) respondDispute(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) < 3 {
+		return shim.Error("Incorrect number of arguments. Expecting at least 3")
+	}
+	caller, err := GetCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	response, err := disputeEntryArgs(stub, caller.Org, args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	dispute, err := GetDispute(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if dispute == nil {
+		return shim.Error(fmt.Sprintf("%s has no dispute", args[0]))
+	}
+	if dispute.State == DisputeResolved {
+		return shim.Error(fmt.Sprintf("Dispute of %s is resolved", args[0]))
+	}
+	if dispute.isParty(caller.Org) == false || caller.Org == dispute.Claim.Org {
+		return shim.Error(fmt.Sprintf("Only the counterparties of %s can respond to its claim", dispute.Claim.Org))
+	}
+	dispute.Responses = append(dispute.Responses, response)
+	dispute.State = DisputeResponded
+	if err = putDispute(stub, *dispute); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+/*
+The arbiter resolves a dispute and the asset gets back the state it had before the dispute.
+args[0] = ID of a Crude or FuelOrder
+args[1] = decision {DISMISS,REVERSE,ADJUST}
+args[2] = reasoning of the decision
+args[3] = timestamp
+args[4:] = org=amount adjustments, one per org and only for ADJUST (e.g. org4=-2.40 refunds 2.40 of org4 to the buyer)
+*/
+func (s *SmartContract) resolveDispute(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) < 4 {
+		return shim.Error("Incorrect number of arguments. Expecting at least 4")
+	}
+	caller, err := GetCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	config, err := GetConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if config.Arbiter == "" {
+		return shim.Error("No arbiter org is configured. Set one with the arbiter key of Init")
+	}
+	if caller.Org != config.Arbiter {
+		return shim.Error(fmt.Sprintf("Only the arbiter %s can resolve a dispute", config.Arbiter))
+	}
+	entry, err := disputeEntryArgs(stub, caller.Org, []string{args[2], args[3]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	dispute, err := GetDispute(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if dispute == nil {
+		return shim.Error(fmt.Sprintf("%s has no dispute", args[0]))
+	}
+	if dispute.State == DisputeResolved {
+		return shim.Error(fmt.Sprintf("Dispute of %s is resolved", args[0]))
+	}
+	if dispute.isParty(caller.Org) {
+		return shim.Error(fmt.Sprintf("The arbiter %s is a party of the dispute", caller.Org))
+	}
+	paid, orgs, err := PaidForAsset(stub, dispute.Buyer, dispute.AssetID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args) > 4 && args[1] != DecisionAdjust {
+		return shim.Error(fmt.Sprintf("Adjustments are allowed only with %s", DecisionAdjust))
+	}
+	resolution := Resolution{DisputeEntry: entry, Decision: args[1]}
+	switch args[1] {
+	case DecisionDismiss:
+	case DecisionReverse:
+		for _, org := range orgs {
+			resolution.Adjustments = append(resolution.Adjustments, Adjustment{org, -paid[org]})
+		}
+	case DecisionAdjust:
+		if len(args) == 4 {
+			return shim.Error("Adjustments of the form org=amount are missing")
+		}
+		adjusted := make(map[string]bool)
+		for _, arg := range args[4:] {
+			kv := strings.SplitN(arg, "=", 2)
+			if len(kv) != 2 {
+				return shim.Error(fmt.Sprintf("Adjustment %s is not of the form org=amount", arg))
+			}
+			amount, err := ParseAmount(kv[1])
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if kv[0] == dispute.Buyer || dispute.isParty(kv[0]) == false {
+				return shim.Error(fmt.Sprintf("%s is not the carrier or the supplier of %s", kv[0], dispute.AssetID))
+			}
+			//one adjustment per org, so the refund is checked against all it was paid.
+			if adjusted[kv[0]] {
+				return shim.Error(fmt.Sprintf("%s is adjusted more than once", kv[0]))
+			}
+			adjusted[kv[0]] = true
+			if amount < 0 && -amount > paid[kv[0]] {
+				return shim.Error(fmt.Sprintf("%s can refund at most the %s it was paid for %s", kv[0], paid[kv[0]], dispute.AssetID))
+			}
+			resolution.Adjustments = append(resolution.Adjustments, Adjustment{kv[0], amount})
+		}
+	default:
+		return shim.Error(fmt.Sprintf("Decision should be one of %s,%s,%s", DecisionDismiss, DecisionReverse, DecisionAdjust))
+	}
+	payments, err := Adjust(stub, dispute.AssetID, dispute.Buyer, resolution.Adjustments)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	d, err := getDelivery(stub, dispute.AssetID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ev := NewEvent(stub, EventDisputeResolved)
+	ev.AddChange(d.ID, d.AD.State, dispute.FrozenState, d.AD.Owner)
+	ev.Payments = append(ev.Payments, payments...)
+	d.AD.State = dispute.FrozenState
+	if err = d.put(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	dispute.Resolution = &resolution
+	dispute.State = DisputeResolved
+	if err = putDispute(stub, *dispute); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = ev.Emit(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+/*
+args[0] = ID of a Crude or FuelOrder
+args[1] = number of the dispute (optional, the latest one by default)
+*/
+func (s *SmartContract) queryDispute(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+	var dispute *Dispute
+	var err error
+	if len(args) == 1 {
+		dispute, err = GetDispute(stub, args[0])
+	} else {
+		seq, convErr := strconv.Atoi(args[1])
+		if convErr != nil || seq < 1 {
+			return shim.Error("Number of the dispute is not a positive int number")
+		}
+		dispute, err = GetDisputeSeq(stub, args[0], seq)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if dispute == nil && len(args) == 1 {
+		return shim.Error(fmt.Sprintf("%s has no dispute", args[0]))
+	}
+	if dispute == nil {
+		return shim.Error(fmt.Sprintf("%s has no dispute %s", args[0], args[1]))
+	}
+	disputeAsBytes, _ := json.Marshal(dispute)
+	return shim.Success(disputeAsBytes)
+}
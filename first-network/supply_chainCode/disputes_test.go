@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//SHA-256 of "bill of lading".
+const testEvidence = "28da4193b5f3bbe6efb52a64069aff85f6948bebe624148369005ec84a0b9fb6"
+
+func setTestArbiter(t *testing.T, stub *shim.MockStub, org string) {
+	t.Helper()
+	if res := stub.MockInit("init", [][]byte{[]byte("init"), []byte("arbiter=" + org)}); res.Status != shim.OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+}
+
+func getTestDispute(t *testing.T, stub *shim.MockStub, id string) Dispute {
+	t.Helper()
+	dispute := Dispute{}
+	if err := json.Unmarshal([]byte(mustInvoke(t, stub, "Org1MSP", "queryDispute", id)), &dispute); err != nil {
+		t.Fatal(err)
+	}
+	return dispute
+}
+
+//a disputed crude can't be refined until the arbiter dismisses the dispute.
+func TestDisputeFreezesAsset(t *testing.T) {
+	stub, ids := newTestPlan(t)
+	now := testNow()
+	runErrorCases(t, stub, []errorCase{
+		{"wrong number of args", "Org3MSP", []string{"openDispute", ids.Crude, "leaking"}, "Expecting at least 3"},
+		{"no claim", "Org3MSP", []string{"openDispute", ids.Crude, " ", now}, "Text of the dispute is missing"},
+		{"bad evidence", "Org3MSP", []string{"openDispute", ids.Crude, "leaking", now, "bill.pdf"}, "not a hex SHA-256 hash"},
+		{"not a party", "Org4MSP", []string{"openDispute", ids.Crude, "leaking", now}, "org4 is not a party of the delivery"},
+		{"order hasn't arrived", "Org5MSP", []string{"openDispute", ids.FuelOrder, "late", now}, "is ON_WAY"},
+		{"fuel isn't a delivery", "Org3MSP", []string{"openDispute", ids.Fuel, "watered", now}, "Only a Crude or a FuelOrder"},
+	})
+	mustInvoke(t, stub, "Org3MSP", "openDispute", ids.Crude, "leaking", now, testEvidence)
+	dispute := getTestDispute(t, stub, ids.Crude)
+	if dispute.State != DisputeOpen || dispute.Buyer != "org3" || dispute.Carrier != "org2" || dispute.Supplier != "org1" ||
+		len(dispute.Claim.Evidence) != 1 || dispute.Claim.Evidence[0] != testEvidence {
+		t.Fatalf("Wrong dispute: %+v", dispute)
+	}
+	runErrorCases(t, stub, []errorCase{
+		{"refine a disputed crude", "Org3MSP", []string{"refine", "5", "10", "org3", "0.8", "diesel", ids.Crude, now}, "Cannot refine a Crude that is DISPUTED"},
+		{"disputed twice", "Org1MSP", []string{"openDispute", ids.Crude, "paid late", now}, "already has a dispute that is OPEN"},
+		{"claimant responds", "Org3MSP", []string{"respondDispute", ids.Crude, "really", now}, "Only the counterparties of org3"},
+		{"outsider responds", "Org5MSP", []string{"respondDispute", ids.Crude, "really", now}, "Only the counterparties of org3"},
+		{"no arbiter", "Org6MSP", []string{"resolveDispute", ids.Crude, DecisionDismiss, "no proof", now}, "No arbiter org is configured"},
+	})
+	mustInvoke(t, stub, "Org2MSP", "respondDispute", ids.Crude, "sealed at loading", now, testEvidence)
+	if dispute = getTestDispute(t, stub, ids.Crude); dispute.State != DisputeResponded || len(dispute.Responses) != 1 {
+		t.Fatalf("Dispute should have the response of org2: %+v", dispute)
+	}
+	setTestArbiter(t, stub, "org6")
+	runErrorCases(t, stub, []errorCase{
+		{"not the arbiter", "Org5MSP", []string{"resolveDispute", ids.Crude, DecisionDismiss, "no proof", now}, "Only the arbiter org6"},
+		{"unknown decision", "Org6MSP", []string{"resolveDispute", ids.Crude, "SPLIT", "no proof", now}, "Decision should be one of"},
+		{"adjustments of a dismissal", "Org6MSP", []string{"resolveDispute", ids.Crude, DecisionDismiss, "no proof", now, "org2=-1"}, "only with ADJUST"},
+		{"no adjustments", "Org6MSP", []string{"resolveDispute", ids.Crude, DecisionAdjust, "no proof", now}, "Adjustments of the form org=amount are missing"},
+	})
+	mustInvoke(t, stub, "Org6MSP", "resolveDispute", ids.Crude, DecisionDismiss, "no proof", now)
+	checkBalances(t, stub, map[string]Amount{"org1": 10005000, "org2": 10001000, "org3": 9994000, "org5": 9997650})
+	if dispute = getTestDispute(t, stub, ids.Crude); dispute.State != DisputeResolved || dispute.Resolution == nil ||
+		dispute.Resolution.Decision != DecisionDismiss || dispute.Resolution.Org != "org6" {
+		t.Fatalf("Dispute should be dismissed by org6: %+v", dispute)
+	}
+	crude := Crude{}
+	getTestState(t, stub, ids.Crude, &crude)
+	if crude.AD.State != StateDelivered {
+		t.Fatalf("Crude should be DELIVERED again and not %s", crude.AD.State)
+	}
+	mustInvoke(t, stub, "Org3MSP", "refine", "5", "10", "org3", "0.8", "diesel", ids.Crude, now)
+	runErrorCases(t, stub, []errorCase{
+		{"resolved twice", "Org6MSP", []string{"resolveDispute", ids.Crude, DecisionReverse, "on second thought", now}, "is resolved"},
+		{"respond after the resolution", "Org1MSP", []string{"respondDispute", ids.Crude, "thanks", now}, "is resolved"},
+	})
+}
+
+//a resolved dispute is kept as history and doesn't block the dispute of a later shortfall.
+func TestDisputeAfterResolution(t *testing.T) {
+	stub, ids := newTestPlan(t)
+	now := testNow()
+	setTestArbiter(t, stub, "org6")
+	mustInvoke(t, stub, "Org4MSP", "arrive", ids.FuelOrder, "30", now, ids.Plan)
+	mustInvoke(t, stub, "Org5MSP", "openDispute", ids.FuelOrder, "seal is broken", now)
+	mustInvoke(t, stub, "Org6MSP", "resolveDispute", ids.FuelOrder, DecisionDismiss, "seal was replaced at loading", now)
+	mustInvoke(t, stub, "Org5MSP", "transfer", ids.FuelOrder, "org5", now, ids.Plan, "24")
+	dispute := getTestDispute(t, stub, ids.FuelOrder)
+	if dispute.Seq != 2 || dispute.State != DisputeOpen || dispute.Received != 24 {
+		t.Fatalf("Shortfall should open the second dispute: %+v", dispute)
+	}
+	first := Dispute{}
+	if err := json.Unmarshal([]byte(mustInvoke(t, stub, "Org1MSP", "queryDispute", ids.FuelOrder, "1")), &first); err != nil {
+		t.Fatal(err)
+	}
+	if first.Seq != 1 || first.State != DisputeResolved || first.Claim.Text != "seal is broken" {
+		t.Fatalf("First dispute should be kept resolved: %+v", first)
+	}
+	runErrorCases(t, stub, []errorCase{
+		{"dispute while open", "Org4MSP", []string{"openDispute", ids.FuelOrder, "short", now}, "already has a dispute that is OPEN"},
+		{"unknown dispute", "Org1MSP", []string{"queryDispute", ids.FuelOrder, "3"}, "has no dispute 3"},
+		{"bad number", "Org1MSP", []string{"queryDispute", ids.FuelOrder, "0"}, "not a positive int number"},
+	})
+}
+
+//the carrier contests an accepted order and the arbiter refunds the buyer.
+func TestReverseDispute(t *testing.T) {
+	stub, ids := newTestPlan(t)
+	now := testNow()
+	mustInvoke(t, stub, "Org4MSP", "arrive", ids.FuelOrder, "30", now, ids.Plan)
+	mustInvoke(t, stub, "Org5MSP", "transfer", ids.FuelOrder, "org5", now, ids.Plan)
+	checkBalances(t, stub, map[string]Amount{
+		"org1": 10005000, "org2": 10001000, "org3": 9996050, "org4": 10000300, "org5": 9997650,
+	})
+	mustInvoke(t, stub, "Org4MSP", "openDispute", ids.FuelOrder, "retailer kept the trailer", now)
+	setTestArbiter(t, stub, "org4")
+	mustFail(t, stub, "The arbiter org4 is a party", "Org4MSP", "resolveDispute", ids.FuelOrder, DecisionReverse, "wrong product", now)
+	setTestArbiter(t, stub, "org6")
+	mustInvoke(t, stub, "Org6MSP", "resolveDispute", ids.FuelOrder, DecisionReverse, "wrong product", now)
+	//org3 refunds 20.50 for the fuel and org4 3.00 for the freight.
+	checkBalances(t, stub, map[string]Amount{"org1": 10005000, "org2": 10001000, "org3": 9994000})
+	dispute := getTestDispute(t, stub, ids.FuelOrder)
+	if adj := dispute.Resolution.Adjustments; len(adj) != 2 || adj[0] != (Adjustment{"org3", -2050}) || adj[1] != (Adjustment{"org4", -300}) {
+		t.Fatalf("Wrong adjustments: %+v", adj)
+	}
+	fuelOrder := FuelOrder{}
+	getTestState(t, stub, ids.FuelOrder, &fuelOrder)
+	if fuelOrder.AD.State != StateDelivered || fuelOrder.AD.Owner != "org5" {
+		t.Fatalf("Order should be DELIVERED to org5: %+v", fuelOrder.AD)
+	}
+}
+
+//the dispute opened for a shortfall is settled with adjustments given as a JSON document.
+func TestAdjustDispute(t *testing.T) {
+	stub, ids := newTestPlan(t)
+	now := testNow()
+	setTestArbiter(t, stub, "org6")
+	mustInvoke(t, stub, "Org4MSP", "arrive", ids.FuelOrder, "30", now, ids.Plan)
+	mustInvoke(t, stub, "Org5MSP", "transfer", ids.FuelOrder, "org5", now, ids.Plan, "24")
+	runErrorCases(t, stub, []errorCase{
+		{"refund more than paid", "Org6MSP", []string{"resolveDispute", ids.FuelOrder, DecisionAdjust, "lost", now, "org4=-2.41"}, "org4 can refund at most the 2.40"},
+		{"refund twice", "Org6MSP", []string{"resolveDispute", ids.FuelOrder, DecisionAdjust, "lost", now, "org4=-2", "org4=-2"}, "org4 is adjusted more than once"},
+		{"buyer in the adjustments", "Org6MSP", []string{"resolveDispute", ids.FuelOrder, DecisionAdjust, "lost", now, "org5=1"}, "org5 is not the carrier or the supplier"},
+		{"outsider in the adjustments", "Org6MSP", []string{"resolveDispute", ids.FuelOrder, DecisionAdjust, "lost", now, "org1=1"}, "org1 is not the carrier or the supplier"},
+		{"bad adjustment", "Org6MSP", []string{"resolveDispute", ids.FuelOrder, DecisionAdjust, "lost", now, "org4"}, "not of the form org=amount"},
+		{"bad JSON adjustments", "Org6MSP", []string{"resolveDispute", `{"Version":1,"AssetID":"` + ids.FuelOrder +
+			`","Decision":"ADJUST","Reasoning":"lost","Timestamp":"` + now + `","Adjustments":{"org4":"x"}}`}, "Adjustments.org4"},
+	})
+	//the carrier gives back the freight of the lost fuel and the buyer pays 1.00 more to the refiner.
+	mustInvoke(t, stub, "Org6MSP", "resolveDispute", `{"Version":1,"AssetID":"`+ids.FuelOrder+
+		`","Decision":"ADJUST","Reasoning":"lost in transit","Timestamp":"`+now+`","Adjustments":{"org4":"-2.40","org3":1}}`)
+	checkBalances(t, stub, map[string]Amount{
+		"org1": 10005000, "org2": 10001000, "org3": 9995740, "org4": 10000000, "org5": 9998260,
+	})
+	fuelOrder := FuelOrder{}
+	getTestState(t, stub, ids.FuelOrder, &fuelOrder)
+	if fuelOrder.AD.State != StateDelivered {
+		t.Fatalf("Order should be DELIVERED again and not %s", fuelOrder.AD.State)
+	}
+}
+
+//a reversal after an adjustment gives back only what is left of the payments.
+func TestReverseAfterAdjust(t *testing.T) {
+	stub, ids := newTestPlan(t)
+	now := testNow()
+	setTestArbiter(t, stub, "org6")
+	mustInvoke(t, stub, "Org4MSP", "arrive", ids.FuelOrder, "30", now, ids.Plan)
+	mustInvoke(t, stub, "Org5MSP", "transfer", ids.FuelOrder, "org5", now, ids.Plan, "24")
+	//org4 gives back 1.00 of the freight and org5 pays 0.50 more for the fuel.
+	mustInvoke(t, stub, "Org6MSP", "resolveDispute", ids.FuelOrder, DecisionAdjust, "lost in transit", now, "org4=-1", "org3=0.50")
+	checkBalances(t, stub, map[string]Amount{"org1": 10005000, "org2": 10001000, "org3": 9995690, "org4": 10000140, "org5": 9998170})
+	mustInvoke(t, stub, "Org5MSP", "openDispute", ids.FuelOrder, "wrong product", now)
+	mustInvoke(t, stub, "Org6MSP", "resolveDispute", ids.FuelOrder, DecisionReverse, "wrong product", now)
+	//org3 refunds the 16.90 it kept for the fuel and org4 the 1.40 it kept for the freight.
+	checkBalances(t, stub, map[string]Amount{"org1": 10005000, "org2": 10001000, "org3": 9994000, "org4": 10000000, "org5": 10000000})
+	dispute := getTestDispute(t, stub, ids.FuelOrder)
+	if adj := dispute.Resolution.Adjustments; len(adj) != 2 || adj[0] != (Adjustment{"org3", -1690}) || adj[1] != (Adjustment{"org4", -140}) {
+		t.Fatalf("Wrong adjustments: %+v", adj)
+	}
+}
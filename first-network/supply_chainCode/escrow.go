@@ -0,0 +1,346 @@
+/*
+Escrow of FuelOrders.
+
+When the buyer (the destination of the order) accepts a FuelOrder that the refiner offered, the value of the order
+plus the most its freight can cost (see policy.go) is moved from the Balance of the buyer to its Locked funds
+and an Escrow is put in db with key Escrow~FuelOrderID. The refiner can't lock the funds of the buyer.
+On transfer the escrow pays the carrier and the refiner and the rest goes back to the buyer.
+If the order is cancelled or its delivery fails, the whole escrow is refunded.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const EscrowIndex = "Escrow"
+
+const (
+	EscrowLocked   = "LOCKED"
+	EscrowReleased = "RELEASED"
+	EscrowRefunded = "REFUNDED"
+)
+
+type Escrow struct {
+	OrderID string
+	Buyer   string
+	Value   Amount //paid to the supplier
+	Fee     Amount //most the freight of the carrier can cost
+	State   string
+}
+
+//balance of an org as shown to clients.
+type Balance struct {
+	Org         string
+	Available   Amount
+	Locked      Amount
+	CreditLimit Amount
+	Currency    string
+}
+
+func (e Escrow) Total() Amount {
+	return e.Value + e.Fee
+}
+
+func escrowKey(stub shim.ChaincodeStubInterface, orderID string) (string, error) {
+	key, err := stub.CreateCompositeKey(EscrowIndex, []string{orderID})
+	if err != nil {
+		return "", fmt.Errorf("Failed to create escrow key of %s: %s", orderID, err.Error())
+	}
+	return key, nil
+}
+
+//returns the escrow of the order or nil if the order was added without one.
+func GetEscrow(stub shim.ChaincodeStubInterface, orderID string) (*Escrow, error) {
+	key, err := escrowKey(stub, orderID)
+	if err != nil {
+		return nil, err
+	}
+	escrowAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get escrow of %s: %s", orderID, err.Error())
+	}
+	if escrowAsBytes == nil {
+		return nil, nil
+	}
+	escrow := Escrow{}
+	if err = json.Unmarshal(escrowAsBytes, &escrow); err != nil {
+		return nil, fmt.Errorf("Failed to decode escrow of %s", orderID)
+	}
+	return &escrow, nil
+}
+
+func putEscrow(stub shim.ChaincodeStubInterface, escrow Escrow) error {
+	key, err := escrowKey(stub, escrow.OrderID)
+	if err != nil {
+		return err
+	}
+	escrowAsBytes, _ := json.Marshal(escrow)
+	if err = stub.PutState(key, escrowAsBytes); err != nil {
+		return fmt.Errorf("Failed to put escrow of %s in db", escrow.OrderID)
+	}
+	return nil
+}
+
+//lock the value and the estimated freight of an order from the account of the buyer.
+func LockEscrow(stub shim.ChaincodeStubInterface, orderID, buyer string, value, fee Amount) error {
+	escrow := Escrow{orderID, buyer, value, fee, EscrowLocked}
+	acc, err := GetAccount(stub, buyer)
+	if err != nil {
+		return err
+	}
+	if acc.Balance-escrow.Total() < -acc.CreditLimit {
+		return fmt.Errorf("%s doesn't have the funds for order %s. Available %s, needed %s",
+			buyer, orderID, acc.Balance, escrow.Total())
+	}
+	acc.Balance -= escrow.Total()
+	acc.Locked += escrow.Total()
+	if err = PutAccount(stub, buyer, acc); err != nil {
+		return err
+	}
+	return putEscrow(stub, escrow)
+}
+
+/*
+Pay the orgs of oa from the escrow of the order and refund the rest to the buyer.
+Payments that exceed the locked amount are paid from the balance of the buyer,
+which can't go below -CreditLimit.
+*/
+func ReleaseEscrow(stub shim.ChaincodeStubInterface, escrow Escrow, oa []OrgAmount) error {
+	if escrow.State != EscrowLocked {
+		return fmt.Errorf("Escrow of %s is %s", escrow.OrderID, escrow.State)
+	}
+	orgs := []string{escrow.Buyer}
+	var total Amount
+	for _, p := range oa {
+		if p.amount < 0 {
+			return fmt.Errorf("Amounts to be paid should be positive")
+		}
+		total += p.amount
+		orgs = append(orgs, p.org)
+	}
+	accounts, orgs, err := GetAccounts(stub, orgs)
+	if err != nil {
+		return err
+	}
+	buyer := accounts[escrow.Buyer]
+	buyer.Locked -= escrow.Total()
+	buyer.Balance += escrow.Total() - total
+	if buyer.Balance < -buyer.CreditLimit {
+		return fmt.Errorf("%s can't pay %s beyond the escrow of %s. Balance would be %s and the credit limit is %s",
+			escrow.Buyer, total-escrow.Total(), escrow.OrderID, buyer.Balance, buyer.CreditLimit)
+	}
+	for _, p := range oa {
+		accounts[p.org].Balance += p.amount
+	}
+	if err = PutAccounts(stub, accounts, orgs); err != nil {
+		return err
+	}
+	escrow.State = EscrowReleased
+	if err = putEscrow(stub, escrow); err != nil {
+		return err
+	}
+	return WriteJournal(stub, escrow.OrderID, escrow.Buyer, oa)
+}
+
+//give back the whole escrow to the buyer.
+func RefundEscrow(stub shim.ChaincodeStubInterface, escrow Escrow) error {
+	if escrow.State != EscrowLocked {
+		return fmt.Errorf("Escrow of %s is %s", escrow.OrderID, escrow.State)
+	}
+	acc, err := GetAccount(stub, escrow.Buyer)
+	if err != nil {
+		return err
+	}
+	acc.Locked -= escrow.Total()
+	acc.Balance += escrow.Total()
+	if err = PutAccount(stub, escrow.Buyer, acc); err != nil {
+		return err
+	}
+	escrow.State = EscrowRefunded
+	return putEscrow(stub, escrow)
+}
+
+/*
+The buyer accepts an order that the refiner offered and its value plus the estimated freight is locked.
+args[0] = FuelOrderID
+*/
+func (s *SmartContract) acceptFuelOrder(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	caller, err := GetCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	id := args[0]
+	fuelOrder, err := getFuelOrder(stub, id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	t, err := CheckTransition(caller, "FuelOrder", "acceptFuelOrder", fuelOrder.AD.State, fuelOrder.AD.Owner, fuelOrder.Dest)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	policy, err := GetPolicy(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = LockEscrow(stub, id, fuelOrder.Dest, fuelOrder.AD.Value, policy.MaxFreight(fuelOrder.AD.Owner, fuelOrder.Dest, fuelOrder.AD.Quantity))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ev := NewEvent(stub, EventFuelOrderAccepted)
+	ev.AddChange(id, fuelOrder.AD.State, t.To, fuelOrder.AD.Owner)
+	fuelOrder.AD.State = t.To
+	fuelOrderAsBytes, _ := json.Marshal(fuelOrder)
+	if err = PutAsset(stub, id, fuelOrderAsBytes); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to put %s in db", id))
+	}
+	if err = ev.Emit(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+/*
+The refiner or the buyer can cancel an order that is not on its way yet.
+The escrow of an accepted order is refunded and the quantity goes back to the fuel.
+args[0] = FuelOrderID
+*/
+func (s *SmartContract) cancelFuelOrder(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	caller, err := GetCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	id := args[0]
+	fuelOrder, err := getFuelOrder(stub, id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	t, err := CheckTransition(caller, "FuelOrder", "cancelFuelOrder", fuelOrder.AD.State, fuelOrder.AD.Owner, fuelOrder.Dest)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fuelbytes, _ := stub.GetState(fuelOrder.FuelID)
+	if fuelbytes == nil {
+		return shim.Error(fmt.Sprintf("Fuel %s of the order doesn't exist", fuelOrder.FuelID))
+	}
+	fuel := Fuel{}
+	if err = json.Unmarshal(fuelbytes, &fuel); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to decode %s", fuelOrder.FuelID))
+	}
+	fuel.Remaining += fuelOrder.AD.Quantity
+	fuelbytes, _ = json.Marshal(fuel)
+	if err = PutAsset(stub, fuelOrder.FuelID, fuelbytes); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to update fuel: %s", fuelOrder.FuelID))
+	}
+	return closeFuelOrder(stub, id, fuelOrder, t.To, EventFuelOrderCancelled)
+}
+
+/*
+The carrier or the buyer reports that an order on its way will not be delivered.
+The carrier is the distributor that made the plan of the order (see plans.go).
+The escrow is refunded to the buyer.
+args[0] = FuelOrderID
+*/
+func (s *SmartContract) reportFailedDelivery(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	caller, err := GetCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	id := args[0]
+	fuelOrder, err := getFuelOrder(stub, id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	t, err := CheckTransition(caller, "FuelOrder", "reportFailedDelivery", fuelOrder.AD.State, fuelOrder.AD.Owner, fuelOrder.Dest)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if caller.Org != fuelOrder.Dest {
+		planID, err := PlanOfOrder(stub, id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if planID == "" {
+			return shim.Error(fmt.Sprintf("%s is not in a plan", id))
+		}
+		dplan, _, err := GetPlanDelivery(stub, planID, id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if dplan.Carrier != caller.Org {
+			return shim.Error(fmt.Sprintf("Only the carrier %s of %s or the destination %s can report that %s failed",
+				dplan.Carrier, planID, fuelOrder.Dest, id))
+		}
+	}
+	return closeFuelOrder(stub, id, fuelOrder, t.To, EventFuelOrderFailed)
+}
+
+//refund the escrow and set the final state of an order that won't be delivered.
+func closeFuelOrder(stub shim.ChaincodeStubInterface, id string, fuelOrder FuelOrder, state, eventName string) sc.Response {
+	escrow, err := GetEscrow(stub, id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if escrow != nil {
+		if err = RefundEscrow(stub, *escrow); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	ev := NewEvent(stub, eventName)
+	ev.AddChange(id, fuelOrder.AD.State, state, fuelOrder.AD.Owner)
+	fuelOrder.AD.State = state
+	fuelOrderAsBytes, _ := json.Marshal(fuelOrder)
+	if err = PutAsset(stub, id, fuelOrderAsBytes); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to put %s in db", id))
+	}
+	if err = ev.Emit(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+/*
+args[0] = org (e.g. 'org5')
+*/
+func (s *SmartContract) queryBalance(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	acc, err := GetAccount(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	balanceAsBytes, _ := json.Marshal(Balance{args[0], acc.Balance, acc.Locked, acc.CreditLimit, acc.Currency})
+	return shim.Success(balanceAsBytes)
+}
+
+func getFuelOrder(stub shim.ChaincodeStubInterface, id string) (FuelOrder, error) {
+	if AssetType(id) != "FuelOrder" {
+		return FuelOrder{}, fmt.Errorf("%s is not a FuelOrder", id)
+	}
+	fuelOrderAsBytes, err := stub.GetState(id)
+	if err != nil {
+		return FuelOrder{}, fmt.Errorf("Failed to get %s: %s", id, err.Error())
+	}
+	if fuelOrderAsBytes == nil {
+		return FuelOrder{}, fmt.Errorf("FuelOrder %s does not exist", id)
+	}
+	fuelOrder := FuelOrder{}
+	if err = json.Unmarshal(fuelOrderAsBytes, &fuelOrder); err != nil {
+		return FuelOrder{}, fmt.Errorf("Failed to decode %s", id)
+	}
+	return fuelOrder, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+)
+
+//a cancelled order gives back the funds of the buyer and the quantity of the fuel.
+func TestCancelFuelOrder(t *testing.T) {
+	stub, fuelID := newTestFuel(t)
+	now := testNow()
+	orderID := mustOrder(t, stub, "20.50", "30", "org3", "org5", fuelID, now)
+	runErrorCases(t, stub, []errorCase{
+		{"wrong number of args", "Org5MSP", []string{"cancelFuelOrder"}, "Expecting 1"},
+		{"not an order", "Org5MSP", []string{"cancelFuelOrder", fuelID}, "is not a FuelOrder"},
+		{"order doesn't exist", "Org5MSP", []string{"cancelFuelOrder", "FuelOrder99999999"}, "does not exist"},
+		{"another retailer", "Org6MSP", []string{"cancelFuelOrder", orderID}, "Allowed: the owner (org3), the destination (org5)"},
+	})
+	mustInvoke(t, stub, "Org5MSP", "cancelFuelOrder", orderID)
+	if balance := getTestBalance(t, stub, "org5"); balance.Available != 100000*MinorUnits || balance.Locked != 0 {
+		t.Fatalf("Escrow of org5 should be refunded: %+v", balance)
+	}
+	fuel := Fuel{}
+	getTestState(t, stub, fuelID, &fuel)
+	if fuel.Remaining != 80 {
+		t.Fatalf("Remaining of the fuel should be 80 and not %d", fuel.Remaining)
+	}
+	runErrorCases(t, stub, []errorCase{
+		{"cancelled already", "Org3MSP", []string{"cancelFuelOrder", orderID}, "Cannot cancelFuelOrder a FuelOrder that is CANCELLED"},
+	})
+}
+
+//an order that can't be delivered is refunded and can't be delivered later.
+func TestReportFailedDelivery(t *testing.T) {
+	stub, ids := newTestPlan(t)
+	now := testNow()
+	setTestRegistrar(t, stub, "org1")
+	mustInvoke(t, stub, "Org1MSP", "onboardParticipant", "Org7MSP", "org7", "Trucks", RoleDistributor, "0")
+	runErrorCases(t, stub, []errorCase{
+		{"order on its way can't be cancelled", "Org5MSP", []string{"cancelFuelOrder", ids.FuelOrder}, "Cannot cancelFuelOrder a FuelOrder that is ON_WAY"},
+		{"not the carrier or the buyer", "Org3MSP", []string{"reportFailedDelivery", ids.FuelOrder}, "Allowed: distributor, the destination (org5)"},
+		{"another distributor", "Org7MSP", []string{"reportFailedDelivery", ids.FuelOrder}, "Only the carrier org4 of " + ids.Plan + " or the destination org5"},
+	})
+	mustInvoke(t, stub, "Org4MSP", "reportFailedDelivery", ids.FuelOrder)
+	checkBalances(t, stub, map[string]Amount{"org1": 10005000, "org2": 10001000, "org3": 9994000})
+	if balance := getTestBalance(t, stub, "org5"); balance.Locked != 0 {
+		t.Fatalf("Escrow of org5 should be refunded: %+v", balance)
+	}
+	runErrorCases(t, stub, []errorCase{
+		{"failed already", "Org5MSP", []string{"reportFailedDelivery", ids.FuelOrder}, "Cannot reportFailedDelivery a FuelOrder that is FAILED"},
+		{"transfer a failed order", "Org5MSP", []string{"transfer", ids.FuelOrder, "org5", now, ids.Plan}, "Cannot transfer a FuelOrder that is FAILED"},
+	})
+}
+
+//the destination of an order can report that it failed without being the carrier.
+func TestReportFailedDeliveryByBuyer(t *testing.T) {
+	stub, ids := newTestPlan(t)
+	mustInvoke(t, stub, "Org5MSP", "reportFailedDelivery", ids.FuelOrder)
+	fuelOrder := FuelOrder{}
+	getTestState(t, stub, ids.FuelOrder, &fuelOrder)
+	if fuelOrder.AD.State != StateFailed {
+		t.Fatalf("Order should be FAILED and not %s", fuelOrder.AD.State)
+	}
+}
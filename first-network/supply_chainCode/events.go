@@ -0,0 +1,97 @@
+/*
+Chaincode events.
+
+Fabric keeps only one event per transaction (the last SetEvent wins), so every
+transaction that changes assets emits exactly one Event that contains all the
+state changes and payments that it made. Clients can listen for the event names
+below instead of polling queryAssetByRange.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	EventCrudeDispatched    = "CrudeDispatched"
+	EventCrudeArrived       = "CrudeArrived"
+	EventCrudeDelivered     = "CrudeDelivered"
+	EventCrudeRejected      = "CrudeRejected"
+	EventFuelRefined        = "FuelRefined"
+	EventFuelOrderAdded     = "FuelOrderAdded"
+	EventFuelOrderAccepted  = "FuelOrderAccepted"
+	EventFuelDispatched     = "FuelDispatched"
+	EventFuelOrderArrived   = "FuelOrderArrived"
+	EventFuelOrderDelivered = "FuelOrderDelivered"
+	EventFuelOrderRejected  = "FuelOrderRejected"
+	EventFuelOrderCancelled = "FuelOrderCancelled"
+	EventFuelOrderFailed    = "FuelOrderFailed"
+	EventDisputeOpened      = "DisputeOpened"
+	EventDisputeResolved    = "DisputeResolved"
+	EventPlanAmended        = "PlanAmended"
+	EventPlanClosed         = "PlanClosed"
+)
+
+//a state transition of a single asset.
+type AssetChange struct {
+	AssetID  string
+	OldState string
+	NewState string
+	Owner    string
+}
+
+//money moved from an org account to another one.
+type Payment struct {
+	From   string
+	To     string
+	Amount Amount
+}
+
+type Event struct {
+	Name     string
+	TxID     string
+	Changes  []AssetChange
+	Payments []Payment
+	Disputes []string `json:",omitempty"` //assets with a dispute opened by the transaction
+	PlanID   string   `json:",omitempty"` //plan made or amended by the transaction
+	Version  int      `json:",omitempty"` //version of the plan after the transaction
+}
+
+func NewEvent(stub shim.ChaincodeStubInterface, name string) *Event {
+	return &Event{Name: name, TxID: stub.GetTxID()}
+}
+
+func (ev *Event) AddChange(id, oldState, newState, owner string) {
+	ev.Changes = append(ev.Changes, AssetChange{id, oldState, newState, owner})
+}
+
+//record the payments that the buyer made with Pay.
+func (ev *Event) AddPayments(buyer string, oa []OrgAmount) {
+	for _, p := range oa {
+		ev.Payments = append(ev.Payments, Payment{buyer, p.org, p.amount})
+	}
+}
+
+func (ev *Event) AddDispute(assetID string) {
+	ev.Disputes = append(ev.Disputes, assetID)
+}
+
+func (ev *Event) SetPlan(planID string, version int) {
+	ev.PlanID = planID
+	ev.Version = version
+}
+
+//set the event in the transaction. Should be called once, after all changes are added.
+func (ev *Event) Emit(stub shim.ChaincodeStubInterface) error {
+	evAsBytes, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal event %s", ev.Name)
+	}
+	if err = stub.SetEvent(ev.Name, evAsBytes); err != nil {
+		return fmt.Errorf("Failed to set event %s", ev.Name)
+	}
+	return nil
+}
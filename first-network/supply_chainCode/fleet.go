@@ -0,0 +1,267 @@
+/*
+Registry of the vehicles.
+
+A shipper registers its vessels and a distributor its trucks with registerVehicle. A vehicle is put
+in db with the composite key Vehicle~Type~ID and is operated by the org that registered it.
+deliverCrude accepts only a vessel and deliverFuel (and the amendments of a plan, see plans.go)
+only a truck of the caller that
+	is registered and ACTIVE,
+	has a certification that hasn't expired,
+	can carry the quantity of the delivery (and a truck has a compartment for every order) and
+	isn't assigned to another delivery.
+A vessel is assigned to a Crude until the Crude arrives and a truck to a Plan until the plan is closed.
+The operator updates the status and the certification of a vehicle with updateVehicle.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const VehicleObjectType = "Vehicle"
+
+const (
+	VehicleActive      = "ACTIVE"
+	VehicleMaintenance = "MAINTENANCE"
+	VehicleRetired     = "RETIRED"
+)
+
+//the role that operates each type of vehicle.
+var vehicleRoles = map[string]string{
+	"Vessel": RoleShipper,
+	"Truck":  RoleDistributor,
+}
+
+type FleetVehicle struct {
+	Type         string
+	ID           string
+	Owner        string //org that operates the vehicle
+	Capacity     int
+	Compartments int //a truck carries every order in its own compartment. 0 for a vessel
+	CertExpiry   time.Time
+	Status       string
+	Assignment   string `json:",omitempty"` //Crude or Plan that the vehicle is delivering
+}
+
+//the quantity and the number of orders that a vehicle should carry.
+type load struct {
+	Quantity int
+	Orders   int
+}
+
+func vehicleKey(stub shim.ChaincodeStubInterface, typ, id string) (string, error) {
+	key, err := stub.CreateCompositeKey(VehicleObjectType, []string{typ, id})
+	if err != nil {
+		return "", fmt.Errorf("Failed to create key of %s %s: %s", typ, id, err.Error())
+	}
+	return key, nil
+}
+
+//returns the vehicle or nil if it isn't registered.
+func GetVehicle(stub shim.ChaincodeStubInterface, typ, id string) (*FleetVehicle, error) {
+	key, err := vehicleKey(stub, typ, id)
+	if err != nil {
+		return nil, err
+	}
+	vehicleAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get %s %s: %s", typ, id, err.Error())
+	}
+	if vehicleAsBytes == nil {
+		return nil, nil
+	}
+	v := FleetVehicle{}
+	if err = json.Unmarshal(vehicleAsBytes, &v); err != nil {
+		return nil, fmt.Errorf("Failed to decode %s %s", typ, id)
+	}
+	return &v, nil
+}
+
+func PutVehicle(stub shim.ChaincodeStubInterface, v FleetVehicle) error {
+	key, err := vehicleKey(stub, v.Type, v.ID)
+	if err != nil {
+		return err
+	}
+	vehicleAsBytes, _ := json.Marshal(v)
+	if err = stub.PutState(key, vehicleAsBytes); err != nil {
+		return fmt.Errorf("Failed to put %s %s in db", v.Type, v.ID)
+	}
+	return nil
+}
+
+/*
+The problems that keep a vehicle from carrying l for operator (empty for any operator) as
+assignment. Returns nil if the vehicle can carry it.
+*/
+func CheckVehicle(stub shim.ChaincodeStubInterface, v *FleetVehicle, typ, id, operator string, l load, assignment string) ([]string, error) {
+	if v == nil {
+		return []string{fmt.Sprintf("%s %s is not registered", typ, id)}, nil
+	}
+	txTime, err := TxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	problems := []string{}
+	if operator != "" && v.Owner != operator {
+		problems = append(problems, fmt.Sprintf("%s %s is operated by %s", typ, id, v.Owner))
+	}
+	if v.Status != VehicleActive {
+		problems = append(problems, fmt.Sprintf("%s %s is %s", typ, id, v.Status))
+	}
+	if v.CertExpiry.After(txTime) == false {
+		problems = append(problems, fmt.Sprintf("Certification of %s %s expired at %s", typ, id, v.CertExpiry.Format(time.RFC3339)))
+	}
+	if l.Quantity > v.Capacity {
+		problems = append(problems, fmt.Sprintf("Total quantity %d exceeds the capacity %d of %s %s", l.Quantity, v.Capacity, typ, id))
+	}
+	if v.Compartments > 0 && l.Orders > v.Compartments {
+		problems = append(problems, fmt.Sprintf("%d orders exceed the %d compartments of %s %s", l.Orders, v.Compartments, typ, id))
+	}
+	if v.Assignment != "" && v.Assignment != assignment {
+		problems = append(problems, fmt.Sprintf("%s %s is already assigned to %s", typ, id, v.Assignment))
+	}
+	if len(problems) == 0 {
+		return nil, nil
+	}
+	return problems, nil
+}
+
+//assign a vehicle that was checked with CheckVehicle to a delivery.
+func AssignVehicle(stub shim.ChaincodeStubInterface, v *FleetVehicle, assignment string) error {
+	v.Assignment = assignment
+	return PutVehicle(stub, *v)
+}
+
+//release a vehicle from a delivery that is over. It's kept if it's assigned to another delivery.
+func ReleaseVehicle(stub shim.ChaincodeStubInterface, typ, id, assignment string) error {
+	v, err := GetVehicle(stub, typ, id)
+	if err != nil {
+		return err
+	}
+	//vehicles of the deliveries made before the registry aren't registered.
+	if v == nil || v.Assignment != assignment {
+		return nil
+	}
+	v.Assignment = ""
+	return PutVehicle(stub, *v)
+}
+
+/*
+The caller registers a vehicle that it operates.
+args[0] = type, one of {Vessel,Truck}
+args[1] = ID
+args[2] = capacity
+args[3] = compartments (0 for a vessel)
+args[4] = certification expiry
+*/
+func (s *SmartContract) registerVehicle(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 5")
+	}
+	role, ok := vehicleRoles[args[0]]
+	if ok == false {
+		return shim.Error("Type of the vehicle should be one of {Vessel,Truck}")
+	}
+	caller, err := RequireRole(stub, role)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if args[1] == "" {
+		return shim.Error("ID of the vehicle is missing")
+	}
+	capacity, err := strconv.Atoi(args[2])
+	if err != nil || capacity <= 0 {
+		return shim.Error("Capacity is not a positive int number")
+	}
+	compartments, err := strconv.Atoi(args[3])
+	if err != nil || compartments < 0 || (args[0] == "Truck" && compartments == 0) {
+		return shim.Error("Compartments is not a non negative int number. A truck has at least one")
+	}
+	certExpiry, err := RFCtoTime(args[4])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	existing, err := GetVehicle(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if existing != nil {
+		return shim.Error(fmt.Sprintf("%s %s is registered by %s already", args[0], args[1], existing.Owner))
+	}
+	v := FleetVehicle{args[0], args[1], caller.Org, capacity, compartments, certExpiry, VehicleActive, ""}
+	if err = PutVehicle(stub, v); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+/*
+The operator of a vehicle changes its status or renews its certification.
+args[0] = type, one of {Vessel,Truck}
+args[1] = ID
+args[2] = status, one of {ACTIVE,MAINTENANCE,RETIRED}
+args[3] = certification expiry
+*/
+func (s *SmartContract) updateVehicle(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+	caller, err := GetCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if args[2] != VehicleActive && args[2] != VehicleMaintenance && args[2] != VehicleRetired {
+		return shim.Error(fmt.Sprintf("Status should be one of {%s,%s,%s}", VehicleActive, VehicleMaintenance, VehicleRetired))
+	}
+	certExpiry, err := RFCtoTime(args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	v, err := GetVehicle(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if v == nil {
+		return shim.Error(fmt.Sprintf("%s %s is not registered", args[0], args[1]))
+	}
+	if err = caller.IsOrg(v.Owner); err != nil {
+		return shim.Error(err.Error())
+	}
+	if v.Status == VehicleRetired {
+		return shim.Error(fmt.Sprintf("%s %s is retired", args[0], args[1]))
+	}
+	if args[2] == VehicleRetired && v.Assignment != "" {
+		return shim.Error(fmt.Sprintf("%s %s can't be retired while it's assigned to %s", args[0], args[1], v.Assignment))
+	}
+	v.Status = args[2]
+	v.CertExpiry = certExpiry
+	if err = PutVehicle(stub, *v); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+/*
+args[0] = type, one of {Vessel,Truck}
+args[1] = ID
+*/
+func (s *SmartContract) queryVehicle(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	v, err := GetVehicle(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if v == nil {
+		return shim.Error(fmt.Sprintf("%s %s is not registered", args[0], args[1]))
+	}
+	vehicleAsBytes, _ := json.Marshal(v)
+	return shim.Success(vehicleAsBytes)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegisterVehicle(t *testing.T) {
+	stub := newTestStub(t)
+	expiry := testLater()
+	runErrorCases(t, stub, []errorCase{
+		{"wrong number of args", "Org4MSP", []string{"registerVehicle", "Truck", "T7", "100", "2"}, "Expecting 5"},
+		{"unknown type", "Org4MSP", []string{"registerVehicle", "Plane", "P1", "100", "0", expiry}, "should be one of {Vessel,Truck}"},
+		{"retailer's truck", "Org5MSP", []string{"registerVehicle", "Truck", "T7", "100", "2", expiry}, "is not allowed"},
+		{"distributor's vessel", "Org4MSP", []string{"registerVehicle", "Vessel", "V7", "100", "0", expiry}, "is not allowed"},
+		{"no capacity", "Org4MSP", []string{"registerVehicle", "Truck", "T7", "0", "2", expiry}, "Capacity is not a positive int"},
+		{"truck without compartments", "Org4MSP", []string{"registerVehicle", "Truck", "T7", "100", "0", expiry}, "A truck has at least one"},
+		{"bad expiry", "Org4MSP", []string{"registerVehicle", "Truck", "T7", "100", "2", "next year"}, "RFC3339"},
+		{"registered twice", "Org4MSP", []string{"registerVehicle", "Truck", "T1", "100", "2", expiry}, "Truck T1 is registered by org4 already"},
+		{"not registered", "Org4MSP", []string{"queryVehicle", "Truck", "T7"}, "Truck T7 is not registered"},
+	})
+	v := FleetVehicle{}
+	if err := json.Unmarshal([]byte(mustInvoke(t, stub, "Org1MSP", "queryVehicle", "Vessel", "V1")), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Owner != "org2" || v.Capacity != 1000 || v.Status != VehicleActive || v.Assignment != "" {
+		t.Fatalf("Wrong vessel: %+v", v)
+	}
+}
+
+//a vessel carries one crude at a time and only if it's active, certified and big enough.
+func TestDeliverCrudeVessel(t *testing.T) {
+	stub := newTestStub(t)
+	now := testNow()
+	est := testLater()
+	past := time.Now().UTC().Add(-time.Hour).Format(time.RFC3339)
+	mustInvoke(t, stub, "Org2MSP", "registerVehicle", "Vessel", "V8", "1000", "0", past)
+	mustInvoke(t, stub, "Org2MSP", "updateVehicle", "Vessel", "V3", VehicleMaintenance, est)
+	deliver := func(quantity, vessel string) []string {
+		return []string{"deliverCrude", "50", quantity, "org1", est, "org1", "org3", vessel, now}
+	}
+	crudeID := mustInvoke(t, stub, "Org1MSP", deliver("100", "V1")...)
+	runErrorCases(t, stub, []errorCase{
+		{"unknown vessel", "Org1MSP", deliver("100", "V7"), "Vessel V7 is not registered"},
+		{"expired certification", "Org1MSP", deliver("100", "V8"), "Certification of Vessel V8 expired"},
+		{"vessel in maintenance", "Org1MSP", deliver("100", "V3"), "Vessel V3 is MAINTENANCE"},
+		{"over capacity", "Org1MSP", deliver("1001", "V2"), "Total quantity 1001 exceeds the capacity 1000 of Vessel V2"},
+		{"vessel on its way", "Org1MSP", deliver("100", "V1"), "Vessel V1 is already assigned to " + crudeID},
+		{"retire a vessel on its way", "Org2MSP", []string{"updateVehicle", "Vessel", "V1", VehicleRetired, est}, "can't be retired while it's assigned"},
+		{"not the operator", "Org4MSP", []string{"updateVehicle", "Vessel", "V2", VehicleRetired, est}, "doesn't match the caller"},
+		{"unknown status", "Org2MSP", []string{"updateVehicle", "Vessel", "V2", "SUNK", est}, "Status should be one of"},
+	})
+	mustInvoke(t, stub, "Org2MSP", "arrive", crudeID, "100", now)
+	mustInvoke(t, stub, "Org1MSP", deliver("100", "V1")...)
+}
+
+//a truck is assigned to a plan until the plan is closed.
+func TestDeliverFuelTruck(t *testing.T) {
+	stub, ids := newTestPlan(t)
+	now := testNow()
+	est := testLater()
+	order := mustOrder(t, stub, "5", "10", "org3", "org5", ids.Fuel, now)
+	mustInvoke(t, stub, "Org4MSP", "updateVehicle", "Truck", "T3", VehicleMaintenance, est)
+	runErrorCases(t, stub, []errorCase{
+		{"unknown truck", "Org4MSP", []string{"deliverFuel", "T7", order, est, "org3", "org5"}, "Truck T7 is not registered"},
+		{"truck of a plan", "Org4MSP", []string{"deliverFuel", "T1", order, est, "org3", "org5"}, "Truck T1 is already assigned to " + ids.Plan},
+		{"truck in maintenance", "Org4MSP", []string{"deliverFuel", "T3", order, est, "org3", "org5"}, "Truck T3 is MAINTENANCE"},
+		{"swap to a truck in maintenance", "Org4MSP", []string{"swapPlanVehicle", ids.Plan, "T3", "breakdown", now}, "Truck T3 is MAINTENANCE"},
+	})
+	mustInvoke(t, stub, "Org4MSP", "swapPlanVehicle", ids.Plan, "T2", "breakdown", now)
+	planID := mustInvoke(t, stub, "Org4MSP", "deliverFuel", "T1", order, est, "org3", "org5")
+	mustFail(t, stub, "Truck T2 is already assigned to "+ids.Plan, "Org4MSP", "swapPlanVehicle", planID, "T2", "breakdown", now)
+	mustInvoke(t, stub, "Org4MSP", "arrive", ids.FuelOrder, "30", now, ids.Plan)
+	mustInvoke(t, stub, "Org4MSP", "closePlan", ids.Plan, now)
+	mustInvoke(t, stub, "Org4MSP", "swapPlanVehicle", planID, "T2", "breakdown", now)
+}
+
+//every problem of a vehicle is reported.
+func TestCheckVehicle(t *testing.T) {
+	stub := newTestStub(t)
+	stub.MockTransactionStart("check")
+	defer stub.MockTransactionEnd("check")
+	v := &FleetVehicle{"Truck", "T1", "org4", 20, 1, time.Now().Add(-time.Hour), VehicleRetired, "Plan00000001"}
+	problems, err := CheckVehicle(stub, v, "Truck", "T1", "org5", load{30, 2}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"operated by org4", "is RETIRED", "Certification", "capacity 20", "compartments", "assigned to Plan00000001"} {
+		if strings.Contains(strings.Join(problems, ". "), want) == false {
+			t.Fatalf("Problems should contain '%s': %v", want, problems)
+		}
+	}
+	if problems, _ = CheckVehicle(stub, v, "Truck", "T1", "org4", load{30, 2}, "Plan00000001"); len(problems) != 4 {
+		t.Fatalf("The operator and the plan of the truck are not problems: %v", problems)
+	}
+}
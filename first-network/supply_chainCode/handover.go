@@ -0,0 +1,272 @@
+/*
+Two-phase handover of the deliveries.
+
+A Crude is dispatched by deliverCrude and a FuelOrder by deliverFuel. When a delivery
+reaches its destination, the carrier (the operator of the vessel of a Crude or the
+distributor that made the plan of a FuelOrder) declares its arrival with arrive and the
+quantity it delivered. The delay of the delivery is computed at this point.
+Then the destination, with its own identity, either accepts the delivery with transfer,
+which changes the owner and makes the payments, or rejects it with rejectDelivery and a reason.
+The destination reports the quantity it received when it accepts a delivery and the payments
+are pro-rated to it. A shortfall above the tolerance or a claim of a party of the delivery
+opens a dispute (see disputes.go).
+Nobody is paid for a rejected delivery and the escrow of a rejected FuelOrder is refunded.
+
+	ON_WAY -arrive-> ARRIVED -transfer-> DELIVERED
+	                 ARRIVED -rejectDelivery-> REJECTED
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+//put in the Crude or the FuelOrder when it arrives.
+type Handover struct {
+	Carrier    string //org that declared the arrival
+	Supplier   string //owner of the asset when it arrived
+	Quantity   int    //delivered quantity declared by the carrier
+	ArrivedAt  time.Time
+	AnsweredAt time.Time      //when the destination accepted or rejected the delivery
+	Reason     string         `json:",omitempty"` //why the delivery was rejected
+	Received   int            //quantity received by the destination
+	Shortfall  int            //quantity of the asset that wasn't received
+	Disputed   bool           `json:",omitempty"` //the shortfall exceeded the tolerance (see disputes.go)
+	Pricing    *AppliedPolicy `json:",omitempty"` //freight paid to the carrier on transfer (see policy.go)
+}
+
+/*
+The carrier declares that a delivery has arrived at its destination.
+args[0] = ID of a Crude or FuelOrder
+args[1] = delivered quantity
+args[2] = timestamp
+args[3] = PlanID (only for a FuelOrder)
+*/
+func (s *SmartContract) arrive(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 or 4")
+	}
+	caller, err := GetCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	quantity, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || quantity <= 0 {
+		return shim.Error("Delivered quantity is not a positive int number")
+	}
+	Timestamp, err := TrustedTime(stub, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	id := args[0]
+	assetAsBytes, err := stub.GetState(id)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to get %s: %s", id, err.Error()))
+	}
+	if assetAsBytes == nil {
+		return shim.Error(fmt.Sprintf("Could not locate asset %s", id))
+	}
+	handover := &Handover{Carrier: caller.Org, Quantity: int(quantity), ArrivedAt: Timestamp}
+	//the supplier is set below, since the owner changes when the delivery is accepted.
+	var ev *Event
+	switch AssetType(id) {
+	case "Crude":
+		crude := Crude{}
+		if err = json.Unmarshal(assetAsBytes, &crude); err != nil {
+			return shim.Error(fmt.Sprintf("Failed to decode %s", id))
+		}
+		t, err := CheckTransition(caller, "Crude", "arrive", crude.AD.State, crude.AD.Owner, crude.DD.Destination)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if handover.Quantity > crude.AD.Quantity {
+			return shim.Error(fmt.Sprintf("Delivered quantity %d exceeds the quantity %d of %s", quantity, crude.AD.Quantity, id))
+		}
+		//the carrier is paid on transfer, so only the operator of the vessel can declare the arrival.
+		vessel, err := GetVehicle(stub, "Vessel", crude.Veh.ID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if vessel == nil || vessel.Owner != caller.Org {
+			return shim.Error(fmt.Sprintf("Only the operator of Vessel %s can declare the arrival of %s", crude.Veh.ID, id))
+		}
+		crude.DD.arrive(Timestamp)
+		//the vessel is free for another delivery once the crude has arrived.
+		if err = ReleaseVehicle(stub, "Vessel", crude.Veh.ID, id); err != nil {
+			return shim.Error(err.Error())
+		}
+		ev = NewEvent(stub, EventCrudeArrived)
+		ev.AddChange(id, crude.AD.State, t.To, crude.AD.Owner)
+		crude.AD.State = t.To
+		handover.Supplier = crude.AD.Owner
+		crude.Handover = handover
+		assetAsBytes, _ = json.Marshal(crude)
+	case "FuelOrder":
+		if len(args) != 4 {
+			return shim.Error("PlanID of the FuelOrder is missing")
+		}
+		fuelOrder := FuelOrder{}
+		if err = json.Unmarshal(assetAsBytes, &fuelOrder); err != nil {
+			return shim.Error(fmt.Sprintf("Failed to decode %s", id))
+		}
+		t, err := CheckTransition(caller, "FuelOrder", "arrive", fuelOrder.AD.State, fuelOrder.AD.Owner, fuelOrder.Dest)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if handover.Quantity > fuelOrder.AD.Quantity {
+			return shim.Error(fmt.Sprintf("Delivered quantity %d exceeds the quantity %d of %s", quantity, fuelOrder.AD.Quantity, id))
+		}
+		dplan, dd, err := GetPlanDelivery(stub, args[3], id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		//the carrier is paid on transfer, so only the distributor that made the plan can declare the arrival.
+		if dplan.Carrier != caller.Org {
+			return shim.Error(fmt.Sprintf("Only the carrier %s of %s can declare the arrival of %s", dplan.Carrier, args[3], id))
+		}
+		dd.arrive(Timestamp)
+		dplan.Plan[id] = dd
+		dplanAsBytes, _ := json.Marshal(dplan)
+		if err = PutAsset(stub, args[3], dplanAsBytes); err != nil {
+			return shim.Error(fmt.Sprintf("Failed to put %s in db", args[3]))
+		}
+		ev = NewEvent(stub, EventFuelOrderArrived)
+		ev.AddChange(id, fuelOrder.AD.State, t.To, fuelOrder.AD.Owner)
+		fuelOrder.AD.State = t.To
+		handover.Supplier = fuelOrder.AD.Owner
+		fuelOrder.Handover = handover
+		assetAsBytes, _ = json.Marshal(fuelOrder)
+	default:
+		return shim.Error("Only a Crude or a FuelOrder can arrive")
+	}
+	if err = PutAsset(stub, id, assetAsBytes); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to put %s in db", id))
+	}
+	if err = ev.Emit(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+/*
+The destination rejects a delivery that has arrived. The owner doesn't change and nobody is paid.
+args[0] = ID of a Crude or FuelOrder
+args[1] = reason
+args[2] = timestamp
+*/
+func (s *SmartContract) rejectDelivery(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	caller, err := GetCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if strings.TrimSpace(args[1]) == "" {
+		return shim.Error("Reason of the rejection is missing")
+	}
+	Timestamp, err := TrustedTime(stub, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	id := args[0]
+	assetAsBytes, err := stub.GetState(id)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to get %s: %s", id, err.Error()))
+	}
+	if assetAsBytes == nil {
+		return shim.Error(fmt.Sprintf("Could not locate asset %s", id))
+	}
+	switch AssetType(id) {
+	case "Crude":
+		crude := Crude{}
+		if err = json.Unmarshal(assetAsBytes, &crude); err != nil {
+			return shim.Error(fmt.Sprintf("Failed to decode %s", id))
+		}
+		t, err := CheckTransition(caller, "Crude", "rejectDelivery", crude.AD.State, crude.AD.Owner, crude.DD.Destination)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		crude.Handover.answer(Timestamp, args[1])
+		ev := NewEvent(stub, EventCrudeRejected)
+		ev.AddChange(id, crude.AD.State, t.To, crude.AD.Owner)
+		crude.AD.State = t.To
+		assetAsBytes, _ = json.Marshal(crude)
+		if err = PutAsset(stub, id, assetAsBytes); err != nil {
+			return shim.Error(fmt.Sprintf("Failed to put %s in db", id))
+		}
+		if err = ev.Emit(stub); err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success(nil)
+	case "FuelOrder":
+		fuelOrder := FuelOrder{}
+		if err = json.Unmarshal(assetAsBytes, &fuelOrder); err != nil {
+			return shim.Error(fmt.Sprintf("Failed to decode %s", id))
+		}
+		t, err := CheckTransition(caller, "FuelOrder", "rejectDelivery", fuelOrder.AD.State, fuelOrder.AD.Owner, fuelOrder.Dest)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		fuelOrder.Handover.answer(Timestamp, args[1])
+		return closeFuelOrder(stub, id, fuelOrder, t.To, EventFuelOrderRejected)
+	}
+	return shim.Error("Only a Crude or a FuelOrder can be rejected")
+}
+
+//record the answer of the destination. Reason is empty if the delivery was accepted.
+func (h *Handover) answer(tstamp time.Time, reason string) {
+	h.AnsweredAt = tstamp
+	h.Reason = reason
+}
+
+/*
+Record that the destination accepted the delivery. Received is the quantity reported by the
+destination or, if it's empty, the quantity declared by the carrier.
+*/
+func (h *Handover) accept(tstamp time.Time, received string, ordered int) error {
+	h.answer(tstamp, "")
+	h.Received = h.Quantity
+	if received == "" {
+		return nil
+	}
+	quantity, err := strconv.ParseInt(received, 10, 64)
+	if err != nil || quantity <= 0 {
+		return fmt.Errorf("Received quantity is not a positive int number. Reject the delivery if nothing was received")
+	}
+	if int(quantity) > ordered {
+		return fmt.Errorf("Received quantity %d exceeds the quantity %d", quantity, ordered)
+	}
+	h.Received = int(quantity)
+	return nil
+}
+
+//the plan with planID and the delivery details of the order in it.
+func GetPlanDelivery(stub shim.ChaincodeStubInterface, planID, orderID string) (FuelDeliveryPlan, DeliveryDetails, error) {
+	if strings.HasPrefix(planID, "Plan") == false {
+		return FuelDeliveryPlan{}, DeliveryDetails{}, fmt.Errorf("PlanID is not of the form 'PlanXXX'")
+	}
+	dplanAsBytes, err := stub.GetState(planID)
+	if err != nil {
+		return FuelDeliveryPlan{}, DeliveryDetails{}, fmt.Errorf("Failed to get %s: %s", planID, err.Error())
+	}
+	if dplanAsBytes == nil {
+		return FuelDeliveryPlan{}, DeliveryDetails{}, fmt.Errorf("Could not locate Plan")
+	}
+	dplan := FuelDeliveryPlan{}
+	if err = json.Unmarshal(dplanAsBytes, &dplan); err != nil {
+		return FuelDeliveryPlan{}, DeliveryDetails{}, fmt.Errorf("Failed to decode %s", planID)
+	}
+	dd, ok := dplan.Plan[orderID]
+	if ok == false {
+		return FuelDeliveryPlan{}, DeliveryDetails{}, fmt.Errorf("FuelOrderID didn't exist in any plan")
+	}
+	return dplan, dd, nil
+}
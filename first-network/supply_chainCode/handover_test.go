@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestArriveErrors(t *testing.T) {
+	stub, ids := newTestPlan(t)
+	now := testNow()
+	//another shipper and distributor that don't carry the deliveries.
+	setTestRegistrar(t, stub, "org1")
+	mustInvoke(t, stub, "Org1MSP", "onboardParticipant", "Org7MSP", "org7", "Trucks", RoleDistributor, "0")
+	mustInvoke(t, stub, "Org1MSP", "onboardParticipant", "Org8MSP", "org8", "Tankers", RoleShipper, "0")
+	crudeID := mustInvoke(t, stub, "Org1MSP", "deliverCrude", "50", "100", "org1", testLater(), "org1", "org3", "V2", now)
+	runErrorCases(t, stub, []errorCase{
+		{"wrong number of args", "Org4MSP", []string{"arrive", ids.FuelOrder, "30"}, "Expecting 3 or 4"},
+		{"bad quantity", "Org4MSP", []string{"arrive", ids.FuelOrder, "-1", now, ids.Plan}, "not a positive int"},
+		{"bad timestamp", "Org4MSP", []string{"arrive", ids.FuelOrder, "30", "now", ids.Plan}, "RFC3339"},
+		{"asset doesn't exist", "Org4MSP", []string{"arrive", "FuelOrder99999999", "30", now, ids.Plan}, "Could not locate"},
+		{"fuel can't arrive", "Org4MSP", []string{"arrive", ids.Fuel, "30", now}, "Only a Crude or a FuelOrder"},
+		{"crude has been accepted", "Org2MSP", []string{"arrive", ids.Crude, "100", now}, "Cannot arrive a Crude that is DELIVERED"},
+		{"order without plan", "Org4MSP", []string{"arrive", ids.FuelOrder, "30", now}, "PlanID of the FuelOrder is missing"},
+		{"not the carrier", "Org5MSP", []string{"arrive", ids.FuelOrder, "30", now, ids.Plan}, "Allowed: distributor"},
+		{"more than the order", "Org4MSP", []string{"arrive", ids.FuelOrder, "31", now, ids.Plan}, "exceeds the quantity 30"},
+		{"plan doesn't exist", "Org4MSP", []string{"arrive", ids.FuelOrder, "30", now, "Plan99999999"}, "Could not locate Plan"},
+		{"another distributor", "Org7MSP", []string{"arrive", ids.FuelOrder, "30", now, ids.Plan}, "Only the carrier org4 of " + ids.Plan},
+		{"another shipper", "Org8MSP", []string{"arrive", crudeID, "100", now}, "Only the operator of Vessel V2"},
+	})
+	mustInvoke(t, stub, "Org4MSP", "arrive", ids.FuelOrder, "30", now, ids.Plan)
+	fuelOrder := FuelOrder{}
+	getTestState(t, stub, ids.FuelOrder, &fuelOrder)
+	if fuelOrder.AD.State != StateArrived || fuelOrder.AD.Owner != "org3" {
+		t.Fatalf("Order should be ARRIVED and owned by org3: %+v", fuelOrder.AD)
+	}
+	if h := fuelOrder.Handover; h == nil || h.Carrier != "org4" || h.Quantity != 30 {
+		t.Fatalf("Wrong handover of the order: %+v", h)
+	}
+	runErrorCases(t, stub, []errorCase{
+		{"arrived already", "Org4MSP", []string{"arrive", ids.FuelOrder, "30", now, ids.Plan}, "Cannot arrive a FuelOrder that is ARRIVED"},
+	})
+}
+
+//a rejected crude stays with the driller and nobody is paid.
+func TestRejectCrude(t *testing.T) {
+	stub := newTestStub(t)
+	now := testNow()
+	crudeID := mustInvoke(t, stub, "Org1MSP", "deliverCrude", "50", "100", "org1", testLater(), "org1", "org3", "V1", now)
+	runErrorCases(t, stub, []errorCase{
+		{"driller can't declare the arrival", "Org1MSP", []string{"arrive", crudeID, "100", now}, "Allowed: shipper"},
+		{"reject before the arrival", "Org3MSP", []string{"rejectDelivery", crudeID, "leaking", now}, "Cannot rejectDelivery a Crude that is ON_WAY"},
+	})
+	mustInvoke(t, stub, "Org2MSP", "arrive", crudeID, "90", now)
+	runErrorCases(t, stub, []errorCase{
+		{"wrong number of args", "Org3MSP", []string{"rejectDelivery", crudeID, "leaking"}, "Expecting 3"},
+		{"no reason", "Org3MSP", []string{"rejectDelivery", crudeID, " ", now}, "Reason of the rejection is missing"},
+		{"not the destination", "Org2MSP", []string{"rejectDelivery", crudeID, "leaking", now}, "Allowed: the destination (org3)"},
+	})
+	mustInvoke(t, stub, "Org3MSP", "rejectDelivery", crudeID, "leaking", now)
+	checkBalances(t, stub, nil)
+	crude := Crude{}
+	getTestState(t, stub, crudeID, &crude)
+	if crude.AD.State != StateRejected || crude.AD.Owner != "org1" {
+		t.Fatalf("Crude should be REJECTED and owned by org1: %+v", crude.AD)
+	}
+	if h := crude.Handover; h == nil || h.Quantity != 90 || h.Reason != "leaking" || h.AnsweredAt.IsZero() {
+		t.Fatalf("Wrong handover of the crude: %+v", h)
+	}
+	runErrorCases(t, stub, []errorCase{
+		{"accept a rejected crude", "Org3MSP", []string{"transfer", crudeID, "org3", now}, "Cannot transfer a Crude that is REJECTED"},
+	})
+}
+
+//the escrow of a rejected order is refunded to the buyer.
+func TestRejectFuelOrder(t *testing.T) {
+	stub, ids := newTestPlan(t)
+	now := testNow()
+	mustInvoke(t, stub, "Org4MSP", "arrive", ids.FuelOrder, "30", now, ids.Plan)
+	mustInvoke(t, stub, "Org5MSP", "rejectDelivery", ids.FuelOrder, "wrong density", now)
+	checkBalances(t, stub, map[string]Amount{"org1": 10005000, "org2": 10001000, "org3": 9994000})
+	if balance := getTestBalance(t, stub, "org5"); balance.Locked != 0 {
+		t.Fatalf("Escrow of org5 should be refunded: %+v", balance)
+	}
+	fuelOrder := FuelOrder{}
+	getTestState(t, stub, ids.FuelOrder, &fuelOrder)
+	if fuelOrder.AD.State != StateRejected || fuelOrder.Handover.Reason != "wrong density" {
+		t.Fatalf("Order should be REJECTED for wrong density: %+v %+v", fuelOrder.AD, fuelOrder.Handover)
+	}
+}
+
+//a shortfall within the tolerance is paid pro rata without a dispute.
+func TestPartialDelivery(t *testing.T) {
+	stub := newTestStub(t)
+	now := testNow()
+	crudeID := mustInvoke(t, stub, "Org1MSP", "deliverCrude", "50", "100", "org1", testLater(), "org1", "org3", "V1", now)
+	mustInvoke(t, stub, "Org2MSP", "arrive", crudeID, "100", now)
+	runErrorCases(t, stub, []errorCase{
+		{"nothing received", "Org3MSP", []string{"transfer", crudeID, "org3", now, "", "0"}, "Reject the delivery"},
+		{"more than the quantity", "Org3MSP", []string{"transfer", crudeID, "org3", now, "", "101"}, "exceeds the quantity 100"},
+	})
+	mustInvoke(t, stub, "Org3MSP", "transfer", crudeID, "org3", now, "", "99")
+	//org3 pays 49.50 for 99 of the crude and 9.90 for their freight.
+	checkBalances(t, stub, map[string]Amount{"org1": 10004950, "org2": 10000990, "org3": 9994060})
+	crude := Crude{}
+	getTestState(t, stub, crudeID, &crude)
+	if h := crude.Handover; h.Received != 99 || h.Shortfall != 1 || h.Disputed {
+		t.Fatalf("Wrong handover of the crude: %+v", h)
+	}
+	if crude.Remaining != 99 {
+		t.Fatalf("Only the received crude can be refined, not %d", crude.Remaining)
+	}
+	mustFail(t, stub, "has no dispute", "Org3MSP", "queryDispute", crudeID)
+}
+
+//the carrier declares the whole order but the retailer receives less.
+func TestShortfallDispute(t *testing.T) {
+	stub, ids := newTestPlan(t)
+	now := testNow()
+	mustInvoke(t, stub, "Org4MSP", "arrive", ids.FuelOrder, "30", now, ids.Plan)
+	mustInvoke(t, stub, "Org5MSP", "transfer", ids.FuelOrder, "org5", now, ids.Plan, "24")
+	//16.40 for 24 of the order and 2.40 of freight are paid from the escrow and the rest is refunded.
+	checkBalances(t, stub, map[string]Amount{
+		"org1": 10005000, "org2": 10001000, "org3": 9995640, "org4": 10000240, "org5": 9998120,
+	})
+	if balance := getTestBalance(t, stub, "org5"); balance.Locked != 0 {
+		t.Fatalf("Escrow of org5 should be released: %+v", balance)
+	}
+	fuelOrder := FuelOrder{}
+	getTestState(t, stub, ids.FuelOrder, &fuelOrder)
+	if fuelOrder.AD.State != StateDisputed {
+		t.Fatalf("Order should be DISPUTED and not %s", fuelOrder.AD.State)
+	}
+	if h := fuelOrder.Handover; h.Received != 24 || h.Shortfall != 6 || h.Disputed == false {
+		t.Fatalf("Wrong handover of the order: %+v", h)
+	}
+	dispute := Dispute{}
+	if err := json.Unmarshal([]byte(mustInvoke(t, stub, "Org5MSP", "queryDispute", ids.FuelOrder)), &dispute); err != nil {
+		t.Fatal(err)
+	}
+	if dispute.State != DisputeOpen || dispute.Claim.Org != "org5" || dispute.Carrier != "org4" ||
+		dispute.Supplier != "org3" || dispute.FrozenState != StateDelivered || dispute.Declared != 30 || dispute.Received != 24 {
+		t.Fatalf("Wrong dispute: %+v", dispute)
+	}
+}
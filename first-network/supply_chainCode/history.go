@@ -0,0 +1,161 @@
+/*
+History of the values of a key (needs the history database of the peer, which is enabled by default).
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+/*
+A committed version of a key.
+Value is decoded into the struct of the asset (Crude,Fuel,FuelOrder,FuelDeliveryPlan)
+or into the Account if the key is an org account. It is nil when the key was deleted.
+*/
+type HistoryEntry struct {
+	TxID      string
+	Timestamp time.Time
+	IsDelete  bool
+	Value     interface{}
+}
+
+/*
+args[0] = ID of an asset (e.g 'Crude12', 'Plan3') or an org account (e.g 'org1')
+The versions that were written before the migration from the first version (see migrate.go)
+are decoded with its layout, and the balances that it kept under the org name come first.
+*/
+func (s *SmartContract) queryAssetHistory(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	id := args[0]
+	if AssetType(id) == "" && HasPrefixOrg(id) == false {
+		return shim.Error("ID should be an asset ID or an org")
+	}
+	migration, err := GetMigration(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	history := []HistoryEntry{}
+	key := id
+	if HasPrefixOrg(id) {
+		if key, err = AccountKey(stub, id); err != nil {
+			return shim.Error(err.Error())
+		}
+		legacyVersions, err := keyHistory(stub, id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		for _, modification := range legacyVersions {
+			//the old account was deleted by the migration.
+			if modification.IsDelete {
+				continue
+			}
+			entry, err := newHistoryEntry(id, modification, true)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			history = append(history, entry)
+		}
+	}
+	modifications, err := keyHistory(stub, key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	//the history is in the order of the commits, so the versions before the one of the migration are legacy.
+	migrated := 0
+	for i, modification := range modifications {
+		if migration != nil && modification.TxId == migration.TxID {
+			migrated = i
+		}
+	}
+	for i, modification := range modifications {
+		entry, err := newHistoryEntry(id, modification, i < migrated)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		history = append(history, entry)
+	}
+	historyAsBytes, _ := json.Marshal(history)
+	return shim.Success(historyAsBytes)
+}
+
+//every committed version of a key, the oldest first.
+func keyHistory(stub shim.ChaincodeStubInterface, key string) ([]*queryresult.KeyModification, error) {
+	resultsIterator, err := stub.GetHistoryForKey(key)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+	modifications := []*queryresult.KeyModification{}
+	for resultsIterator.HasNext() {
+		modification, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		modifications = append(modifications, modification)
+	}
+	return modifications, nil
+}
+
+func newHistoryEntry(id string, modification *queryresult.KeyModification, legacy bool) (HistoryEntry, error) {
+	entry := HistoryEntry{TxID: modification.TxId, IsDelete: modification.IsDelete}
+	if modification.Timestamp != nil {
+		entry.Timestamp, _ = ptypes.Timestamp(modification.Timestamp)
+	}
+	if modification.IsDelete == false {
+		var err error
+		if entry.Value, err = DecodeValue(id, modification.Value, legacy); err != nil {
+			return HistoryEntry{}, fmt.Errorf("Failed to decode version %s of %s", modification.TxId, id)
+		}
+	}
+	return entry, nil
+}
+
+/*
+Decode the value of a key into the type that is stored under it.
+A legacy value has the layout of the first version: a balance is a float number of euros
+and so is the Value of an asset.
+*/
+func DecodeValue(id string, value []byte, legacy bool) (interface{}, error) {
+	if legacy && HasPrefixOrg(id) {
+		balance, err := LegacyAmount(value)
+		if err != nil {
+			return nil, err
+		}
+		return &Account{Balance: balance, Currency: Currency}, nil
+	}
+	if legacy {
+		var err error
+		if value, err = LegacyValueInCents(value); err != nil {
+			return nil, err
+		}
+	}
+	var v interface{}
+	switch AssetType(id) {
+	case "Crude":
+		v = &Crude{}
+	case "Fuel":
+		v = &Fuel{}
+	case "FuelOrder":
+		v = &FuelOrder{}
+	case "Plan":
+		v = &FuelDeliveryPlan{}
+	default:
+		if HasPrefixOrg(id) == false {
+			return nil, fmt.Errorf("Unknown type of key %s", id)
+		}
+		v = &Account{}
+	}
+	if err := json.Unmarshal(value, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
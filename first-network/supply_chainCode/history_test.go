@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+)
+
+/*
+A MockStub with a history of the keys, which MockStub doesn't keep.
+queryAssetHistory is called on it directly.
+*/
+type historyStub struct {
+	*shim.MockStub
+	history map[string][]*queryresult.KeyModification
+}
+
+func (stub historyStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return &testHistoryIterator{stub.history[key]}, nil
+}
+
+type testHistoryIterator struct {
+	modifications []*queryresult.KeyModification
+}
+
+func (it *testHistoryIterator) HasNext() bool { return len(it.modifications) > 0 }
+func (it *testHistoryIterator) Close() error  { return nil }
+func (it *testHistoryIterator) Next() (*queryresult.KeyModification, error) {
+	modification := it.modifications[0]
+	it.modifications = it.modifications[1:]
+	return modification, nil
+}
+
+//a version of a key written by txID at the hour of 2019-05-01. An empty value is a deletion.
+func testVersion(txID string, hour int, value string) *queryresult.KeyModification {
+	timestamp, _ := ptypes.TimestampProto(time.Date(2019, 5, 1, hour, 0, 0, 0, time.UTC))
+	return &queryresult.KeyModification{TxId: txID, Value: []byte(value), Timestamp: timestamp, IsDelete: value == ""}
+}
+
+//every version of an asset or an account is returned decoded, in the order it was written.
+func TestQueryAssetHistory(t *testing.T) {
+	stub := shim.NewMockStub("supplychain", new(SmartContract))
+	accountKey, _ := AccountKey(stub, "org3")
+	hs := historyStub{stub, map[string][]*queryresult.KeyModification{
+		"FuelOrder1": {
+			testVersion("tx1", 10, `{"AD":{"Owner":"org3","State":"ON_WAY"},"Dest":"org5","FuelID":"Fuel1"}`),
+			testVersion("tx2", 11, `{"AD":{"Owner":"org5","State":"DELIVERED"},"Dest":"org5","FuelID":"Fuel1"}`),
+		},
+		accountKey: {testVersion("tx1", 10, `{"Balance":9994000,"Currency":"EUR"}`), testVersion("tx2", 11, `{"Balance":9996050,"Currency":"EUR"}`)},
+		"Fuel9":    {testVersion("tx1", 10, `{"AD":{"Owner":"org3","State":"REFINED"}}`), testVersion("tx3", 12, "")},
+		"Fuel8":    {testVersion("tx1", 10, `diesel`)},
+	}}
+	cases := []struct {
+		name string
+		id   string
+		//a version per line: TxID, hour of the timestamp and the state of an asset, the balance of an account or 'deleted'.
+		versions []string
+		err      string
+	}{
+		{"order", "FuelOrder1", []string{"tx1 10 ON_WAY", "tx2 11 DELIVERED"}, ""},
+		{"account", "org3", []string{"tx1 10 99940.00", "tx2 11 99960.50"}, ""},
+		{"deleted fuel", "Fuel9", []string{"tx1 10 REFINED", "tx3 12 deleted"}, ""},
+		{"no history", "Crude1", []string{}, ""},
+		{"broken version", "Fuel8", nil, "Failed to decode version tx1 of Fuel8"},
+		{"not an asset", "Truck1", nil, "ID should be an asset ID or an org"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			res := new(SmartContract).queryAssetHistory(hs, []string{c.id})
+			if c.err != "" {
+				if res.Status == shim.OK || strings.Contains(res.Message, c.err) == false {
+					t.Fatalf("queryAssetHistory should fail with '%s' and not '%s'", c.err, res.Message)
+				}
+				return
+			}
+			if res.Status != shim.OK {
+				t.Fatalf("queryAssetHistory failed: %s", res.Message)
+			}
+			history := []struct {
+				TxID      string
+				Timestamp time.Time
+				IsDelete  bool
+				Value     json.RawMessage
+			}{}
+			if err := json.Unmarshal(res.Payload, &history); err != nil {
+				t.Fatal(err)
+			}
+			versions := []string{}
+			for _, entry := range history {
+				version := fmt.Sprintf("%s %d ", entry.TxID, entry.Timestamp.Hour())
+				if entry.IsDelete {
+					version += "deleted"
+				} else if HasPrefixOrg(c.id) {
+					account := Account{}
+					json.Unmarshal(entry.Value, &account)
+					version += account.Balance.String()
+				} else {
+					v := struct{ AD AssetDetails }{}
+					json.Unmarshal(entry.Value, &v)
+					version += v.AD.State
+				}
+				versions = append(versions, version)
+			}
+			if reflect.DeepEqual(versions, c.versions) == false {
+				t.Fatalf("History should be %v and not %v", c.versions, versions)
+			}
+		})
+	}
+}
+
+//the versions written before the migration are decoded in euros and the old balances come first.
+func TestQueryLegacyHistory(t *testing.T) {
+	stub := shim.NewMockStub("supplychain", new(SmartContract))
+	putTestState(t, stub, MigrationKey, Migration{TxID: "tx3"})
+	accountKey, _ := AccountKey(stub, "org3")
+	hs := historyStub{stub, map[string][]*queryresult.KeyModification{
+		"org3":     {testVersion("tx1", 10, `100000`), testVersion("tx2", 11, `99940.5`), testVersion("tx3", 12, "")},
+		accountKey: {testVersion("tx3", 12, `{"Balance":9994050,"Currency":"EUR"}`), testVersion("tx4", 13, `{"Balance":9995050,"Currency":"EUR"}`)},
+		"Crude1": {
+			testVersion("tx1", 10, `{"AD":{"Value":50.5,"Owner":"org1","State":"ON_WAY"}}`),
+			testVersion("tx3", 12, `{"AD":{"Value":5050,"Owner":"org1","State":"ON_WAY"}}`),
+			testVersion("tx4", 13, `{"AD":{"Value":5050,"Owner":"org3","State":"DELIVERED"}}`),
+		},
+		"Crude2": {testVersion("tx5", 14, `{"AD":{"Value":50,"Owner":"org1","State":"ON_WAY"}}`)},
+	}}
+	cases := []struct {
+		id       string
+		versions []string
+	}{
+		{"org3", []string{"tx1 100000.00", "tx2 99940.50", "tx3 99940.50", "tx4 99950.50"}},
+		{"Crude1", []string{"tx1 50.50", "tx3 50.50", "tx4 50.50"}},
+		//created after the migration.
+		{"Crude2", []string{"tx5 0.50"}},
+	}
+	for _, c := range cases {
+		t.Run(c.id, func(t *testing.T) {
+			res := new(SmartContract).queryAssetHistory(hs, []string{c.id})
+			if res.Status != shim.OK {
+				t.Fatalf("queryAssetHistory failed: %s", res.Message)
+			}
+			history := []struct {
+				TxID  string
+				Value struct {
+					Balance Amount
+					AD      AssetDetails
+				}
+			}{}
+			if err := json.Unmarshal(res.Payload, &history); err != nil {
+				t.Fatal(err)
+			}
+			versions := []string{}
+			for _, entry := range history {
+				amount := entry.Value.AD.Value
+				if HasPrefixOrg(c.id) {
+					amount = entry.Value.Balance
+				}
+				versions = append(versions, entry.TxID+" "+amount.String())
+			}
+			if reflect.DeepEqual(versions, c.versions) == false {
+				t.Fatalf("History should be %v and not %v", c.versions, versions)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+/*
+IDs of the assets are allocated by the chaincode.
+
+Every type has its own sequence, put in db with key Sequence~type. An ID is the type followed
+by the next number of its sequence padded with zeros (e.g. Crude00000042), so the IDs of a type
+sort in the order the assets were created and range queries return them in that order.
+The sequence is read from the committed state, so a transaction can allocate only one ID per type.
+Transactions that allocate an ID of the same type concurrently conflict and only the first is committed.
+*/
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	SequenceObjectType = "Sequence"
+	idDigits           = 8
+)
+
+//allocate the next ID of type typ (one of Crude,Fuel,FuelOrder,Plan,Proposal).
+func NextID(stub shim.ChaincodeStubInterface, typ string) (string, error) {
+	key, err := stub.CreateCompositeKey(SequenceObjectType, []string{typ})
+	if err != nil {
+		return "", fmt.Errorf("Failed to create sequence key of %s: %s", typ, err.Error())
+	}
+	seqAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get sequence of %s: %s", typ, err.Error())
+	}
+	var seq int64
+	if seqAsBytes != nil {
+		if seq, err = strconv.ParseInt(string(seqAsBytes), 10, 64); err != nil {
+			return "", fmt.Errorf("Failed to decode sequence of %s", typ)
+		}
+	}
+	//assets created before the sequences existed may have any ID, so the IDs they took are skipped.
+	var id string
+	for {
+		seq++
+		id = fmt.Sprintf("%s%0*d", typ, idDigits, seq)
+		assetAsBytes, err := stub.GetState(id)
+		if err != nil {
+			return "", fmt.Errorf("Failed to get %s: %s", id, err.Error())
+		}
+		if assetAsBytes == nil {
+			break
+		}
+	}
+	if err = stub.PutState(key, []byte(strconv.FormatInt(seq, 10))); err != nil {
+		return "", fmt.Errorf("Failed to put sequence of %s in db", typ)
+	}
+	return id, nil
+}
+
+/*
+Clients of the first version sent the ID of the new asset as args[0]. When args has n+1 args
+that leading ID is dropped, so those clients keep working, and the allocated ID is returned as usual.
+The dropped ID should still be an ID of type typ, so that args that are only mis-ordered are not taken for it.
+*/
+func DropLegacyID(typ string, args []string, n int) ([]string, error) {
+	if len(args) != n+1 {
+		return args, nil
+	}
+	if AssetType(args[0]) != typ {
+		return nil, fmt.Errorf("Incorrect number of arguments. Expecting %d, or %d with a %s ID first", n, n+1, typ)
+	}
+	return args[1:], nil
+}
@@ -0,0 +1,244 @@
+/*
+Secondary indexes of the assets.
+
+For every Crude, Fuel and FuelOrder the following composite keys (with an empty value) are kept:
+	owner~type~id e.g. org3 Fuel Fuel12
+	state~type~id e.g. ON_WAY FuelOrder FuelOrder7
+	dest~id       e.g. org6 FuelOrder7 (only Crudes and FuelOrders have a destination)
+and for every FuelOrder of a Plan
+	order~plan    e.g. FuelOrder7 Plan3
+The children of an asset (see trace.go) are found through its parent ID:
+	crude~fuel    e.g. Crude2 Fuel12
+	fuel~order    e.g. Fuel12 FuelOrder7
+Assets must be written with PutAsset so that their indexes stay up to date.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	OwnerIndex = "owner~type~id"
+	StateIndex = "state~type~id"
+	DestIndex  = "dest~id"
+	PlanIndex  = "order~plan"
+	FuelIndex  = "crude~fuel"
+	OrderIndex = "fuel~order"
+)
+
+//the parent IDs of a Fuel and a FuelOrder.
+type parentView struct {
+	CrudeID string
+	FuelID  string
+}
+
+/*
+Put an asset in db and update its indexes.
+The indexes are computed from the committed value of the asset,
+so an asset should be put only once per transaction.
+*/
+func PutAsset(stub shim.ChaincodeStubInterface, id string, value []byte) error {
+	oldValue, err := stub.GetState(id)
+	if err != nil {
+		return fmt.Errorf("Failed to get %s: %s", id, err.Error())
+	}
+	oldKeys, err := indexKeys(stub, id, oldValue)
+	if err != nil {
+		return err
+	}
+	newKeys, err := indexKeys(stub, id, value)
+	if err != nil {
+		return err
+	}
+	if err = stub.PutState(id, value); err != nil {
+		return fmt.Errorf("Failed to put %s in db", id)
+	}
+	for key := range oldKeys {
+		if newKeys[key] {
+			continue
+		}
+		if err = stub.DelState(key); err != nil {
+			return fmt.Errorf("Failed to delete index of %s", id)
+		}
+	}
+	for key := range newKeys {
+		if oldKeys[key] {
+			continue
+		}
+		if err = stub.PutState(key, []byte{0x00}); err != nil {
+			return fmt.Errorf("Failed to index %s", id)
+		}
+	}
+	return nil
+}
+
+//the index keys of an asset. Nil values have no index keys.
+func indexKeys(stub shim.ChaincodeStubInterface, id string, value []byte) (map[string]bool, error) {
+	keys := make(map[string]bool)
+	typ := AssetType(id)
+	if value == nil {
+		return keys, nil
+	}
+	if typ == "Plan" {
+		return planKeys(stub, id, value)
+	}
+	v := filterView{}
+	if err := json.Unmarshal(value, &v); err != nil {
+		return nil, fmt.Errorf("Failed to decode %s", id)
+	}
+	dest := v.Dest
+	if dest == "" {
+		dest = v.DD.Destination
+	}
+	attrs := map[string][]string{
+		OwnerIndex: {v.AD.Owner, typ, id},
+		StateIndex: {v.AD.State, typ, id},
+	}
+	if dest != "" {
+		attrs[DestIndex] = []string{dest, id}
+	}
+	parents := parentView{}
+	if err := json.Unmarshal(value, &parents); err != nil {
+		return nil, fmt.Errorf("Failed to decode %s", id)
+	}
+	if typ == "Fuel" && parents.CrudeID != "" {
+		attrs[FuelIndex] = []string{parents.CrudeID, id}
+	}
+	if typ == "FuelOrder" && parents.FuelID != "" {
+		attrs[OrderIndex] = []string{parents.FuelID, id}
+	}
+	for index, attr := range attrs {
+		key, err := stub.CreateCompositeKey(index, attr)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create %s key of %s: %s", index, id, err.Error())
+		}
+		keys[key] = true
+	}
+	return keys, nil
+}
+
+//the order~plan keys of the FuelOrders of a plan.
+func planKeys(stub shim.ChaincodeStubInterface, id string, value []byte) (map[string]bool, error) {
+	keys := make(map[string]bool)
+	dplan := FuelDeliveryPlan{}
+	if err := json.Unmarshal(value, &dplan); err != nil {
+		return nil, fmt.Errorf("Failed to decode %s", id)
+	}
+	for orderID := range dplan.Plan {
+		key, err := stub.CreateCompositeKey(PlanIndex, []string{orderID, id})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create %s key of %s: %s", PlanIndex, id, err.Error())
+		}
+		keys[key] = true
+	}
+	return keys, nil
+}
+
+/*
+args[0] = owner (e.g. 'org3')
+args[1] = type (optional), one of {Crude,Fuel,FuelOrder}
+*/
+func (s *SmartContract) queryByOwner(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+	return queryIndex(stub, OwnerIndex, args)
+}
+
+/*
+args[0] = state (e.g. 'ON_WAY')
+args[1] = type (optional), one of {Crude,Fuel,FuelOrder}
+*/
+func (s *SmartContract) queryByState(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+	return queryIndex(stub, StateIndex, args)
+}
+
+/*
+Crudes and FuelOrders on their way to (or delivered at) an org.
+args[0] = destination (e.g. 'org6')
+*/
+func (s *SmartContract) queryByDest(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	return queryIndex(stub, DestIndex, args)
+}
+
+//returns an array of {Key,Record} of the assets whose index keys start with attrs.
+func queryIndex(stub shim.ChaincodeStubInterface, index string, attrs []string) sc.Response {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(index, attrs)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+	bArrayMemberAlreadyWritten := false
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, keyParts, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		//the ID is always the last attribute of the index.
+		id := keyParts[len(keyParts)-1]
+		assetAsBytes, err := stub.GetState(id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if assetAsBytes == nil {
+			continue
+		}
+		if bArrayMemberAlreadyWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString("{\"Key\":\"")
+		buffer.WriteString(id)
+		buffer.WriteString("\", \"Record\":")
+		buffer.Write(assetAsBytes)
+		buffer.WriteString("}")
+		bArrayMemberAlreadyWritten = true
+	}
+	buffer.WriteString("]")
+	return shim.Success(buffer.Bytes())
+}
+
+/*
+Index the assets that were added before the indexes existed.
+Index keys are written with the same value every time, so it's safe to call it many times.
+*/
+func (s *SmartContract) rebuildIndexes(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	count := 0
+	for _, typ := range []string{"Crude", "Fuel", "FuelOrder", "Plan"} {
+		err := forEachAsset(stub, typ, func(key string, value []byte) error {
+			keys, err := indexKeys(stub, key, value)
+			if err != nil {
+				return err
+			}
+			for indexKey := range keys {
+				if err = stub.PutState(indexKey, []byte{0x00}); err != nil {
+					return fmt.Errorf("Failed to index %s", key)
+				}
+			}
+			count++
+			return nil
+		})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	return shim.Success([]byte(fmt.Sprintf("%d", count)))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+//a lookup through one of the indexes.
+type testLookup func(*SmartContract, shim.ChaincodeStubInterface, []string) sc.Response
+
+//the lookups return the assets whose indexes match and follow the changes of the assets.
+func TestQueryIndexes(t *testing.T) {
+	stub := newTestLedger(t, testLineage)
+	stub.MockTransactionStart("transfer")
+	err := PutAsset(stub, "FuelOrder1", []byte(`{"AD":{"Owner":"org5","State":"DELIVERED"},"Dest":"org5","FuelID":"Fuel1"}`))
+	stub.MockTransactionEnd("transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	byOwner, byState, byDest := (*SmartContract).queryByOwner, (*SmartContract).queryByState, (*SmartContract).queryByDest
+	cases := []struct {
+		name   string
+		lookup testLookup
+		args   []string
+		keys   []string
+	}{
+		{"by owner", byOwner, []string{"org3"}, []string{"Crude1", "Fuel1", "Fuel2", "Fuel3", "FuelOrder2"}},
+		{"by owner and type", byOwner, []string{"org3", "FuelOrder"}, []string{"FuelOrder2"}},
+		{"new owner", byOwner, []string{"org5"}, []string{"FuelOrder1"}},
+		{"owner of nothing", byOwner, []string{"org6"}, []string{}},
+		{"by state", byState, []string{"ON_WAY"}, []string{"Crude2"}},
+		{"by state and type", byState, []string{"DELIVERED", "FuelOrder"}, []string{"FuelOrder1"}},
+		{"old state", byState, []string{"ON_WAY", "FuelOrder"}, []string{}},
+		{"by dest of a crude", byDest, []string{"org3"}, []string{"Crude1", "Crude2"}},
+		{"by dest of an order", byDest, []string{"org6"}, []string{"FuelOrder2"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if keys, _ := testQueryKeys(t, c.lookup(new(SmartContract), stub, c.args)); reflect.DeepEqual(keys, c.keys) == false {
+				t.Fatalf("Lookup of %v should return %v and not %v", c.args, c.keys, keys)
+			}
+		})
+	}
+}
+
+//assets that were put in db without their indexes are found after rebuildIndexes.
+func TestRebuildIndexes(t *testing.T) {
+	stub := newTestLedger(t, testLineage)
+	stub.MockTransactionStart("raw")
+	stub.PutState("Crude99", []byte(`{"AD":{"Owner":"org3","State":"DELIVERED"},"DD":{"Destination":"org3"}}`))
+	stub.PutState("Plan99", []byte(`{"Veh":{"Type":"Truck","ID":"T2"},"Plan":{"FuelOrder2":{"Destination":"org6"}}}`))
+	stub.MockTransactionEnd("raw")
+	if keys, _ := testQueryKeys(t, new(SmartContract).queryByDest(stub, []string{"org3"})); reflect.DeepEqual(keys, []string{"Crude1", "Crude2"}) == false {
+		t.Fatalf("Crude99 shouldn't be indexed yet: %v", keys)
+	}
+	//the 8 assets of testLineage, Crude99 and Plan99, every time it's called.
+	for i := 0; i < 2; i++ {
+		stub.MockTransactionStart("rebuild")
+		res := new(SmartContract).rebuildIndexes(stub, []string{})
+		stub.MockTransactionEnd("rebuild")
+		if res.Status != shim.OK || string(res.Payload) != "10" {
+			t.Fatalf("rebuildIndexes should index 10 assets and not %s: %s", res.Payload, res.Message)
+		}
+	}
+	byOwner, byState, byDest := (*SmartContract).queryByOwner, (*SmartContract).queryByState, (*SmartContract).queryByDest
+	cases := []struct {
+		name   string
+		lookup testLookup
+		args   []string
+		keys   []string
+	}{
+		{"by owner", byOwner, []string{"org3", "Crude"}, []string{"Crude1", "Crude99"}},
+		{"by state", byState, []string{"DELIVERED", "Crude"}, []string{"Crude1", "Crude99"}},
+		{"by dest", byDest, []string{"org3"}, []string{"Crude1", "Crude2", "Crude99"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if keys, _ := testQueryKeys(t, c.lookup(new(SmartContract), stub, c.args)); reflect.DeepEqual(keys, c.keys) == false {
+				t.Fatalf("Lookup of %v should return %v and not %v", c.args, c.keys, keys)
+			}
+		})
+	}
+	if planID, err := PlanOfOrder(stub, "FuelOrder2"); err != nil || planID != "Plan99" {
+		t.Fatalf("FuelOrder2 should be in Plan99 and not in '%s'", planID)
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Journal of payments.
+
+Every posting of Pay writes an immutable JournalEntry. The entry is stored once for the
+payer and once for the payee with the composite key Statement~org~timestamp~txID~payer~payee~reason,
+so the statement of an org is a range over its own entries in chronological order.
+A transaction should not post twice from the same payer to the same payee for the same reason.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const StatementIndex = "Statement"
+
+const (
+	ReasonFreight    = "freight"    //carrier gets paid for the delivery
+	ReasonGoods      = "goods"      //supplier gets paid for the crude or fuel
+	ReasonRefund     = "refund"     //carrier or supplier pays back the buyer after a dispute
+	ReasonAdjustment = "adjustment" //buyer pays more after a dispute
+)
+
+type JournalEntry struct {
+	Payer     string
+	Payee     string
+	Amount    Amount
+	Currency  string
+	Reason    string
+	AssetID   string
+	TxID      string
+	Timestamp time.Time
+}
+
+//a journal entry as seen from the org of the statement.
+type StatementLine struct {
+	JournalEntry
+	Direction string //DEBIT if the org paid, CREDIT if it got paid
+}
+
+//write one journal entry for every payment of the payer.
+func WriteJournal(stub shim.ChaincodeStubInterface, assetID, payer string, oa []OrgAmount) error {
+	timestamp, err := TxTime(stub)
+	if err != nil {
+		return err
+	}
+	for _, p := range oa {
+		entry := JournalEntry{payer, p.org, p.amount, Currency, p.reason, assetID, stub.GetTxID(), timestamp}
+		entryAsBytes, _ := json.Marshal(entry)
+		for _, org := range []string{payer, p.org} {
+			key, err := stub.CreateCompositeKey(StatementIndex,
+				[]string{org, timestamp.Format(time.RFC3339Nano), entry.TxID, payer, p.org, p.reason})
+			if err != nil {
+				return fmt.Errorf("Failed to create journal key: %s", err.Error())
+			}
+			if existing, _ := stub.GetState(key); existing != nil {
+				return fmt.Errorf("Journal entry %s of %s already exists", entry.TxID, org)
+			}
+			if err = stub.PutState(key, entryAsBytes); err != nil {
+				return fmt.Errorf("Failed to write journal entry of %s", org)
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Account statement of an org: every payment it made or received.
+args[0] = org (e.g. 'org3')
+*/
+func (s *SmartContract) queryStatement(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if HasPrefixOrg(args[0]) == false {
+		return shim.Error("Arg should be an org")
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(StatementIndex, []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	statement := []StatementLine{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		line := StatementLine{Direction: "CREDIT"}
+		if err = json.Unmarshal(queryResponse.Value, &line.JournalEntry); err != nil {
+			return shim.Error("Failed to decode journal entry")
+		}
+		if line.Payer == args[0] {
+			line.Direction = "DEBIT"
+		}
+		statement = append(statement, line)
+	}
+	statementAsBytes, _ := json.Marshal(statement)
+	return shim.Success(statementAsBytes)
+}
@@ -0,0 +1,155 @@
+/*
+Migration of a ledger written by the first version of the chaincode.
+
+That version kept the balance of an org as a float number of euros under the key of the org
+(e.g. 'org1' -> 99940.5) and the Value of the assets as a float number of euros.
+MigrateLedger moves the balances to the accounts (see money.go) and rewrites the Values in cents.
+It's called by Init, so it runs with the upgrade of the chaincode before any transaction of the new version.
+The transaction of the migration is kept under MigrationKey, so that queryAssetHistory
+decodes the versions that were written before it with the old layout.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const MigrationKey = "Migration"
+
+type Migration struct {
+	TxID      string
+	Timestamp time.Time
+	Accounts  int
+	Assets    int
+}
+
+//a ledger of the first version has the float balance of org1 under its org name.
+func IsLegacyLedger(stub shim.ChaincodeStubInterface) (bool, error) {
+	legacyBytes, err := stub.GetState("org1")
+	if err != nil {
+		return false, fmt.Errorf("Failed to get org1: %s", err.Error())
+	}
+	return legacyBytes != nil, nil
+}
+
+func GetMigration(stub shim.ChaincodeStubInterface) (*Migration, error) {
+	migrationAsBytes, err := stub.GetState(MigrationKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get migration: %s", err.Error())
+	}
+	if migrationAsBytes == nil {
+		return nil, nil
+	}
+	migration := Migration{}
+	if err = json.Unmarshal(migrationAsBytes, &migration); err != nil {
+		return nil, fmt.Errorf("Failed to decode migration: %s", err.Error())
+	}
+	return &migration, nil
+}
+
+/*
+Move the balances of the orgs of initLedger to their accounts and convert the Values of the assets to cents.
+The assets are indexed too, since the first version had no indexes. Does nothing if the ledger isn't legacy.
+*/
+func MigrateLedger(stub shim.ChaincodeStubInterface) error {
+	legacy, err := IsLegacyLedger(stub)
+	if err != nil || legacy == false {
+		return err
+	}
+	migration := Migration{TxID: stub.GetTxID()}
+	if migration.Timestamp, err = TxTime(stub); err != nil {
+		return err
+	}
+	for _, p := range defaultParticipants {
+		balance, err := legacyBalance(stub, p.Org)
+		if err != nil {
+			return err
+		}
+		if err = Onboard(stub, p, NewAccount(balance, CreditLimits[p.Org])); err != nil {
+			return err
+		}
+		if err = stub.DelState(p.Org); err != nil {
+			return fmt.Errorf("Failed to delete the old account of %s", p.Org)
+		}
+		migration.Accounts++
+	}
+	for _, typ := range []string{"Crude", "Fuel", "FuelOrder"} {
+		err = forEachAsset(stub, typ, func(key string, value []byte) error {
+			value, err := LegacyValueInCents(value)
+			if err != nil {
+				return fmt.Errorf("Failed to migrate %s: %s", key, err.Error())
+			}
+			if err = stub.PutState(key, value); err != nil {
+				return fmt.Errorf("Failed to put %s in db", key)
+			}
+			keys, err := indexKeys(stub, key, value)
+			if err != nil {
+				return err
+			}
+			for indexKey := range keys {
+				if err = stub.PutState(indexKey, []byte{0x00}); err != nil {
+					return fmt.Errorf("Failed to index %s", key)
+				}
+			}
+			migration.Assets++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	migrationAsBytes, _ := json.Marshal(migration)
+	if err = stub.PutState(MigrationKey, migrationAsBytes); err != nil {
+		return fmt.Errorf("Failed to put migration in db")
+	}
+	return nil
+}
+
+//the balance of an org in the first version. Orgs without one start from zero.
+func legacyBalance(stub shim.ChaincodeStubInterface, org string) (Amount, error) {
+	legacyBytes, err := stub.GetState(org)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get the old account of %s: %s", org, err.Error())
+	}
+	if legacyBytes == nil {
+		return 0, nil
+	}
+	return LegacyAmount(legacyBytes)
+}
+
+//a float number of euros (e.g. 99940.5) in cents.
+func LegacyAmount(value []byte) (Amount, error) {
+	var euros float64
+	if err := json.Unmarshal(value, &euros); err != nil {
+		return 0, fmt.Errorf("Old balance is not a number")
+	}
+	return AmountFromFloat(euros), nil
+}
+
+//rewrite the float AD.Value of an asset in cents. The other fields are kept as they are.
+func LegacyValueInCents(value []byte) ([]byte, error) {
+	asset := map[string]json.RawMessage{}
+	if err := json.Unmarshal(value, &asset); err != nil {
+		return nil, err
+	}
+	if asset["AD"] == nil {
+		return value, nil
+	}
+	ad := map[string]json.RawMessage{}
+	if err := json.Unmarshal(asset["AD"], &ad); err != nil {
+		return nil, err
+	}
+	if ad["Value"] != nil {
+		cents, err := LegacyAmount(ad["Value"])
+		if err != nil {
+			return nil, fmt.Errorf("Value is not a number")
+		}
+		ad["Value"], _ = json.Marshal(cents)
+	}
+	asset["AD"], _ = json.Marshal(ad)
+	return json.Marshal(asset)
+}
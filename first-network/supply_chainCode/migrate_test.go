@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//balances and assets as the first version of the chaincode wrote them, in euros.
+var testLegacyLedger = map[string]string{
+	"org1":       `100050`,
+	"org2":       `100010`,
+	"org3":       `99940.5`,
+	"org4":       `100000`,
+	"org5":       `99999.5`,
+	"org6":       `100000`,
+	"Crude1":     `{"AD":{"Value":50.5,"Quantity":100,"Owner":"org3","State":"DELIVERED"},"DD":{"Destination":"org3"}}`,
+	"Fuel1":      `{"AD":{"Value":20,"Quantity":80,"Owner":"org3","State":"REFINED"},"CrudeID":"Crude1","Type":"diesel"}`,
+	"FuelOrder1": `{"AD":{"Value":0.5,"Quantity":5,"Owner":"org5","State":"DELIVERED"},"Dest":"org5","FuelID":"Fuel1"}`,
+	"Plan1":      `{"Veh":{"Type":"Truck","ID":"T1"},"Plan":{"FuelOrder1":{"Destination":"org5"}}}`,
+}
+
+//the upgrade moves the balances to the accounts and the values to cents, once.
+func TestMigrateLedger(t *testing.T) {
+	stub := shim.NewMockStub("supplychain", new(SmartContract))
+	stub.MockTransactionStart("v1")
+	for key, value := range testLegacyLedger {
+		stub.PutState(key, []byte(value))
+	}
+	stub.MockTransactionEnd("v1")
+	mustFail(t, stub, "called already by the previous version", "Org1MSP", "initLedger")
+	if res := stub.MockInit("upgrade", [][]byte{[]byte("init")}); res.Status != shim.OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+	want := map[string]Amount{"org1": 10005000, "org2": 10001000, "org3": 9994050, "org5": 9999950}
+	checkBalances(t, stub, want)
+	for org := range want {
+		if stub.State[org] != nil {
+			t.Fatalf("Old account of %s should be deleted", org)
+		}
+	}
+	for id, value := range map[string]Amount{"Crude1": 5050, "Fuel1": 2000, "FuelOrder1": 50} {
+		asset := struct{ AD AssetDetails }{}
+		getTestState(t, stub, id, &asset)
+		if asset.AD.Value != value || asset.AD.Owner == "" {
+			t.Fatalf("%s should be worth %s and not %s: %+v", id, value, asset.AD.Value, asset.AD)
+		}
+	}
+	fuel := Fuel{}
+	getTestState(t, stub, "Fuel1", &fuel)
+	if fuel.CrudeID != "Crude1" || fuel.Type != "diesel" {
+		t.Fatalf("Migration should keep the other fields of Fuel1: %+v", fuel)
+	}
+	if keys, _ := testQueryKeys(t, new(SmartContract).queryByOwner(stub, []string{"org3"})); reflect.DeepEqual(keys, []string{"Crude1", "Fuel1"}) == false {
+		t.Fatalf("Migrated assets of org3 should be indexed: %v", keys)
+	}
+	migration := Migration{}
+	getTestState(t, stub, MigrationKey, &migration)
+	if migration.TxID != "upgrade" || migration.Accounts != 6 || migration.Assets != 3 {
+		t.Fatalf("Wrong migration: %+v", migration)
+	}
+	mustFail(t, stub, "initLedger has been called already", "Org1MSP", "initLedger")
+	//a later upgrade finds nothing to migrate.
+	if res := stub.MockInit("upgrade2", [][]byte{[]byte("init")}); res.Status != shim.OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+	checkBalances(t, stub, want)
+	if getTestState(t, stub, MigrationKey, &migration); migration.TxID != "upgrade" {
+		t.Fatalf("Migration shouldn't run twice: %+v", migration)
+	}
+}
+
+//values of the first version that are not numbers stop the upgrade.
+func TestMigrateBrokenLedger(t *testing.T) {
+	for key, value := range map[string]string{"org3": `"a lot"`, "Crude1": `{"AD":{"Value":"50.5"}}`} {
+		stub := shim.NewMockStub("supplychain", new(SmartContract))
+		stub.MockTransactionStart("v1")
+		stub.PutState("org1", []byte(`100000`))
+		stub.PutState(key, []byte(value))
+		stub.MockTransactionEnd("v1")
+		if res := stub.MockInit("upgrade", [][]byte{[]byte("init")}); res.Status == shim.OK {
+			t.Fatalf("Init should fail to migrate %s", value)
+		}
+	}
+}
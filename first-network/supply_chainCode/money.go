@@ -0,0 +1,175 @@
+/*
+Money is never stored as a float. Amounts are integer minor units (cents)
+of the Currency of the network, so adding and subtracting them is exact.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const Currency = "EUR"
+const AccountObjectType = "Account"
+const MinorUnits = 100 //cents per euro
+
+type Amount int64
+
+/*
+Put in db with the composite key Account~org (e.g. Account~org1), so that accounts don't share
+the namespace of the assets. Use AccountKey to get the key of an org.
+Balance is the available amount and can be negative down to -CreditLimit.
+Locked is the amount held in escrows (see escrow.go).
+*/
+type Account struct {
+	Balance     Amount
+	Currency    string
+	CreditLimit Amount
+	Locked      Amount
+}
+
+/*
+How much the orgs registered by initLedger can owe. Orgs that are not listed can't overdraw their account.
+Changing a limit requires a chaincode upgrade, which all orgs have to endorse.
+The registrar sets the limit of an org that is onboarded later (see participants.go).
+*/
+var CreditLimits = map[string]Amount{
+	"org3": 20000 * MinorUnits,
+	"org5": 5000 * MinorUnits,
+	"org6": 5000 * MinorUnits,
+}
+
+func NewAccount(balance, creditLimit Amount) Account {
+	return Account{balance, Currency, creditLimit, 0}
+}
+
+func AccountKey(stub shim.ChaincodeStubInterface, org string) (string, error) {
+	key, err := stub.CreateCompositeKey(AccountObjectType, []string{org})
+	if err != nil {
+		return "", fmt.Errorf("Failed to create account key of %s: %s", org, err.Error())
+	}
+	return key, nil
+}
+
+func GetAccount(stub shim.ChaincodeStubInterface, org string) (Account, error) {
+	key, err := AccountKey(stub, org)
+	if err != nil {
+		return Account{}, err
+	}
+	accBytes, err := stub.GetState(key)
+	if err != nil {
+		return Account{}, fmt.Errorf("Failed to get account of %s: %s", org, err.Error())
+	}
+	if accBytes == nil {
+		return Account{}, fmt.Errorf("Account of %s doesn't exist. Please call initLedger before transfer", org)
+	}
+	acc := Account{}
+	if err = json.Unmarshal(accBytes, &acc); err != nil {
+		return Account{}, fmt.Errorf("Failed to decode account of %s", org)
+	}
+	if acc.Currency != Currency {
+		return Account{}, fmt.Errorf("Account of %s is not in %s", org, Currency)
+	}
+	return acc, nil
+}
+
+/*
+Get the accounts of many orgs at once. Returns the accounts by org
+and the orgs without duplicates, in the order they were given.
+Changes should be made on the returned accounts and written with PutAccounts,
+since GetState doesn't return what the transaction has already written.
+*/
+func GetAccounts(stub shim.ChaincodeStubInterface, orgs []string) (map[string]*Account, []string, error) {
+	accounts := make(map[string]*Account)
+	unique := []string{}
+	for _, org := range orgs {
+		if _, ok := accounts[org]; ok {
+			continue
+		}
+		acc, err := GetAccount(stub, org)
+		if err != nil {
+			return nil, nil, err
+		}
+		accounts[org] = &acc
+		unique = append(unique, org)
+	}
+	return accounts, unique, nil
+}
+
+func PutAccounts(stub shim.ChaincodeStubInterface, accounts map[string]*Account, orgs []string) error {
+	for _, org := range orgs {
+		if err := PutAccount(stub, org, *accounts[org]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func PutAccount(stub shim.ChaincodeStubInterface, org string, acc Account) error {
+	key, err := AccountKey(stub, org)
+	if err != nil {
+		return err
+	}
+	accBytes, _ := json.Marshal(acc)
+	if err = stub.PutState(key, accBytes); err != nil {
+		return fmt.Errorf("Failed to add new amount for %s org", org)
+	}
+	return nil
+}
+
+/*
+Parse a decimal string with at most 2 fractional digits (e.g. '12', '12.5', '-0.05').
+*/
+func ParseAmount(s string) (Amount, error) {
+	neg := strings.HasPrefix(s, "-")
+	parts := strings.SplitN(strings.TrimPrefix(s, "-"), ".", 2)
+	units, err := strconv.ParseUint(parts[0], 10, 63)
+	if err != nil || units > math.MaxInt64/MinorUnits-1 {
+		return 0, fmt.Errorf("%s is not a valid amount", s)
+	}
+	var cents uint64
+	if len(parts) == 2 {
+		frac := parts[1]
+		if len(frac) == 0 || len(frac) > 2 {
+			return 0, fmt.Errorf("%s is not a valid amount. Use at most 2 decimal digits", s)
+		}
+		if len(frac) == 1 {
+			frac += "0"
+		}
+		if cents, err = strconv.ParseUint(frac, 10, 8); err != nil {
+			return 0, fmt.Errorf("%s is not a valid amount", s)
+		}
+	}
+	amount := Amount(units*MinorUnits + cents)
+	if neg {
+		amount = -amount
+	}
+	return amount, nil
+}
+
+//round a float (e.g. a penalty computed from a delay) to the nearest cent.
+func AmountFromFloat(f float64) Amount {
+	return Amount(math.Round(f * MinorUnits))
+}
+
+//the part of a that corresponds to part of whole (e.g. the value of a partial delivery), rounded down.
+func (a Amount) ProRata(part, whole int) Amount {
+	if whole <= 0 || part >= whole {
+		return a
+	}
+	return a * Amount(part) / Amount(whole)
+}
+
+func (a Amount) String() string {
+	sign := ""
+	if a < 0 {
+		sign = "-"
+		a = -a
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, a/MinorUnits, a%MinorUnits)
+}
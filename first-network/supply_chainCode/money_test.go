@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseAmount(t *testing.T) {
+	cases := []struct {
+		in   string
+		want Amount
+		str  string
+	}{
+		{"12", 1200, "12.00"},
+		{"12.5", 1250, "12.50"},
+		{"0.05", 5, "0.05"},
+		{"-3.10", -310, "-3.10"},
+		{"0", 0, "0.00"},
+	}
+	for _, c := range cases {
+		got, err := ParseAmount(c.in)
+		if err != nil || got != c.want {
+			t.Errorf("ParseAmount(%s) should be %d and not %d (%v)", c.in, c.want, got, err)
+		}
+		if got.String() != c.str {
+			t.Errorf("%d should be printed as %s and not %s", got, c.str, got.String())
+		}
+	}
+	for _, in := range []string{"", "1.", "1.234", "+1", "a", "1.-2", ".5", "1.+5", "1e3"} {
+		if _, err := ParseAmount(in); err == nil {
+			t.Errorf("ParseAmount(%q) should fail", in)
+		}
+	}
+}
+
+func TestAmountFromFloat(t *testing.T) {
+	for f, want := range map[float64]Amount{3: 300, 0.125: 13, 0.004: 0, 36.001: 3600} {
+		if got := AmountFromFloat(f); got != want {
+			t.Errorf("AmountFromFloat(%f) should be %d and not %d", f, want, got)
+		}
+	}
+}
+
+func TestProRata(t *testing.T) {
+	cases := []struct {
+		a           Amount
+		part, whole int
+		want        Amount
+	}{
+		{2050, 24, 30, 1640},
+		{5000, 99, 100, 4950},
+		{100, 1, 3, 33},
+		{100, 3, 3, 100},
+		{100, 5, 0, 100},
+	}
+	for _, c := range cases {
+		if got := c.a.ProRata(c.part, c.whole); got != c.want {
+			t.Errorf("%d/%d of %s should be %s and not %s", c.part, c.whole, c.a, c.want, got)
+		}
+	}
+}
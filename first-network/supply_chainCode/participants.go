@@ -0,0 +1,386 @@
+/*
+Registry of the participants of the supply chain.
+
+A participant is put in db with the composite key Participant~MSPID and maps the MSP ID of
+an org to its display name, its role and the name of its account (which is also the name of
+the org in the owners and destinations of the assets, e.g. Org3MSP -> org3).
+The index org~msp finds the participant of an org name.
+initLedger registers the six orgs of the network. Afterwards the registrar org (see config.go)
+	onboards a new org with onboardParticipant, which opens its account,
+	suspends a participant with suspendParticipant and reinstates it with reinstateParticipant and
+	offboards a participant for good with offboardParticipant.
+Only an ACTIVE participant can submit transactions or be the destination of a new delivery.
+A SUSPENDED participant is still paid for the deliveries it made. An OFFBOARDED participant
+is kept in db, since the assets and the journal still refer to it, but its MSP ID and org
+name can't be onboarded again.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	ParticipantObjectType = "Participant"
+	ParticipantOrgIndex   = "org~msp"
+)
+
+const (
+	ParticipantActive     = "ACTIVE"
+	ParticipantSuspended  = "SUSPENDED"
+	ParticipantOffboarded = "OFFBOARDED"
+)
+
+type Participant struct {
+	MSPID  string
+	Org    string //name of the account and of the org in the assets
+	Name   string //display name
+	Role   string
+	Status string
+	Reason string `json:",omitempty"` //why it was suspended or offboarded
+}
+
+//the orgs of the network that initLedger registers.
+var defaultParticipants = []Participant{
+	{MSPID: "Org1MSP", Org: "org1", Name: "Driller", Role: RoleDriller},
+	{MSPID: "Org2MSP", Org: "org2", Name: "Shipper", Role: RoleShipper},
+	{MSPID: "Org3MSP", Org: "org3", Name: "Refinery", Role: RoleRefiner},
+	{MSPID: "Org4MSP", Org: "org4", Name: "Distributor", Role: RoleDistributor},
+	{MSPID: "Org5MSP", Org: "org5", Name: "Fuel station 5", Role: RoleRetailer},
+	{MSPID: "Org6MSP", Org: "org6", Name: "Fuel station 6", Role: RoleRetailer},
+}
+
+var participantRoles = []string{RoleDriller, RoleShipper, RoleRefiner, RoleDistributor, RoleRetailer}
+
+func participantKey(stub shim.ChaincodeStubInterface, mspid string) (string, error) {
+	key, err := stub.CreateCompositeKey(ParticipantObjectType, []string{mspid})
+	if err != nil {
+		return "", fmt.Errorf("Failed to create participant key of %s: %s", mspid, err.Error())
+	}
+	return key, nil
+}
+
+//returns the participant of an MSP ID or nil if it isn't registered.
+func GetParticipant(stub shim.ChaincodeStubInterface, mspid string) (*Participant, error) {
+	key, err := participantKey(stub, mspid)
+	if err != nil {
+		return nil, err
+	}
+	participantAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get participant %s: %s", mspid, err.Error())
+	}
+	if participantAsBytes == nil {
+		return nil, nil
+	}
+	p := Participant{}
+	if err = json.Unmarshal(participantAsBytes, &p); err != nil {
+		return nil, fmt.Errorf("Failed to decode participant %s", mspid)
+	}
+	return &p, nil
+}
+
+//returns the participant of an org name (e.g. 'org3') or nil if it isn't registered.
+func GetParticipantOfOrg(stub shim.ChaincodeStubInterface, org string) (*Participant, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(ParticipantOrgIndex, []string{org})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the participant of %s: %s", org, err.Error())
+	}
+	defer resultsIterator.Close()
+	if resultsIterator.HasNext() == false {
+		return nil, nil
+	}
+	queryResponse, err := resultsIterator.Next()
+	if err != nil {
+		return nil, err
+	}
+	_, keyParts, err := stub.SplitCompositeKey(queryResponse.Key)
+	if err != nil {
+		return nil, err
+	}
+	return GetParticipant(stub, keyParts[1])
+}
+
+func PutParticipant(stub shim.ChaincodeStubInterface, p Participant) error {
+	key, err := participantKey(stub, p.MSPID)
+	if err != nil {
+		return err
+	}
+	participantAsBytes, _ := json.Marshal(p)
+	if err = stub.PutState(key, participantAsBytes); err != nil {
+		return fmt.Errorf("Failed to put participant %s in db", p.MSPID)
+	}
+	indexKey, err := stub.CreateCompositeKey(ParticipantOrgIndex, []string{p.Org, p.MSPID})
+	if err != nil {
+		return fmt.Errorf("Failed to create the org index of %s: %s", p.MSPID, err.Error())
+	}
+	if err = stub.PutState(indexKey, []byte{0x00}); err != nil {
+		return fmt.Errorf("Failed to index participant %s", p.MSPID)
+	}
+	return nil
+}
+
+/*
+Register a participant and open its account.
+A participant should have a new MSP ID and org name and one of the roles of the supply chain.
+*/
+func Onboard(stub shim.ChaincodeStubInterface, p Participant, account Account) error {
+	validRole := false
+	for _, role := range participantRoles {
+		validRole = validRole || p.Role == role
+	}
+	if validRole == false {
+		return fmt.Errorf("Role should be one of %v", participantRoles)
+	}
+	//the org name is the name of an account, which has to be told apart from the IDs of the assets.
+	if HasPrefixOrg(p.Org) == false {
+		return fmt.Errorf("Org name %s is not prefixed with 'org'", p.Org)
+	}
+	existing, err := GetParticipant(stub, p.MSPID)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("MSP ID %s is registered as %s already", p.MSPID, existing.Org)
+	}
+	if existing, err = GetParticipantOfOrg(stub, p.Org); err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("Org name %s is taken by %s already", p.Org, existing.MSPID)
+	}
+	p.Status = ParticipantActive
+	if err = PutParticipant(stub, p); err != nil {
+		return err
+	}
+	return PutAccount(stub, p.Org, account)
+}
+
+//returns the role of an ACTIVE org (e.g. 'org3' -> refiner) or an empty string if it's not one.
+func RoleOfOrg(stub shim.ChaincodeStubInterface, org string) (string, error) {
+	p, err := GetParticipantOfOrg(stub, org)
+	if err != nil {
+		return "", err
+	}
+	if p == nil || p.Status != ParticipantActive {
+		return "", nil
+	}
+	return p.Role, nil
+}
+
+/*
+The account that pays org for its part in a delivery as role.
+An org that was suspended after the delivery is still paid, an offboarded one isn't.
+*/
+func PayeeOf(stub shim.ChaincodeStubInterface, org, role string) (string, error) {
+	p, err := GetParticipantOfOrg(stub, org)
+	if err != nil {
+		return "", err
+	}
+	if p == nil {
+		return "", fmt.Errorf("%s is not a participant of the supply chain", org)
+	}
+	if p.Role != role {
+		return "", fmt.Errorf("%s is a %s and can't be paid as a %s", org, p.Role, role)
+	}
+	if p.Status == ParticipantOffboarded {
+		return "", fmt.Errorf("%s is offboarded and can't be paid", org)
+	}
+	return p.Org, nil
+}
+
+//ensure that the caller is the registrar of the config.
+func requireRegistrar(stub shim.ChaincodeStubInterface) error {
+	caller, err := GetCaller(stub)
+	if err != nil {
+		return err
+	}
+	config, err := GetConfig(stub)
+	if err != nil {
+		return err
+	}
+	if config.Registrar == "" {
+		return fmt.Errorf("No registrar org is configured. Set one with the registrar key of Init")
+	}
+	if caller.Org != config.Registrar {
+		return fmt.Errorf("Only the registrar %s can change the participants", config.Registrar)
+	}
+	return nil
+}
+
+//the participant of mspid for the registrar to change.
+func getRegisteredParticipant(stub shim.ChaincodeStubInterface, mspid string) (Participant, error) {
+	if err := requireRegistrar(stub); err != nil {
+		return Participant{}, err
+	}
+	p, err := GetParticipant(stub, mspid)
+	if err != nil {
+		return Participant{}, err
+	}
+	if p == nil {
+		return Participant{}, fmt.Errorf("MSP ID %s is not registered", mspid)
+	}
+	return *p, nil
+}
+
+/*
+The registrar onboards a new org and opens its account with a zero balance.
+args[0] = MSP ID
+args[1] = org name, the name of its account (e.g. 'org7')
+args[2] = display name
+args[3] = role, one of {driller,shipper,refiner,distributor,retailer}
+args[4] = credit limit, how much the org can owe
+*/
+func (s *SmartContract) onboardParticipant(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 5")
+	}
+	if err := requireRegistrar(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	if args[0] == "" || args[2] == "" {
+		return shim.Error("MSP ID and display name of the participant are required")
+	}
+	creditLimit, err := ParseAmount(args[4])
+	if err != nil || creditLimit < 0 {
+		return shim.Error("Credit limit is not a non negative decimal number with at most 2 decimal digits")
+	}
+	p := Participant{MSPID: args[0], Org: args[1], Name: args[2], Role: args[3]}
+	if err = Onboard(stub, p, NewAccount(0, creditLimit)); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+/*
+The registrar suspends an ACTIVE participant.
+args[0] = MSP ID
+args[1] = reason
+*/
+func (s *SmartContract) suspendParticipant(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	p, err := getRegisteredParticipant(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if p.Status != ParticipantActive {
+		return shim.Error(fmt.Sprintf("Only an ACTIVE participant can be suspended. %s is %s", p.MSPID, p.Status))
+	}
+	if args[1] == "" {
+		return shim.Error("Reason of the suspension is missing")
+	}
+	p.Status = ParticipantSuspended
+	p.Reason = args[1]
+	if err = PutParticipant(stub, p); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+/*
+The registrar reinstates a SUSPENDED participant.
+args[0] = MSP ID
+*/
+func (s *SmartContract) reinstateParticipant(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	p, err := getRegisteredParticipant(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if p.Status != ParticipantSuspended {
+		return shim.Error(fmt.Sprintf("Only a SUSPENDED participant can be reinstated. %s is %s", p.MSPID, p.Status))
+	}
+	p.Status = ParticipantActive
+	p.Reason = ""
+	if err = PutParticipant(stub, p); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+/*
+The registrar offboards a participant for good. Its account should be settled,
+i.e. it owes nothing and has no funds locked in escrow.
+args[0] = MSP ID
+args[1] = reason
+*/
+func (s *SmartContract) offboardParticipant(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	p, err := getRegisteredParticipant(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if p.Status == ParticipantOffboarded {
+		return shim.Error(fmt.Sprintf("%s is offboarded already", p.MSPID))
+	}
+	if args[1] == "" {
+		return shim.Error("Reason of the offboarding is missing")
+	}
+	config, err := GetConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if p.Org == config.Registrar || p.Org == config.Arbiter {
+		return shim.Error(fmt.Sprintf("%s is the registrar or the arbiter. Change the config first", p.Org))
+	}
+	account, err := GetAccount(stub, p.Org)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if account.Balance < 0 {
+		return shim.Error(fmt.Sprintf("%s owes %s and can't be offboarded", p.Org, (-account.Balance).String()))
+	}
+	if account.Locked > 0 {
+		return shim.Error(fmt.Sprintf("%s has %s locked in escrow and can't be offboarded", p.Org, account.Locked.String()))
+	}
+	p.Status = ParticipantOffboarded
+	p.Reason = args[1]
+	if err = PutParticipant(stub, p); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+//every participant, in the order of their MSP IDs.
+func GetParticipants(stub shim.ChaincodeStubInterface) ([]Participant, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(ParticipantObjectType, []string{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the participants: %s", err.Error())
+	}
+	defer resultsIterator.Close()
+	participants := []Participant{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		p := Participant{}
+		if err = json.Unmarshal(queryResponse.Value, &p); err != nil {
+			return nil, fmt.Errorf("Failed to decode participant %s", queryResponse.Key)
+		}
+		participants = append(participants, p)
+	}
+	return participants, nil
+}
+
+func (s *SmartContract) queryParticipants(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+	participants, err := GetParticipants(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	participantsAsBytes, _ := json.Marshal(participants)
+	return shim.Success(participantsAsBytes)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func setTestRegistrar(t *testing.T, stub *shim.MockStub, org string) {
+	t.Helper()
+	if res := stub.MockInit("init", [][]byte{[]byte("init"), []byte("registrar=" + org)}); res.Status != shim.OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+}
+
+//an org that is onboarded later takes part in the deliveries and is paid like the orgs of initLedger.
+func TestOnboardParticipant(t *testing.T) {
+	stub := newTestStub(t)
+	now := testNow()
+	onboard := func(mspid, org, role string) []string {
+		return []string{"onboardParticipant", mspid, org, "Tanker Co", role, "100"}
+	}
+	mustFail(t, stub, "No registrar org is configured", "Org1MSP", onboard("Org7MSP", "org7", RoleShipper)...)
+	setTestRegistrar(t, stub, "org1")
+	runErrorCases(t, stub, []errorCase{
+		{"not the registrar", "Org2MSP", onboard("Org7MSP", "org7", RoleShipper), "Only the registrar org1"},
+		{"unknown MSP", "Org7MSP", onboard("Org7MSP", "org7", RoleShipper), "has no role"},
+		{"unknown role", "Org1MSP", onboard("Org7MSP", "org7", "trader"), "Role should be one of"},
+		{"not an org name", "Org1MSP", onboard("Org7MSP", "tanker", RoleShipper), "is not prefixed with 'org'"},
+		{"MSP ID taken", "Org1MSP", onboard("Org2MSP", "org7", RoleShipper), "MSP ID Org2MSP is registered as org2 already"},
+		{"org name taken", "Org1MSP", onboard("Org7MSP", "org2", RoleShipper), "Org name org2 is taken by Org2MSP already"},
+		{"bad credit limit", "Org1MSP", []string{"onboardParticipant", "Org7MSP", "org7", "Tanker Co", RoleShipper, "-1"}, "Credit limit"},
+	})
+	mustInvoke(t, stub, "Org1MSP", onboard("Org7MSP", "org7", RoleShipper)...)
+	if balance := getTestBalance(t, stub, "org7"); balance.Available != 0 {
+		t.Fatalf("New account should be empty: %+v", balance)
+	}
+	participants := []Participant{}
+	if err := json.Unmarshal([]byte(mustInvoke(t, stub, "Org5MSP", "queryParticipants")), &participants); err != nil {
+		t.Fatal(err)
+	}
+	if len(participants) != 7 || participants[6] != (Participant{"Org7MSP", "org7", "Tanker Co", RoleShipper, ParticipantActive, ""}) {
+		t.Fatalf("Wrong participants: %+v", participants)
+	}
+
+	//org7 carries a crude on its own vessel and org3 pays it instead of org2.
+	mustInvoke(t, stub, "Org7MSP", "registerVehicle", "Vessel", "V7", "1000", "0", testLater())
+	crudeID := mustInvoke(t, stub, "Org1MSP", "deliverCrude", "50", "100", "org1", testLater(), "org1", "org3", "V7", now)
+	mustInvoke(t, stub, "Org7MSP", "arrive", crudeID, "100", now)
+	mustInvoke(t, stub, "Org3MSP", "transfer", crudeID, "org3", now)
+	checkBalances(t, stub, map[string]Amount{"org1": 10005000, "org3": 9994000})
+	if balance := getTestBalance(t, stub, "org7"); balance.Available != 1000 {
+		t.Fatalf("org7 should be paid 10.00 for the freight: %+v", balance)
+	}
+}
+
+//a suspended org can't call the chaincode or receive new deliveries, but it's paid for the ones it made.
+func TestSuspendParticipant(t *testing.T) {
+	stub := newTestStub(t)
+	now := testNow()
+	setTestRegistrar(t, stub, "org1")
+	crudeID := mustInvoke(t, stub, "Org1MSP", "deliverCrude", "50", "100", "org1", testLater(), "org1", "org3", "V1", now)
+	mustInvoke(t, stub, "Org2MSP", "arrive", crudeID, "100", now)
+	runErrorCases(t, stub, []errorCase{
+		{"not the registrar", "Org3MSP", []string{"suspendParticipant", "Org2MSP", "late payments"}, "Only the registrar org1"},
+		{"unknown MSP ID", "Org1MSP", []string{"suspendParticipant", "Org9MSP", "late payments"}, "MSP ID Org9MSP is not registered"},
+		{"no reason", "Org1MSP", []string{"suspendParticipant", "Org2MSP", ""}, "Reason of the suspension is missing"},
+		{"reinstate an active org", "Org1MSP", []string{"reinstateParticipant", "Org2MSP"}, "Only a SUSPENDED participant can be reinstated"},
+	})
+	mustInvoke(t, stub, "Org1MSP", "suspendParticipant", "Org2MSP", "expired insurance")
+	mustInvoke(t, stub, "Org1MSP", "suspendParticipant", "Org6MSP", "unpaid fees")
+	runErrorCases(t, stub, []errorCase{
+		{"suspended caller", "Org2MSP", []string{"registerVehicle", "Vessel", "V8", "1000", "0", testLater()}, "org2 is SUSPENDED"},
+		{"suspended destination", "Org1MSP", []string{"deliverCrude", "50", "100", "org1", testLater(), "org1", "org6", "V2", now}, "should be delivered to a refiner"},
+		{"suspended twice", "Org1MSP", []string{"suspendParticipant", "Org2MSP", "again"}, "Only an ACTIVE participant can be suspended"},
+	})
+	mustInvoke(t, stub, "Org3MSP", "transfer", crudeID, "org3", now)
+	checkBalances(t, stub, map[string]Amount{"org1": 10005000, "org2": 10001000, "org3": 9994000})
+	mustInvoke(t, stub, "Org1MSP", "reinstateParticipant", "Org2MSP")
+	mustInvoke(t, stub, "Org2MSP", "registerVehicle", "Vessel", "V8", "1000", "0", testLater())
+}
+
+//an offboarded org is kept in the registry, but it can't call the chaincode, be paid or be onboarded again.
+func TestOffboardParticipant(t *testing.T) {
+	stub, ids := newTestPlan(t)
+	now := testNow()
+	setTestRegistrar(t, stub, "org1")
+	setTestArbiter(t, stub, "org6")
+	runErrorCases(t, stub, []errorCase{
+		{"escrow of an order", "Org1MSP", []string{"offboardParticipant", "Org5MSP", "closed"}, "has 23.50 locked in escrow"},
+		{"registrar", "Org1MSP", []string{"offboardParticipant", "Org1MSP", "closed"}, "is the registrar or the arbiter"},
+		{"arbiter", "Org1MSP", []string{"offboardParticipant", "Org6MSP", "closed"}, "is the registrar or the arbiter"},
+		{"no reason", "Org1MSP", []string{"offboardParticipant", "Org4MSP", ""}, "Reason of the offboarding is missing"},
+	})
+	mustInvoke(t, stub, "Org4MSP", "arrive", ids.FuelOrder, "30", now, ids.Plan)
+	mustInvoke(t, stub, "Org1MSP", "offboardParticipant", "Org4MSP", "sold its fleet")
+	runErrorCases(t, stub, []errorCase{
+		{"offboarded caller", "Org4MSP", []string{"closePlan", ids.Plan, now}, "org4 is OFFBOARDED"},
+		{"offboarded carrier", "Org5MSP", []string{"transfer", ids.FuelOrder, "org5", now, ids.Plan}, "org4 is offboarded and can't be paid"},
+		{"offboarded twice", "Org1MSP", []string{"offboardParticipant", "Org4MSP", "again"}, "Org4MSP is offboarded already"},
+		{"reinstated", "Org1MSP", []string{"reinstateParticipant", "Org4MSP"}, "Org4MSP is OFFBOARDED"},
+		{"onboarded again", "Org1MSP", []string{"onboardParticipant", "Org4MSP", "org8", "Trucks", RoleDistributor, "0"}, "is registered as org4 already"},
+	})
+}
@@ -0,0 +1,532 @@
+/*
+Validation and amendments of the fuel delivery plans.
+
+deliverFuel accepts a plan only if, for every delivery {FuelOrderID,EstTime,Sloc,Dest} of it,
+	the FuelOrder exists and the caller can deliver it (it's READY and the caller is a distributor),
+	Dest is the destination of the FuelOrder,
+	Sloc is the refiner that owns the FuelOrder and
+	the FuelOrder appears once in the plan and isn't in another plan,
+and the truck is a registered truck of the caller that can carry the orders (see fleet.go).
+Every mismatch is reported in one PlanError, so that the distributor can fix the whole plan at once.
+The fields of its errors are named like the fields of the JSON args of deliverFuel (see args.go).
+
+The distributor that made a plan can amend it while it's open:
+	addPlanOrders       - adds READY orders, which are validated like the orders of deliverFuel,
+	removePlanOrder     - removes an order that is ON_WAY and makes it READY again,
+	reschedulePlanOrder - changes the EstTime of an order that is ON_WAY with a reason code,
+	swapPlanVehicle     - puts the orders of the plan on another truck of the carrier,
+	closePlan           - closes a plan that has no orders ON_WAY, so it can't be amended anymore.
+Every amendment increments the Version of the plan and is appended to its Amendments.
+The EstTime of an order can be changed only before it has passed, so the delay penalty of
+a late order is computed against the EstTime that was agreed before it was late. ETAVersion of
+the delivery details is the version of the plan that agreed on its EstTime.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+//reason codes of reschedulePlanOrder.
+var ETAReasons = []string{"BREAKDOWN", "TRAFFIC", "WEATHER", "STATION_REQUEST", "OTHER"}
+
+type Amendment struct {
+	Version     int //version of the plan after the amendment
+	Action      string
+	Org         string
+	Time        time.Time
+	Reason      string `json:",omitempty"`
+	FuelOrderID string `json:",omitempty"`
+	From        string `json:",omitempty"` //the EstTime or the truck before the amendment
+	To          string `json:",omitempty"` //the EstTime or the truck after the amendment
+}
+
+type PlanError struct {
+	TruckID string
+	Errors  []FieldError
+}
+
+func (e *PlanError) Error() string {
+	errAsBytes, _ := json.Marshal(e)
+	return string(errAsBytes)
+}
+
+func (e *PlanError) add(field, format string, a ...interface{}) {
+	e.Errors = append(e.Errors, FieldError{field, fmt.Sprintf(format, a...)})
+}
+
+//a FuelOrder of a valid plan with its delivery details and the state it goes to.
+type plannedOrder struct {
+	ID        FuelOrderID
+	FuelOrder FuelOrder
+	To        string
+	DD        DeliveryDetails
+}
+
+/*
+Validate the deliveries of a plan. orders are the {FuelOrderID,EstTime,Sloc,Dest} args of deliverFuel
+or addPlanOrders (action), loaded is what is already on the truck and planID is the plan that is
+amended (empty for a new plan).
+Returns the orders in the order they were given or a PlanError with every mismatch.
+*/
+func ValidatePlan(stub shim.ChaincodeStubInterface, caller Caller, action, truckID string, orders []string, loaded load, planID string) ([]plannedOrder, error) {
+	planErr := &PlanError{TruckID: truckID}
+	planned := []plannedOrder{}
+	seen := make(map[FuelOrderID]int)
+	total := loaded
+	for i := 0; i < len(orders); i += 4 {
+		n := i / 4
+		field := fmt.Sprintf("Deliveries[%d]", n)
+		id := orders[i]
+		if first, ok := seen[id]; ok {
+			planErr.add(field+".FuelOrderID", "%s is already in Deliveries[%d]", id, first)
+			continue
+		}
+		seen[id] = n
+		DD, err := NewDeliveryDetails(orders[i+1], orders[i+2], orders[i+3])
+		if err != nil {
+			planErr.add(field, "%s", err.Error())
+		}
+		fuelOrderbytes, err := stub.GetState(id)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get %s: %s", id, err.Error())
+		}
+		if fuelOrderbytes == nil || AssetType(id) != "FuelOrder" {
+			planErr.add(field+".FuelOrderID", "FuelOrderID %s does not exist", id)
+			continue
+		}
+		fuelOrder := FuelOrder{}
+		if err = json.Unmarshal(fuelOrderbytes, &fuelOrder); err != nil {
+			return nil, fmt.Errorf("Failed to decode %s", id)
+		}
+		t, err := CheckTransition(caller, "FuelOrder", action, fuelOrder.AD.State, fuelOrder.AD.Owner, fuelOrder.Dest)
+		if err != nil {
+			planErr.add(field+".FuelOrderID", "%s: %s", id, err.Error())
+		}
+		otherPlan, err := PlanOfOrder(stub, id)
+		if err != nil {
+			return nil, err
+		}
+		if otherPlan != "" {
+			planErr.add(field+".FuelOrderID", "%s is already in %s", id, otherPlan)
+		}
+		if orders[i+2] != fuelOrder.AD.Owner {
+			planErr.add(field+".StartingLocation", "%s should be the refiner %s that owns %s", orders[i+2], fuelOrder.AD.Owner, id)
+		}
+		if orders[i+3] != fuelOrder.Dest {
+			planErr.add(field+".Destination", "%s should be the destination %s of %s", orders[i+3], fuelOrder.Dest, id)
+		}
+		total.Quantity += fuelOrder.AD.Quantity
+		total.Orders++
+		planned = append(planned, plannedOrder{id, fuelOrder, t.To, DD})
+	}
+	truck, err := GetVehicle(stub, "Truck", truckID)
+	if err != nil {
+		return nil, err
+	}
+	problems, err := CheckVehicle(stub, truck, "Truck", truckID, caller.Org, total, planID)
+	if err != nil {
+		return nil, err
+	}
+	for _, problem := range problems {
+		planErr.add("TruckID", "%s", problem)
+	}
+	if len(planErr.Errors) > 0 {
+		return nil, planErr
+	}
+	return planned, nil
+}
+
+//returns the ID of the plan that a FuelOrder is in or an empty string.
+func PlanOfOrder(stub shim.ChaincodeStubInterface, id FuelOrderID) (string, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(PlanIndex, []string{id})
+	if err != nil {
+		return "", fmt.Errorf("Failed to get the plan of %s: %s", id, err.Error())
+	}
+	defer resultsIterator.Close()
+	if resultsIterator.HasNext() == false {
+		return "", nil
+	}
+	queryResponse, err := resultsIterator.Next()
+	if err != nil {
+		return "", err
+	}
+	_, keyParts, err := stub.SplitCompositeKey(queryResponse.Key)
+	if err != nil {
+		return "", err
+	}
+	return keyParts[1], nil
+}
+
+//the plan with planID if it's open and the caller made it.
+func getOpenPlan(stub shim.ChaincodeStubInterface, caller Caller, planID string) (FuelDeliveryPlan, error) {
+	if strings.HasPrefix(planID, "Plan") == false {
+		return FuelDeliveryPlan{}, fmt.Errorf("PlanID is not of the form 'PlanXXX'")
+	}
+	dplanAsBytes, err := stub.GetState(planID)
+	if err != nil {
+		return FuelDeliveryPlan{}, fmt.Errorf("Failed to get %s: %s", planID, err.Error())
+	}
+	if dplanAsBytes == nil {
+		return FuelDeliveryPlan{}, fmt.Errorf("Could not locate Plan")
+	}
+	dplan := FuelDeliveryPlan{}
+	if err = json.Unmarshal(dplanAsBytes, &dplan); err != nil {
+		return FuelDeliveryPlan{}, fmt.Errorf("Failed to decode %s", planID)
+	}
+	if dplan.Closed {
+		return FuelDeliveryPlan{}, fmt.Errorf("%s is closed", planID)
+	}
+	//plans made before the amendments have no carrier, so any distributor can amend them.
+	if caller.Role != RoleDistributor || (dplan.Carrier != "" && dplan.Carrier != caller.Org) {
+		carrier := dplan.Carrier
+		if carrier == "" {
+			carrier = "distributor"
+		}
+		return FuelDeliveryPlan{}, fmt.Errorf("Only the %s that made %s can amend it", carrier, planID)
+	}
+	return dplan, nil
+}
+
+//the FuelOrder of a plan.
+func getPlanOrder(stub shim.ChaincodeStubInterface, dplan FuelDeliveryPlan, planID, id string) (FuelOrder, error) {
+	if _, ok := dplan.Plan[id]; ok == false {
+		return FuelOrder{}, fmt.Errorf("%s is not in %s", id, planID)
+	}
+	fuelOrderbytes, err := stub.GetState(id)
+	if err != nil {
+		return FuelOrder{}, fmt.Errorf("Failed to get %s: %s", id, err.Error())
+	}
+	fuelOrder := FuelOrder{}
+	if err = json.Unmarshal(fuelOrderbytes, &fuelOrder); err != nil {
+		return FuelOrder{}, fmt.Errorf("Failed to decode %s", id)
+	}
+	return fuelOrder, nil
+}
+
+//the orders of a plan that are still on the truck.
+func loadedOrders(stub shim.ChaincodeStubInterface, dplan FuelDeliveryPlan, planID string) (load, error) {
+	loaded := load{}
+	for id := range dplan.Plan {
+		fuelOrder, err := getPlanOrder(stub, dplan, planID, id)
+		if err != nil {
+			return load{}, err
+		}
+		if fuelOrder.AD.State == StateOnWay {
+			loaded.Quantity += fuelOrder.AD.Quantity
+			loaded.Orders++
+		}
+	}
+	return loaded, nil
+}
+
+//record an amendment and increment the version of the plan.
+func (dplan *FuelDeliveryPlan) amend(a Amendment) {
+	dplan.Version++
+	a.Version = dplan.Version
+	dplan.Amendments = append(dplan.Amendments, a)
+}
+
+func putPlan(stub shim.ChaincodeStubInterface, planID string, dplan FuelDeliveryPlan) error {
+	dplanAsBytes, _ := json.Marshal(dplan)
+	if err := PutAsset(stub, planID, dplanAsBytes); err != nil {
+		return fmt.Errorf("Failed to put %s in db", planID)
+	}
+	return nil
+}
+
+/*
+Add orders to an open plan.
+args[0] = PlanID
+args[1] = timestamp
+args[2:] = {FuelOrderID,EstTime,Sloc,Dest}...
+*/
+func (s *SmartContract) addPlanOrders(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) < 6 || (len(args)-2)%4 != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting PlanID,timestamp and {FuelOrderID,EstTime,Sloc,Dest}...")
+	}
+	caller, err := GetCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	Timestamp, err := TrustedTime(stub, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	planID := args[0]
+	dplan, err := getOpenPlan(stub, caller, planID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	loaded, err := loadedOrders(stub, dplan, planID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	planned, err := ValidatePlan(stub, caller, "addPlanOrders", dplan.Veh.ID, args[2:], loaded, planID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ev := NewEvent(stub, EventPlanAmended)
+	for _, p := range planned {
+		fuelOrder := p.FuelOrder
+		ev.AddChange(p.ID, fuelOrder.AD.State, p.To, fuelOrder.AD.Owner)
+		fuelOrder.AD.State = p.To
+		fuelOrderAsBytes, _ := json.Marshal(fuelOrder)
+		if err = PutAsset(stub, p.ID, fuelOrderAsBytes); err != nil {
+			return shim.Error(fmt.Sprintf("Failed to put %s in db", p.ID))
+		}
+		dplan.amend(Amendment{Action: "addPlanOrders", Org: caller.Org, Time: Timestamp, FuelOrderID: p.ID,
+			To: p.DD.EstTime.Format(time.RFC3339)})
+		p.DD.ETAVersion = dplan.Version
+		dplan.Plan[p.ID] = p.DD
+	}
+	if err = putPlan(stub, planID, dplan); err != nil {
+		return shim.Error(err.Error())
+	}
+	ev.SetPlan(planID, dplan.Version)
+	if err = ev.Emit(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+/*
+Remove an order that is ON_WAY from an open plan. The order is READY_FOR_DISTRIBUTION again.
+args[0] = PlanID
+args[1] = FuelOrderID
+args[2] = reason
+args[3] = timestamp
+*/
+func (s *SmartContract) removePlanOrder(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+	caller, err := GetCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if strings.TrimSpace(args[2]) == "" {
+		return shim.Error("Reason of the amendment is missing")
+	}
+	Timestamp, err := TrustedTime(stub, args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	planID, id := args[0], args[1]
+	dplan, err := getOpenPlan(stub, caller, planID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fuelOrder, err := getPlanOrder(stub, dplan, planID, id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	t, err := CheckTransition(caller, "FuelOrder", "removePlanOrder", fuelOrder.AD.State, fuelOrder.AD.Owner, fuelOrder.Dest)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ev := NewEvent(stub, EventPlanAmended)
+	ev.AddChange(id, fuelOrder.AD.State, t.To, fuelOrder.AD.Owner)
+	fuelOrder.AD.State = t.To
+	fuelOrderAsBytes, _ := json.Marshal(fuelOrder)
+	if err = PutAsset(stub, id, fuelOrderAsBytes); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to put %s in db", id))
+	}
+	dplan.amend(Amendment{Action: "removePlanOrder", Org: caller.Org, Time: Timestamp, Reason: args[2], FuelOrderID: id,
+		From: dplan.Plan[id].EstTime.Format(time.RFC3339)})
+	delete(dplan.Plan, id)
+	if err = putPlan(stub, planID, dplan); err != nil {
+		return shim.Error(err.Error())
+	}
+	ev.SetPlan(planID, dplan.Version)
+	if err = ev.Emit(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+/*
+Change the EstTime of an order that is ON_WAY, before the current EstTime has passed.
+args[0] = PlanID
+args[1] = FuelOrderID
+args[2] = new EstTime
+args[3] = reason code, one of ETAReasons
+args[4] = timestamp
+*/
+func (s *SmartContract) reschedulePlanOrder(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 5")
+	}
+	caller, err := GetCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	estTime, err := time.Parse(time.RFC3339, args[2])
+	if err != nil {
+		return shim.Error("EstTime is not in RFC3339 format")
+	}
+	known := false
+	for _, reason := range ETAReasons {
+		known = known || args[3] == reason
+	}
+	if known == false {
+		return shim.Error(fmt.Sprintf("Reason code should be one of %s", strings.Join(ETAReasons, ",")))
+	}
+	Timestamp, err := TrustedTime(stub, args[4])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	planID, id := args[0], args[1]
+	dplan, err := getOpenPlan(stub, caller, planID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fuelOrder, err := getPlanOrder(stub, dplan, planID, id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if fuelOrder.AD.State != StateOnWay {
+		return shim.Error(fmt.Sprintf("Only an order that is ON_WAY can be rescheduled. %s is %s", id, fuelOrder.AD.State))
+	}
+	dd := dplan.Plan[id]
+	if Timestamp.After(dd.EstTime) {
+		return shim.Error(fmt.Sprintf("EstTime %s of %s has passed. A late order can't be rescheduled",
+			dd.EstTime.Format(time.RFC3339), id))
+	}
+	if estTime.Before(Timestamp) {
+		return shim.Error("New EstTime should be after the transaction time")
+	}
+	dplan.amend(Amendment{Action: "reschedulePlanOrder", Org: caller.Org, Time: Timestamp, Reason: args[3], FuelOrderID: id,
+		From: dd.EstTime.Format(time.RFC3339), To: estTime.Format(time.RFC3339)})
+	dd.EstTime = estTime
+	dd.ETAVersion = dplan.Version
+	dplan.Plan[id] = dd
+	if err = putPlan(stub, planID, dplan); err != nil {
+		return shim.Error(err.Error())
+	}
+	ev := NewEvent(stub, EventPlanAmended)
+	ev.SetPlan(planID, dplan.Version)
+	if err = ev.Emit(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+/*
+Put the orders of an open plan on another truck.
+args[0] = PlanID
+args[1] = TruckID
+args[2] = reason
+args[3] = timestamp
+*/
+func (s *SmartContract) swapPlanVehicle(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+	caller, err := GetCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if strings.TrimSpace(args[1]) == "" {
+		return shim.Error("TruckID is missing")
+	}
+	if strings.TrimSpace(args[2]) == "" {
+		return shim.Error("Reason of the amendment is missing")
+	}
+	Timestamp, err := TrustedTime(stub, args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	planID := args[0]
+	dplan, err := getOpenPlan(stub, caller, planID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if args[1] == dplan.Veh.ID {
+		return shim.Error(fmt.Sprintf("%s is already on %s", planID, args[1]))
+	}
+	loaded, err := loadedOrders(stub, dplan, planID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	truck, err := GetVehicle(stub, "Truck", args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	problems, err := CheckVehicle(stub, truck, "Truck", args[1], caller.Org, loaded, planID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if problems != nil {
+		return shim.Error(strings.Join(problems, ". "))
+	}
+	if err = ReleaseVehicle(stub, "Truck", dplan.Veh.ID, planID); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = AssignVehicle(stub, truck, planID); err != nil {
+		return shim.Error(err.Error())
+	}
+	dplan.amend(Amendment{Action: "swapPlanVehicle", Org: caller.Org, Time: Timestamp, Reason: args[2],
+		From: dplan.Veh.ID, To: args[1]})
+	dplan.Veh = NewVehicle("Truck", args[1])
+	if err = putPlan(stub, planID, dplan); err != nil {
+		return shim.Error(err.Error())
+	}
+	ev := NewEvent(stub, EventPlanAmended)
+	ev.SetPlan(planID, dplan.Version)
+	if err = ev.Emit(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+/*
+Close a plan that has no orders ON_WAY.
+args[0] = PlanID
+args[1] = timestamp
+*/
+func (s *SmartContract) closePlan(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	caller, err := GetCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	Timestamp, err := TrustedTime(stub, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	planID := args[0]
+	dplan, err := getOpenPlan(stub, caller, planID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	loaded, err := loadedOrders(stub, dplan, planID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if loaded.Orders > 0 {
+		return shim.Error(fmt.Sprintf("%s has orders ON_WAY. Remove them or declare their arrival first", planID))
+	}
+	dplan.amend(Amendment{Action: "closePlan", Org: caller.Org, Time: Timestamp})
+	dplan.Closed = true
+	if err = ReleaseVehicle(stub, "Truck", dplan.Veh.ID, planID); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = putPlan(stub, planID, dplan); err != nil {
+		return shim.Error(err.Error())
+	}
+	ev := NewEvent(stub, EventPlanClosed)
+	ev.SetPlan(planID, dplan.Version)
+	if err = ev.Emit(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//every mismatch of a plan is reported in one PlanError.
+func TestValidatePlan(t *testing.T) {
+	stub, ids := newTestPlan(t)
+	now := testNow()
+	est := testLater()
+	mustInvoke(t, stub, "Org4MSP", "registerVehicle", "Truck", "T5", "15", "3", est)
+	first := mustOrder(t, stub, "5", "10", "org3", "org5", ids.Fuel, now)
+	second := mustOrder(t, stub, "5", "10", "org3", "org6", ids.Fuel, now)
+	third := mustOrder(t, stub, "2", "5", "org3", "org5", ids.Fuel, now)
+	res := invoke(stub, "Org4MSP", "deliverFuel", "T5",
+		first, est, "org3", "org5",
+		first, est, "org3", "org5",
+		second, est, "org4", "org5",
+		ids.FuelOrder, est, "org3", "org5",
+		"FuelOrder99999999", est, "org3", "org5",
+		third, "soon", "org3", "org5")
+	if res.Status == shim.OK {
+		t.Fatal("deliverFuel should fail")
+	}
+	planErr := PlanError{}
+	if err := json.Unmarshal([]byte(res.Message), &planErr); err != nil {
+		t.Fatalf("Error should be a PlanError: %s", res.Message)
+	}
+	want := []FieldError{
+		{"Deliveries[1].FuelOrderID", first + " is already in Deliveries[0]"},
+		{"Deliveries[2].StartingLocation", "org4 should be the refiner org3 that owns " + second},
+		{"Deliveries[2].Destination", "org5 should be the destination org6 of " + second},
+		{"Deliveries[3].FuelOrderID", ids.FuelOrder + ": Cannot deliverFuel a FuelOrder that is ON_WAY"},
+		{"Deliveries[3].FuelOrderID", ids.FuelOrder + " is already in " + ids.Plan},
+		{"Deliveries[4].FuelOrderID", "FuelOrderID FuelOrder99999999 does not exist"},
+		{"Deliveries[5]", "Time is not in RFC3339 format"},
+		{"TruckID", "Total quantity 55 exceeds the capacity 15 of Truck T5"},
+		{"TruckID", "4 orders exceed the 3 compartments of Truck T5"},
+	}
+	if planErr.TruckID != "T5" || len(planErr.Errors) != len(want) {
+		t.Fatalf("Wrong plan error: %s", res.Message)
+	}
+	for i, e := range want {
+		if planErr.Errors[i] != e {
+			t.Fatalf("Error %d should be %+v and not %+v", i, e, planErr.Errors[i])
+		}
+	}
+	planID := mustInvoke(t, stub, "Org4MSP", "deliverFuel", "T2", first, est, "org3", "org5", third, est, "org3", "org5")
+	if plan, err := PlanOfOrder(stub, third); err != nil || plan != planID {
+		t.Fatalf("%s should be in %s and not in '%s' (%v)", third, planID, plan, err)
+	}
+	mustFail(t, stub, first+" is already in "+planID, "Org4MSP", "deliverFuel", "T3", first, est, "org3", "org5")
+}
+
+func getTestPlan(t *testing.T, stub *shim.MockStub, planID string) FuelDeliveryPlan {
+	t.Helper()
+	dplan := FuelDeliveryPlan{}
+	getTestState(t, stub, planID, &dplan)
+	return dplan
+}
+
+//add, reschedule and remove orders, swap the truck and close the plan.
+func TestPlanAmendments(t *testing.T) {
+	stub, ids := newTestPlan(t)
+	now := testNow()
+	est := testLater()
+	past := time.Now().UTC().Add(-time.Hour).Format(time.RFC3339)
+	added := mustOrder(t, stub, "5", "10", "org3", "org5", ids.Fuel, now)
+	late := mustOrder(t, stub, "2", "5", "org3", "org6", ids.Fuel, now)
+	runErrorCases(t, stub, []errorCase{
+		{"not the carrier", "Org5MSP", []string{"addPlanOrders", ids.Plan, now, added, est, "org3", "org5"}, "Only the org4 that made"},
+		{"plan doesn't exist", "Org4MSP", []string{"addPlanOrders", "Plan99999999", now, added, est, "org3", "org5"}, "Could not locate Plan"},
+		{"order of the plan", "Org4MSP", []string{"addPlanOrders", ids.Plan, now, ids.FuelOrder, est, "org3", "org5"}, "is already in " + ids.Plan},
+		{"wrong destination", "Org4MSP", []string{"addPlanOrders", ids.Plan, now, added, est, "org3", "org6"}, "Deliveries[0].Destination"},
+	})
+	mustInvoke(t, stub, "Org4MSP", "addPlanOrders", ids.Plan, now, added, est, "org3", "org5", late, past, "org3", "org6")
+	dplan := getTestPlan(t, stub, ids.Plan)
+	if dplan.Version != 3 || dplan.Plan[added].ETAVersion != 2 || dplan.Plan[late].ETAVersion != 3 {
+		t.Fatalf("Plan should be at version 3 after adding 2 orders: %+v", dplan)
+	}
+	runErrorCases(t, stub, []errorCase{
+		{"unknown reason code", "Org4MSP", []string{"reschedulePlanOrder", ids.Plan, added, est, "LUNCH", now}, "Reason code should be one of"},
+		{"ETA in the past", "Org4MSP", []string{"reschedulePlanOrder", ids.Plan, added, past, "TRAFFIC", now}, "should be after the transaction time"},
+		{"late order", "Org4MSP", []string{"reschedulePlanOrder", ids.Plan, late, est, "TRAFFIC", now}, "A late order can't be rescheduled"},
+		{"order not in the plan", "Org4MSP", []string{"reschedulePlanOrder", ids.Plan, ids.Fuel, est, "TRAFFIC", now}, "is not in " + ids.Plan},
+		{"remove without reason", "Org4MSP", []string{"removePlanOrder", ids.Plan, late, " ", now}, "Reason of the amendment is missing"},
+		{"close with orders on their way", "Org4MSP", []string{"closePlan", ids.Plan, now}, "has orders ON_WAY"},
+		{"same truck", "Org4MSP", []string{"swapPlanVehicle", ids.Plan, "T1", "breakdown", now}, "is already on T1"},
+	})
+	later := time.Now().UTC().Add(2 * time.Hour).Format(time.RFC3339)
+	mustInvoke(t, stub, "Org4MSP", "reschedulePlanOrder", ids.Plan, added, later, "BREAKDOWN", now)
+	mustInvoke(t, stub, "Org4MSP", "removePlanOrder", ids.Plan, late, "station closed", now)
+	mustInvoke(t, stub, "Org4MSP", "swapPlanVehicle", ids.Plan, "T9", "breakdown", now)
+	fuelOrder := FuelOrder{}
+	getTestState(t, stub, late, &fuelOrder)
+	if fuelOrder.AD.State != StateReady {
+		t.Fatalf("Removed order should be READY and not %s", fuelOrder.AD.State)
+	}
+	if plan, _ := PlanOfOrder(stub, late); plan != "" {
+		t.Fatalf("Removed order should not be in %s", plan)
+	}
+	mustInvoke(t, stub, "Org4MSP", "arrive", ids.FuelOrder, "30", now, ids.Plan)
+	mustInvoke(t, stub, "Org4MSP", "arrive", added, "10", now, ids.Plan)
+	mustInvoke(t, stub, "Org4MSP", "closePlan", ids.Plan, now)
+	dplan = getTestPlan(t, stub, ids.Plan)
+	if dplan.Closed == false || dplan.Version != 7 || dplan.Veh.ID != "T9" || len(dplan.Plan) != 2 {
+		t.Fatalf("Wrong closed plan: %+v", dplan)
+	}
+	if dd := dplan.Plan[added]; dd.ETAVersion != 4 || dd.EstTime.Format(time.RFC3339) != later || dd.Delay >= 0 {
+		t.Fatalf("Order should arrive before the rescheduled EstTime: %+v", dd)
+	}
+	actions := []string{}
+	for i, a := range dplan.Amendments {
+		if a.Version != i+2 || a.Org != "org4" {
+			t.Fatalf("Wrong amendment %d: %+v", i, a)
+		}
+		actions = append(actions, a.Action)
+	}
+	if strings.Join(actions, ",") != "addPlanOrders,addPlanOrders,reschedulePlanOrder,removePlanOrder,swapPlanVehicle,closePlan" {
+		t.Fatalf("Wrong amendments: %v", actions)
+	}
+	mustFail(t, stub, ids.Plan+" is closed", "Org4MSP", "swapPlanVehicle", ids.Plan, "T1", "fixed", now)
+}
+
+//the orders on the truck count against the capacity of the truck when orders are added.
+func TestAddPlanOrdersCapacity(t *testing.T) {
+	stub, ids := newTestPlan(t)
+	now := testNow()
+	mustInvoke(t, stub, "Org4MSP", "registerVehicle", "Truck", "T5", "35", "6", testLater())
+	mustInvoke(t, stub, "Org4MSP", "swapPlanVehicle", ids.Plan, "T5", "bigger truck is needed elsewhere", now)
+	order := mustOrder(t, stub, "5", "10", "org3", "org5", ids.Fuel, now)
+	mustFail(t, stub, "Total quantity 40 exceeds the capacity 35 of Truck T5", "Org4MSP", "addPlanOrders", ids.Plan, now, order, testLater(), "org3", "org5")
+	mustInvoke(t, stub, "Org4MSP", "arrive", ids.FuelOrder, "30", now, ids.Plan)
+	mustInvoke(t, stub, "Org4MSP", "addPlanOrders", ids.Plan, now, order, testLater(), "org3", "org5")
+}
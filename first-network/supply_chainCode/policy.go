@@ -0,0 +1,495 @@
+/*
+Pricing and penalty policy of the deliveries.
+
+The policy sets what the buyer of a delivery pays its carrier:
+	freight = FreightRate * received quantity - penalty of the delay + bonus of an early delivery
+and the freight can't be negative. A delay up to the GracePeriod costs nothing and the rest
+costs according to the penalty curve:
+	LINEAR - Rate per second of delay
+	STEP   - Rate per started Step of seconds
+	CAPPED - Rate per second of delay, at most Cap
+A delivery that is early earns Rate per second, at most Cap. The terms of the first override
+that matches the carrier and the route (starting location and destination) of a delivery
+replace the terms of the policy. Amounts of the policy are in cents.
+
+The policies are versioned and put in db with the composite key Policy~version and the
+current version is kept with key PolicyVersion. Version 0 is the policy built into the
+chaincode, which applies until a policy is approved.
+A participant proposes a policy with proposePolicy. The proposal is put in db with the composite
+key PolicyProposal~ID and becomes the next version when more than half of the ACTIVE
+participants have approved it with approvePolicy. The proposer approves its own proposal.
+transfer records the version of the policy that it applied in the Handover of the delivery.
+The escrow of a FuelOrder locks the most that its freight can cost under the current policy. If a
+policy that costs more is approved before the order is delivered, the buyer pays the difference.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	PolicyObjectType   = "Policy"
+	ProposalObjectType = "PolicyProposal"
+	PolicyVersionKey   = "PolicyVersion"
+)
+
+const (
+	CurveLinear = "LINEAR"
+	CurveStep   = "STEP"
+	CurveCapped = "CAPPED"
+)
+
+const (
+	ProposalPending  = "PENDING"
+	ProposalApproved = "APPROVED"
+)
+
+type PenaltyCurve struct {
+	Kind string
+	Rate Amount //per second of delay or per step
+	Step int64  `json:",omitempty"` //seconds of a STEP
+	Cap  Amount `json:",omitempty"` //most a CAPPED penalty costs
+}
+
+type EarlyBonus struct {
+	Rate Amount //per second that the delivery was early
+	Cap  Amount //most the bonus pays
+}
+
+type Terms struct {
+	FreightRate Amount //per unit of the received quantity
+	GracePeriod int64  //seconds of delay without penalty
+	Penalty     PenaltyCurve
+	EarlyBonus  EarlyBonus
+}
+
+//terms for the deliveries of a carrier and/or a route. Empty fields match anything.
+type PolicyOverride struct {
+	Carrier string `json:",omitempty"`
+	From    string `json:",omitempty"`
+	To      string `json:",omitempty"`
+	Terms   Terms
+}
+
+type PricingPolicy struct {
+	Version    int
+	Terms      Terms
+	Overrides  []PolicyOverride `json:",omitempty"`
+	ApprovedBy []string         `json:",omitempty"`
+	ApprovedAt time.Time
+}
+
+type PolicyProposal struct {
+	ID         string
+	Proposer   string
+	Policy     PricingPolicy //its Version is set when it's approved
+	Approvals  []string
+	Status     string
+	ProposedAt time.Time
+}
+
+//what transfer paid the carrier of a delivery and under which version of the policy.
+type AppliedPolicy struct {
+	Version int
+	Freight Amount
+	Penalty Amount
+	Bonus   Amount
+}
+
+//the freight and the penalty of the older versions of the chaincode.
+var DefaultPolicy = PricingPolicy{
+	Terms: Terms{
+		FreightRate: MinorUnits / 10,
+		Penalty:     PenaltyCurve{Kind: CurveLinear, Rate: 1},
+	},
+}
+
+//freight for delivering quantity without delays.
+func (t Terms) Freight(quantity int) Amount {
+	return Amount(quantity) * t.FreightRate
+}
+
+//the penalty of a delay in seconds. Early deliveries have no penalty.
+func (t Terms) DelayPenalty(delay float64) Amount {
+	late := delay - float64(t.GracePeriod)
+	if late <= 0 {
+		return 0
+	}
+	c := t.Penalty
+	switch c.Kind {
+	case CurveStep:
+		return c.Rate * Amount(math.Ceil(late/float64(c.Step)))
+	case CurveCapped:
+		penalty := Amount(math.Round(late * float64(c.Rate)))
+		if penalty > c.Cap {
+			return c.Cap
+		}
+		return penalty
+	default:
+		return Amount(math.Round(late * float64(c.Rate)))
+	}
+}
+
+//the bonus of a delay in seconds. Only early deliveries get one.
+func (t Terms) Bonus(delay float64) Amount {
+	if delay >= 0 {
+		return 0
+	}
+	bonus := Amount(math.Round(-delay * float64(t.EarlyBonus.Rate)))
+	if bonus > t.EarlyBonus.Cap {
+		return t.EarlyBonus.Cap
+	}
+	return bonus
+}
+
+//the terms for a carrier on a route. An empty carrier matches only the overrides of any carrier.
+func (p PricingPolicy) TermsFor(carrier, from, to string) Terms {
+	for _, o := range p.Overrides {
+		if (o.Carrier == "" || o.Carrier == carrier) && (o.From == "" || o.From == from) && (o.To == "" || o.To == to) {
+			return o.Terms
+		}
+	}
+	return p.Terms
+}
+
+//the most the freight of quantity on a route can cost, whoever carries it.
+func (p PricingPolicy) MaxFreight(from, to string, quantity int) Amount {
+	terms := []Terms{p.Terms}
+	for _, o := range p.Overrides {
+		if (o.From == "" || o.From == from) && (o.To == "" || o.To == to) {
+			terms = append(terms, o.Terms)
+		}
+	}
+	var max Amount
+	for _, t := range terms {
+		if fee := t.Freight(quantity) + t.EarlyBonus.Cap; fee > max {
+			max = fee
+		}
+	}
+	return max
+}
+
+//what the carrier of a delivery on a route is paid for the received quantity and the delay.
+func (p PricingPolicy) Apply(carrier, from, to string, received int, delay float64) AppliedPolicy {
+	t := p.TermsFor(carrier, from, to)
+	applied := AppliedPolicy{p.Version, 0, t.DelayPenalty(delay), t.Bonus(delay)}
+	applied.Freight = t.Freight(received) - applied.Penalty + applied.Bonus
+	if applied.Freight < 0 {
+		applied.Freight = 0
+	}
+	return applied
+}
+
+func (t Terms) validate(field string) error {
+	if t.FreightRate < 0 {
+		return fmt.Errorf("%s.FreightRate should not be negative", field)
+	}
+	if t.GracePeriod < 0 {
+		return fmt.Errorf("%s.GracePeriod should not be negative", field)
+	}
+	c := t.Penalty
+	if c.Kind != CurveLinear && c.Kind != CurveStep && c.Kind != CurveCapped {
+		return fmt.Errorf("%s.Penalty.Kind should be one of {%s,%s,%s}", field, CurveLinear, CurveStep, CurveCapped)
+	}
+	if c.Rate < 0 || c.Cap < 0 {
+		return fmt.Errorf("%s.Penalty should not have a negative Rate or Cap", field)
+	}
+	if c.Kind == CurveStep && c.Step <= 0 {
+		return fmt.Errorf("%s.Penalty.Step should be a positive number of seconds", field)
+	}
+	if t.EarlyBonus.Rate < 0 || t.EarlyBonus.Cap < 0 {
+		return fmt.Errorf("%s.EarlyBonus should not have a negative Rate or Cap", field)
+	}
+	return nil
+}
+
+//parse and check the JSON document of a proposed policy.
+func ParsePolicy(doc string) (PricingPolicy, error) {
+	p := PricingPolicy{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(doc)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&p); err != nil {
+		return PricingPolicy{}, fmt.Errorf("Policy is not a valid JSON document: %s", err.Error())
+	}
+	if err := p.Terms.validate("Terms"); err != nil {
+		return PricingPolicy{}, err
+	}
+	for i, o := range p.Overrides {
+		field := fmt.Sprintf("Overrides[%d]", i)
+		if o.Carrier == "" && o.From == "" && o.To == "" {
+			return PricingPolicy{}, fmt.Errorf("%s should have a Carrier, From or To", field)
+		}
+		for _, org := range []string{o.Carrier, o.From, o.To} {
+			if org != "" && HasPrefixOrg(org) == false {
+				return PricingPolicy{}, fmt.Errorf("%s has %s which is not prefixed with 'org'", field, org)
+			}
+		}
+		if err := o.Terms.validate(field + ".Terms"); err != nil {
+			return PricingPolicy{}, err
+		}
+	}
+	//the version and the approvals are set by approvePolicy.
+	p.Version = 0
+	p.ApprovedBy = nil
+	p.ApprovedAt = time.Time{}
+	return p, nil
+}
+
+func policyKey(stub shim.ChaincodeStubInterface, version int) (string, error) {
+	key, err := stub.CreateCompositeKey(PolicyObjectType, []string{fmt.Sprintf("%0*d", idDigits, version)})
+	if err != nil {
+		return "", fmt.Errorf("Failed to create key of policy version %d: %s", version, err.Error())
+	}
+	return key, nil
+}
+
+//the current policy, or DefaultPolicy if none has been approved.
+func GetPolicy(stub shim.ChaincodeStubInterface) (PricingPolicy, error) {
+	versionAsBytes, err := stub.GetState(PolicyVersionKey)
+	if err != nil {
+		return PricingPolicy{}, fmt.Errorf("Failed to get the policy version: %s", err.Error())
+	}
+	if versionAsBytes == nil {
+		return DefaultPolicy, nil
+	}
+	version, err := strconv.Atoi(string(versionAsBytes))
+	if err != nil {
+		return PricingPolicy{}, fmt.Errorf("Failed to decode the policy version")
+	}
+	return GetPolicyVersion(stub, version)
+}
+
+func GetPolicyVersion(stub shim.ChaincodeStubInterface, version int) (PricingPolicy, error) {
+	if version == 0 {
+		return DefaultPolicy, nil
+	}
+	key, err := policyKey(stub, version)
+	if err != nil {
+		return PricingPolicy{}, err
+	}
+	policyAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return PricingPolicy{}, fmt.Errorf("Failed to get policy version %d: %s", version, err.Error())
+	}
+	if policyAsBytes == nil {
+		return PricingPolicy{}, fmt.Errorf("Policy version %d does not exist", version)
+	}
+	p := PricingPolicy{}
+	if err = json.Unmarshal(policyAsBytes, &p); err != nil {
+		return PricingPolicy{}, fmt.Errorf("Failed to decode policy version %d", version)
+	}
+	return p, nil
+}
+
+//put a policy in db as the current version.
+func putPolicy(stub shim.ChaincodeStubInterface, p PricingPolicy) error {
+	key, err := policyKey(stub, p.Version)
+	if err != nil {
+		return err
+	}
+	policyAsBytes, _ := json.Marshal(p)
+	if err = stub.PutState(key, policyAsBytes); err != nil {
+		return fmt.Errorf("Failed to put policy version %d in db", p.Version)
+	}
+	if err = stub.PutState(PolicyVersionKey, []byte(strconv.Itoa(p.Version))); err != nil {
+		return fmt.Errorf("Failed to put the policy version in db")
+	}
+	return nil
+}
+
+func proposalKey(stub shim.ChaincodeStubInterface, id string) (string, error) {
+	key, err := stub.CreateCompositeKey(ProposalObjectType, []string{id})
+	if err != nil {
+		return "", fmt.Errorf("Failed to create key of %s: %s", id, err.Error())
+	}
+	return key, nil
+}
+
+func GetProposal(stub shim.ChaincodeStubInterface, id string) (PolicyProposal, error) {
+	key, err := proposalKey(stub, id)
+	if err != nil {
+		return PolicyProposal{}, err
+	}
+	proposalAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return PolicyProposal{}, fmt.Errorf("Failed to get %s: %s", id, err.Error())
+	}
+	if proposalAsBytes == nil {
+		return PolicyProposal{}, fmt.Errorf("Could not locate %s", id)
+	}
+	proposal := PolicyProposal{}
+	if err = json.Unmarshal(proposalAsBytes, &proposal); err != nil {
+		return PolicyProposal{}, fmt.Errorf("Failed to decode %s", id)
+	}
+	return proposal, nil
+}
+
+func putProposal(stub shim.ChaincodeStubInterface, proposal PolicyProposal) error {
+	key, err := proposalKey(stub, proposal.ID)
+	if err != nil {
+		return err
+	}
+	proposalAsBytes, _ := json.Marshal(proposal)
+	if err = stub.PutState(key, proposalAsBytes); err != nil {
+		return fmt.Errorf("Failed to put %s in db", proposal.ID)
+	}
+	return nil
+}
+
+/*
+Approve a proposal on behalf of org and make it the next version of the policy
+if more than half of the ACTIVE participants have approved it.
+*/
+func approveProposal(stub shim.ChaincodeStubInterface, proposal *PolicyProposal, org string) error {
+	for _, approver := range proposal.Approvals {
+		if approver == org {
+			return fmt.Errorf("%s has approved %s already", org, proposal.ID)
+		}
+	}
+	proposal.Approvals = append(proposal.Approvals, org)
+	participants, err := GetParticipants(stub)
+	if err != nil {
+		return err
+	}
+	//approvals of orgs that are no longer ACTIVE don't count.
+	active, approved := 0, []string{}
+	for _, p := range participants {
+		if p.Status != ParticipantActive {
+			continue
+		}
+		active++
+		for _, approver := range proposal.Approvals {
+			if approver == p.Org {
+				approved = append(approved, p.Org)
+			}
+		}
+	}
+	if 2*len(approved) <= active {
+		return putProposal(stub, *proposal)
+	}
+	current, err := GetPolicy(stub)
+	if err != nil {
+		return err
+	}
+	txTime, err := TxTime(stub)
+	if err != nil {
+		return err
+	}
+	proposal.Status = ProposalApproved
+	proposal.Policy.Version = current.Version + 1
+	proposal.Policy.ApprovedBy = approved
+	proposal.Policy.ApprovedAt = txTime
+	if err = putPolicy(stub, proposal.Policy); err != nil {
+		return err
+	}
+	return putProposal(stub, *proposal)
+}
+
+/*
+A participant proposes the next policy. Returns the ID of the proposal.
+args[0] = policy, a JSON document of its Terms and Overrides, e.g.
+	{"Terms":{"FreightRate":10,"GracePeriod":600,"Penalty":{"Kind":"CAPPED","Rate":1,"Cap":2000},
+	"EarlyBonus":{"Rate":0,"Cap":0}},"Overrides":[{"Carrier":"org4","To":"org6","Terms":{...}}]}
+args[1] = timestamp
+*/
+func (s *SmartContract) proposePolicy(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	caller, err := GetCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	policy, err := ParsePolicy(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	Timestamp, err := TrustedTime(stub, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	id, err := NextID(stub, "Proposal")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	proposal := PolicyProposal{ID: id, Proposer: caller.Org, Policy: policy, Status: ProposalPending, ProposedAt: Timestamp}
+	if err = approveProposal(stub, &proposal, caller.Org); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(id))
+}
+
+/*
+A participant approves a pending proposal.
+args[0] = ID of the proposal
+*/
+func (s *SmartContract) approvePolicy(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	caller, err := GetCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	proposal, err := GetProposal(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if proposal.Status != ProposalPending {
+		return shim.Error(fmt.Sprintf("%s is %s", proposal.ID, proposal.Status))
+	}
+	if err = approveProposal(stub, &proposal, caller.Org); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+/*
+The current policy or the given version of it.
+args[0] = version (optional)
+*/
+func (s *SmartContract) queryPolicy(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1")
+	}
+	var policy PricingPolicy
+	var err error
+	if len(args) == 0 {
+		policy, err = GetPolicy(stub)
+	} else {
+		version, convErr := strconv.Atoi(args[0])
+		if convErr != nil || version < 0 {
+			return shim.Error("Version is not a non negative int number")
+		}
+		policy, err = GetPolicyVersion(stub, version)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	policyAsBytes, _ := json.Marshal(policy)
+	return shim.Success(policyAsBytes)
+}
+
+/*
+args[0] = ID of the proposal
+*/
+func (s *SmartContract) queryPolicyProposal(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	proposal, err := GetProposal(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	proposalAsBytes, _ := json.Marshal(proposal)
+	return shim.Success(proposalAsBytes)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//propose a policy as org1 and approve it as org2, org3 and org4, which are more than half of the six orgs.
+func approveTestPolicy(t *testing.T, stub *shim.MockStub, doc string) string {
+	t.Helper()
+	id := mustInvoke(t, stub, "Org1MSP", "proposePolicy", doc, testNow())
+	for _, msp := range []string{"Org2MSP", "Org3MSP", "Org4MSP"} {
+		mustInvoke(t, stub, msp, "approvePolicy", id)
+	}
+	return id
+}
+
+func getTestPolicy(t *testing.T, stub *shim.MockStub, args ...string) PricingPolicy {
+	t.Helper()
+	policy := PricingPolicy{}
+	if err := json.Unmarshal([]byte(mustInvoke(t, stub, "Org1MSP", append([]string{"queryPolicy"}, args...)...)), &policy); err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+func TestPolicyTerms(t *testing.T) {
+	terms := Terms{FreightRate: 20, GracePeriod: 60, EarlyBonus: EarlyBonus{Rate: 2, Cap: 100}}
+	cases := []struct {
+		curve PenaltyCurve
+		delay float64
+		want  Amount
+	}{
+		{PenaltyCurve{Kind: CurveLinear, Rate: 1}, 30, 0},
+		{PenaltyCurve{Kind: CurveLinear, Rate: 1}, 360, 300},
+		{PenaltyCurve{Kind: CurveStep, Rate: 500, Step: 600}, 61, 500},
+		{PenaltyCurve{Kind: CurveStep, Rate: 500, Step: 600}, 1260, 1000},
+		{PenaltyCurve{Kind: CurveCapped, Rate: 1, Cap: 200}, 160, 100},
+		{PenaltyCurve{Kind: CurveCapped, Rate: 1, Cap: 200}, 3600, 200},
+		{PenaltyCurve{Kind: CurveCapped, Rate: 1, Cap: 200}, -3600, 0},
+	}
+	for _, c := range cases {
+		terms.Penalty = c.curve
+		if penalty := terms.DelayPenalty(c.delay); penalty != c.want {
+			t.Errorf("%s penalty of %.0f seconds should be %s and not %s", c.curve.Kind, c.delay, c.want, penalty)
+		}
+	}
+	if bonus := terms.Bonus(-30); bonus != 60 {
+		t.Errorf("30 seconds early should earn 0.60 and not %s", bonus)
+	}
+	if bonus := terms.Bonus(-3600); bonus != 100 {
+		t.Errorf("Bonus should be capped at 1.00 and not %s", bonus)
+	}
+	policy := PricingPolicy{Terms: terms, Overrides: []PolicyOverride{
+		{Carrier: "org4", To: "org6", Terms: Terms{FreightRate: 50, Penalty: PenaltyCurve{Kind: CurveLinear}}},
+		{To: "org6", Terms: Terms{FreightRate: 30, Penalty: PenaltyCurve{Kind: CurveLinear}}},
+	}}
+	for _, c := range []struct {
+		carrier, to string
+		rate        Amount
+	}{{"org4", "org6", 50}, {"org7", "org6", 30}, {"org4", "org5", 20}} {
+		if terms := policy.TermsFor(c.carrier, "org3", c.to); terms.FreightRate != c.rate {
+			t.Errorf("Rate of %s to %s should be %s and not %s", c.carrier, c.to, c.rate, terms.FreightRate)
+		}
+	}
+	if fee := policy.MaxFreight("org3", "org6", 10); fee != 500 {
+		t.Errorf("Most the freight to org6 can cost is 5.00 and not %s", fee)
+	}
+	if fee := policy.MaxFreight("org3", "org5", 10); fee != 300 {
+		t.Errorf("Most the freight to org5 can cost is 3.00 with the bonus and not %s", fee)
+	}
+}
+
+//a proposal becomes the next version of the policy when more than half of the active orgs approve it.
+func TestPolicyApproval(t *testing.T) {
+	stub := newTestStub(t)
+	doc := `{"Terms":{"FreightRate":20,"GracePeriod":600,"Penalty":{"Kind":"STEP","Rate":500,"Step":900}}}`
+	runErrorCases(t, stub, []errorCase{
+		{"not JSON", "Org2MSP", []string{"proposePolicy", "cheap", testNow()}, "Policy is not a valid JSON document"},
+		{"unknown field", "Org2MSP", []string{"proposePolicy", `{"Terms":{"Rate":1}}`, testNow()}, "unknown field"},
+		{"unknown curve", "Org2MSP", []string{"proposePolicy", `{"Terms":{"Penalty":{"Kind":"EXPONENTIAL"}}}`, testNow()}, "Terms.Penalty.Kind should be one of"},
+		{"step without seconds", "Org2MSP", []string{"proposePolicy", `{"Terms":{"Penalty":{"Kind":"STEP","Rate":1}}}`, testNow()}, "Terms.Penalty.Step should be a positive"},
+		{"negative rate", "Org2MSP", []string{"proposePolicy", `{"Terms":{"FreightRate":-1,"Penalty":{"Kind":"LINEAR"}}}`, testNow()}, "Terms.FreightRate should not be negative"},
+		{"override of anything", "Org2MSP", []string{"proposePolicy", `{"Terms":{"Penalty":{"Kind":"LINEAR"}},"Overrides":[{"Terms":{}}]}`, testNow()}, "Overrides[0] should have a Carrier, From or To"},
+		{"override of a truck", "Org2MSP", []string{"proposePolicy", `{"Terms":{"Penalty":{"Kind":"LINEAR"}},"Overrides":[{"Carrier":"T1","Terms":{}}]}`, testNow()}, "Overrides[0] has T1"},
+		{"bad override terms", "Org2MSP", []string{"proposePolicy", `{"Terms":{"Penalty":{"Kind":"LINEAR"}},"Overrides":[{"To":"org6","Terms":{}}]}`, testNow()}, "Overrides[0].Terms.Penalty.Kind"},
+		{"unknown proposal", "Org2MSP", []string{"approvePolicy", "Proposal99999999"}, "Could not locate Proposal99999999"},
+	})
+	id := mustInvoke(t, stub, "Org2MSP", "proposePolicy", doc, testNow())
+	mustFail(t, stub, "org2 has approved "+id+" already", "Org2MSP", "approvePolicy", id)
+	mustInvoke(t, stub, "Org3MSP", "approvePolicy", id)
+	mustInvoke(t, stub, "Org4MSP", "approvePolicy", id)
+	if policy := getTestPolicy(t, stub); policy.Version != 0 || policy.Terms.FreightRate != MinorUnits/10 {
+		t.Fatalf("3 of 6 orgs are not a majority: %+v", policy)
+	}
+	mustInvoke(t, stub, "Org5MSP", "approvePolicy", id)
+	policy := getTestPolicy(t, stub)
+	if policy.Version != 1 || policy.Terms.GracePeriod != 600 || len(policy.ApprovedBy) != 4 {
+		t.Fatalf("Wrong policy: %+v", policy)
+	}
+	mustFail(t, stub, id+" is APPROVED", "Org6MSP", "approvePolicy", id)
+	if old := getTestPolicy(t, stub, "0"); old.Terms.Penalty.Kind != CurveLinear {
+		t.Fatalf("Version 0 should be the default policy: %+v", old)
+	}
+	mustFail(t, stub, "Policy version 2 does not exist", "Org1MSP", "queryPolicy", "2")
+
+	//the approvals of suspended orgs don't count.
+	setTestRegistrar(t, stub, "org1")
+	next := mustInvoke(t, stub, "Org2MSP", "proposePolicy", doc, testNow())
+	mustInvoke(t, stub, "Org3MSP", "approvePolicy", next)
+	mustInvoke(t, stub, "Org1MSP", "suspendParticipant", "Org3MSP", "audit")
+	mustInvoke(t, stub, "Org4MSP", "approvePolicy", next)
+	if policy = getTestPolicy(t, stub); policy.Version != 1 {
+		t.Fatalf("2 of 5 active orgs are not a majority: %+v", policy)
+	}
+	mustInvoke(t, stub, "Org5MSP", "approvePolicy", next)
+	if policy = getTestPolicy(t, stub); policy.Version != 2 {
+		t.Fatalf("3 of 5 active orgs are a majority: %+v", policy)
+	}
+}
+
+//transfer pays the carrier by the current policy and records its version.
+func TestTransferAppliesPolicy(t *testing.T) {
+	stub, ids := newTestPlan(t)
+	now := testNow()
+	approveTestPolicy(t, stub, `{"Terms":{"FreightRate":20,"Penalty":{"Kind":"LINEAR","Rate":1},"EarlyBonus":{"Rate":1,"Cap":500}},
+		"Overrides":[{"Carrier":"org2","Terms":{"FreightRate":30,"GracePeriod":600,"Penalty":{"Kind":"LINEAR","Rate":1}}}]}`)
+
+	//5 minutes late is within the grace period of org2.
+	est := time.Now().UTC().Add(-5 * time.Minute).Format(time.RFC3339)
+	crudeID := mustInvoke(t, stub, "Org1MSP", "deliverCrude", "50", "100", "org1", est, "org1", "org3", "V2", now)
+	mustInvoke(t, stub, "Org2MSP", "arrive", crudeID, "100", now)
+	mustInvoke(t, stub, "Org3MSP", "transfer", crudeID, "org3", now)
+	crude := Crude{}
+	getTestState(t, stub, crudeID, &crude)
+	if p := crude.Handover.Pricing; p == nil || *p != (AppliedPolicy{1, 3000, 0, 0}) {
+		t.Fatalf("Crude should be paid 30.00 under version 1: %+v", p)
+	}
+
+	//the order was added under version 0, so org5 pays the difference of the freight from its balance.
+	mustInvoke(t, stub, "Org4MSP", "arrive", ids.FuelOrder, "30", now, ids.Plan)
+	mustInvoke(t, stub, "Org5MSP", "transfer", ids.FuelOrder, "org5", now, ids.Plan)
+	fuelOrder := FuelOrder{}
+	getTestState(t, stub, ids.FuelOrder, &fuelOrder)
+	if p := fuelOrder.Handover.Pricing; p == nil || *p != (AppliedPolicy{1, 1100, 0, 500}) {
+		t.Fatalf("Order should be paid 6.00 and a bonus of 5.00 under version 1: %+v", p)
+	}
+	checkBalances(t, stub, map[string]Amount{
+		"org1": 10010000, "org2": 10004000, "org3": 9988050, "org4": 10001100, "org5": 9996850,
+	})
+	if balance := getTestBalance(t, stub, "org5"); balance.Locked != 0 {
+		t.Fatalf("Escrow of the order should be released: %+v", balance)
+	}
+
+	//the escrow of a new order covers the most the freight can cost under version 1.
+	mustOrder(t, stub, "5", "10", "org3", "org6", ids.Fuel, now)
+	if balance := getTestBalance(t, stub, "org6"); balance.Locked != 500+200+500 {
+		t.Fatalf("org6 should lock 5.00 of value, 2.00 of freight and 5.00 of bonus: %+v", balance)
+	}
+}
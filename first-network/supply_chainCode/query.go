@@ -0,0 +1,112 @@
+/*
+Helpers for the range queries over assets.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+Keys of an asset type are in [start,end).
+Fuel keys end before 'FuelOrder', so a range over fuels doesn't read the FuelOrders
+(IDs of the form FuelXXXX where X is a digit sort before 'FuelOrder').
+*/
+func AssetRange(typ string) (string, string) {
+	if typ == "Fuel" {
+		return "Fuel", "FuelOrder"
+	}
+	return typ, typ + "~"
+}
+
+/*
+Filter of a range query. Empty fields match everything.
+Dest is the destination of a Crude or FuelOrder.
+From and To limit the Timestamp of the asset.
+*/
+type AssetFilter struct {
+	Owner string
+	State string
+	Dest  string
+	From  time.Time
+	To    time.Time
+}
+
+//the fields of Crude, Fuel and FuelOrder that can be filtered.
+type filterView struct {
+	AD        AssetDetails
+	DD        DeliveryDetails
+	Dest      string
+	Timestamp time.Time
+}
+
+//parse filters of the form field=value (e.g. 'state=ON_WAY','from=2019-05-01T00:00:00Z').
+func NewAssetFilter(typ string, filters []string) (AssetFilter, error) {
+	f := AssetFilter{}
+	for _, filter := range filters {
+		kv := strings.SplitN(filter, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return AssetFilter{}, fmt.Errorf("Filter %s is not of the form field=value", filter)
+		}
+		var err error
+		switch kv[0] {
+		case "owner":
+			f.Owner = kv[1]
+		case "state":
+			f.State = kv[1]
+		case "dest":
+			f.Dest = kv[1]
+		case "from":
+			f.From, err = RFCtoTime(kv[1])
+		case "to":
+			f.To, err = RFCtoTime(kv[1])
+		default:
+			return AssetFilter{}, fmt.Errorf("Unknown filter %s. Should be one of {owner,state,dest,from,to}", kv[0])
+		}
+		if err != nil {
+			return AssetFilter{}, err
+		}
+	}
+	if typ == "Plan" && f.Empty() == false {
+		return AssetFilter{}, errors.New("Plans can't be filtered")
+	}
+	if typ == "Fuel" && f.Dest != "" {
+		return AssetFilter{}, errors.New("Fuels don't have a destination")
+	}
+	return f, nil
+}
+
+func (f AssetFilter) Empty() bool {
+	return f == AssetFilter{}
+}
+
+func (f AssetFilter) Match(value []byte) (bool, error) {
+	if f.Empty() {
+		return true, nil
+	}
+	v := filterView{}
+	if err := json.Unmarshal(value, &v); err != nil {
+		return false, err
+	}
+	dest := v.Dest
+	if dest == "" {
+		dest = v.DD.Destination
+	}
+	switch {
+	case f.Owner != "" && f.Owner != v.AD.Owner:
+		return false, nil
+	case f.State != "" && f.State != v.AD.State:
+		return false, nil
+	case f.Dest != "" && f.Dest != dest:
+		return false, nil
+	case f.From.IsZero() == false && v.Timestamp.Before(f.From):
+		return false, nil
+	case f.To.IsZero() == false && v.Timestamp.After(f.To):
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+/*
+A MockStub that pages range queries, which MockStub doesn't implement.
+Like in LevelDB the bookmark is the key that the next page starts with.
+The handlers that page are called on it directly.
+*/
+type pagedStub struct {
+	*shim.MockStub
+}
+
+func (stub pagedStub) GetStateByRangeWithPagination(startKey, endKey string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *sc.QueryResponseMetadata, error) {
+	resultsIterator, err := stub.GetStateByRange(startKey, endKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	kvs := []*queryresult.KV{}
+	for resultsIterator.HasNext() {
+		queryResponse, _ := resultsIterator.Next()
+		kvs = append(kvs, queryResponse)
+	}
+	return testPageOf(kvs, pageSize, bookmark)
+}
+
+//the page of kvs (sorted by key) that starts at the bookmark. A page size of 0 doesn't limit the page.
+func testPageOf(kvs []*queryresult.KV, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *sc.QueryResponseMetadata, error) {
+	page := &testIterator{}
+	metadata := &sc.QueryResponseMetadata{}
+	for _, kv := range kvs {
+		if kv.Key < bookmark {
+			continue
+		}
+		if pageSize > 0 && len(page.kvs) == int(pageSize) {
+			metadata.Bookmark = kv.Key
+			break
+		}
+		page.kvs = append(page.kvs, kv)
+	}
+	metadata.FetchedRecordsCount = int32(len(page.kvs))
+	return page, metadata, nil
+}
+
+type testIterator struct {
+	kvs []*queryresult.KV
+}
+
+func (it *testIterator) HasNext() bool { return len(it.kvs) > 0 }
+func (it *testIterator) Close() error  { return nil }
+func (it *testIterator) Next() (*queryresult.KV, error) {
+	kv := it.kvs[0]
+	it.kvs = it.kvs[1:]
+	return kv, nil
+}
+
+//a page of a query. Queries without a page size return only the records.
+type testPage struct {
+	Records []struct {
+		Key    string
+		Record json.RawMessage
+	}
+	FetchedRecordsCount int
+	Bookmark            string
+}
+
+//the keys and the bookmark of the result of a query.
+func testQueryKeys(t *testing.T, res sc.Response) ([]string, string) {
+	t.Helper()
+	if res.Status != shim.OK {
+		t.Fatalf("Query failed: %s", res.Message)
+	}
+	page := testPage{}
+	var err error
+	if strings.HasPrefix(string(res.Payload), "[") {
+		err = json.Unmarshal(res.Payload, &page.Records)
+	} else {
+		err = json.Unmarshal(res.Payload, &page)
+	}
+	if err != nil {
+		t.Fatalf("Failed to decode %s: %s", res.Payload, err.Error())
+	}
+	keys := []string{}
+	for _, record := range page.Records {
+		keys = append(keys, record.Key)
+	}
+	return keys, page.Bookmark
+}
+
+//the pages follow each other and the filters are applied to the records of every page.
+func TestQueryAssetByRange(t *testing.T) {
+	stub := pagedStub{newTestLedger(t, testLineage)}
+	cases := []struct {
+		name     string
+		args     []string
+		keys     []string
+		bookmark string
+	}{
+		{"all the crudes", []string{"Crude"}, []string{"Crude1", "Crude2"}, ""},
+		{"first page", []string{"Crude", "1", ""}, []string{"Crude1"}, "Crude2"},
+		{"last page", []string{"Crude", "1", "Crude2"}, []string{"Crude2"}, ""},
+		{"page of everything", []string{"Crude", "0", ""}, []string{"Crude1", "Crude2"}, ""},
+		{"fuels without the orders", []string{"Fuel", "0", ""}, []string{"Fuel1", "Fuel2", "Fuel3"}, ""},
+		{"plans", []string{"Plan"}, []string{"Plan1"}, ""},
+		{"by owner", []string{"Crude", "0", "", "owner=org1"}, []string{"Crude2"}, ""},
+		{"by state", []string{"FuelOrder", "0", "", "state=ON_WAY"}, []string{"FuelOrder1"}, ""},
+		{"by dest of an order", []string{"FuelOrder", "0", "", "dest=org6"}, []string{"FuelOrder2"}, ""},
+		{"by dest of a crude", []string{"Crude", "0", "", "dest=org3"}, []string{"Crude1", "Crude2"}, ""},
+		{"by owner and state", []string{"FuelOrder", "0", "", "owner=org3", "state=ON_WAY"}, []string{"FuelOrder1"}, ""},
+		{"by time", []string{"Crude", "0", "", "from=2019-05-02T00:00:00Z", "to=2019-05-03T00:00:00Z"}, []string{"Crude2"}, ""},
+		{"before the first asset", []string{"Crude", "0", "", "to=2019-05-01T00:00:00Z"}, []string{}, ""},
+		//the records that don't match are skipped until the page is full or the range ends.
+		{"filtered page", []string{"FuelOrder", "1", "", "dest=org6"}, []string{"FuelOrder2"}, ""},
+		{"filtered last page", []string{"FuelOrder", "1", "FuelOrder2", "dest=org6"}, []string{"FuelOrder2"}, ""},
+		{"skipped first record", []string{"Crude", "1", "", "state=ON_WAY"}, []string{"Crude2"}, ""},
+		{"full page before the range ends", []string{"Fuel", "2", "", "owner=org3"}, []string{"Fuel1", "Fuel2"}, "Fuel3"},
+		{"next filtered page", []string{"Fuel", "2", "Fuel3", "owner=org3"}, []string{"Fuel3"}, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			keys, bookmark := testQueryKeys(t, new(SmartContract).queryAssetByRange(stub, c.args))
+			if reflect.DeepEqual(keys, c.keys) == false || bookmark != c.bookmark {
+				t.Fatalf("Query should return %v with bookmark '%s' and not %v with bookmark '%s'", c.keys, c.bookmark, keys, bookmark)
+			}
+		})
+	}
+	for _, args := range [][]string{{"Truck"}, {"Crude", "0"}, {"Crude", "-1", ""}, {"Fuel", "0", "", "dest=org5"}, {"Plan", "0", "", "owner=org3"}, {"Crude", "0", "", "color=red"}} {
+		if res := new(SmartContract).queryAssetByRange(stub, args); res.Status == shim.OK {
+			t.Fatalf("Query %v should fail", args)
+		}
+	}
+}
+
+//a filtered page is read from as many pages of the range as needed and the bookmark is the first record left.
+func TestQueryFilteredPages(t *testing.T) {
+	stub := pagedStub{newTestLedger(t, map[string]string{
+		"Crude1": `{"AD":{"Owner":"org1","State":"ON_WAY"}}`,
+		"Crude2": `{"AD":{"Owner":"org3","State":"DELIVERED"}}`,
+		"Crude3": `{"AD":{"Owner":"org1","State":"ON_WAY"}}`,
+		"Crude4": `{"AD":{"Owner":"org1","State":"ON_WAY"}}`,
+		"Crude5": `{"AD":{"Owner":"org3","State":"DELIVERED"}}`,
+	})}
+	pages := [][]string{}
+	bookmark := ""
+	for {
+		keys, next := testQueryKeys(t, new(SmartContract).queryAssetByRange(stub, []string{"Crude", "2", bookmark, "owner=org1"}))
+		pages = append(pages, keys)
+		if bookmark = next; bookmark == "" {
+			break
+		}
+	}
+	if want := [][]string{{"Crude1", "Crude3"}, {"Crude4"}}; reflect.DeepEqual(pages, want) == false {
+		t.Fatalf("Pages should be %v and not %v", want, pages)
+	}
+	res := new(SmartContract).queryAssetByRange(stub, []string{"Crude", "2", "", "owner=org1"})
+	page := testPage{}
+	if err := json.Unmarshal(res.Payload, &page); err != nil || page.FetchedRecordsCount != 2 || page.Bookmark != "Crude4" {
+		t.Fatalf("First page should have 2 records and start the next one at Crude4: %s", res.Payload)
+	}
+}
@@ -0,0 +1,221 @@
+/*
+Rich queries over the assets (needs CouchDB as state database, see docker-compose-couch.yaml).
+
+Clients send only a Mango selector. It's validated against the fields of the assets and
+a small set of operators before it's sent to CouchDB, and the query is limited to the keys
+of the requested type. The indexes for the common fields are under META-INF/statedb/couchdb/indexes.
+
+Example: all fuel with density < 0.8 refined since May 1st
+	richQuery Fuel {"Density":{"$lt":0.8},"Timestamp":{"$gte":"2019-05-01T00:00:00Z"}}
+Times are compared as strings, so they should be RFC3339 in UTC (ending with 'Z').
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const maxSelectorDepth = 8
+
+//fields of Crude, Fuel and FuelOrder that can be used in a selector.
+var queryFields = map[string]bool{
+	"AD.Value": true, "AD.Quantity": true, "AD.Owner": true, "AD.State": true,
+	"DD.EstTime": true, "DD.Delay": true, "DD.StartingLocation": true, "DD.Destination": true,
+	"Veh.Type": true, "Veh.ID": true,
+	"Density": true, "Type": true, "CrudeID": true, "FuelID": true, "Dest": true,
+	"Remaining": true, "CrudeUsed": true, "Timestamp": true, "Retailer": true,
+}
+
+//operators that can be applied on a field.
+var fieldOperators = map[string]bool{
+	"$eq": true, "$ne": true, "$lt": true, "$lte": true, "$gt": true, "$gte": true,
+	"$in": true, "$nin": true, "$exists": true,
+}
+
+/*
+args[0] = type, one of {Crude,Fuel,FuelOrder}
+args[1] = selector (JSON object)
+optional args:
+args[2] = page size, args[3] = bookmark of the previous page ("" for the first page)
+Returns an array of {Key,Record} or, with a page size, {Records,FetchedRecordsCount,Bookmark}.
+*/
+func (s *SmartContract) richQuery(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 or 4")
+	}
+	typ := args[0]
+	if typ != "Crude" && typ != "Fuel" && typ != "FuelOrder" {
+		return shim.Error("Type should be one of {Crude,Fuel,FuelOrder}")
+	}
+	var selector map[string]interface{}
+	if err := json.Unmarshal([]byte(args[1]), &selector); err != nil {
+		return shim.Error("Selector is not a JSON object")
+	}
+	if err := ValidateSelector(selector, 0); err != nil {
+		return shim.Error(fmt.Sprintf("Invalid selector: %s", err.Error()))
+	}
+	//limit the query to the keys of the type.
+	startKey, endKey := AssetRange(typ)
+	query := map[string]interface{}{
+		"selector": map[string]interface{}{
+			"$and": []interface{}{
+				selector,
+				map[string]interface{}{"_id": map[string]interface{}{"$gte": startKey, "$lt": endKey}},
+			},
+		},
+	}
+	queryAsBytes, _ := json.Marshal(query)
+
+	var resultsIterator shim.StateQueryIteratorInterface
+	var metadata *sc.QueryResponseMetadata
+	var err error
+	paged := len(args) == 4
+	if paged {
+		pageSize, err := strconv.ParseInt(args[2], 10, 32)
+		if err != nil || pageSize <= 0 {
+			return shim.Error("Page size should be a positive int number")
+		}
+		resultsIterator, metadata, err = stub.GetQueryResultWithPagination(string(queryAsBytes), int32(pageSize), args[3])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	} else {
+		resultsIterator, err = stub.GetQueryResult(string(queryAsBytes))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	defer resultsIterator.Close()
+
+	var buffer bytes.Buffer
+	if paged {
+		buffer.WriteString("{\"Records\":")
+	}
+	buffer.WriteString("[")
+	bArrayMemberAlreadyWritten := false
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if AssetType(queryResponse.Key) != typ {
+			continue
+		}
+		if bArrayMemberAlreadyWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString("{\"Key\":\"")
+		buffer.WriteString(queryResponse.Key)
+		buffer.WriteString("\", \"Record\":")
+		buffer.Write(queryResponse.Value)
+		buffer.WriteString("}")
+		bArrayMemberAlreadyWritten = true
+	}
+	buffer.WriteString("]")
+	if paged {
+		buffer.WriteString(fmt.Sprintf(", \"FetchedRecordsCount\":%d, \"Bookmark\":\"%s\"}",
+			metadata.FetchedRecordsCount, metadata.Bookmark))
+	}
+	return shim.Success(buffer.Bytes())
+}
+
+/*
+A selector is an object whose keys are either fields of the assets or one of $and,$or,$not.
+A field is compared with a value (implicit $eq) or with an object of field operators.
+*/
+func ValidateSelector(selector map[string]interface{}, depth int) error {
+	if depth > maxSelectorDepth {
+		return errors.New("selector is nested too deep")
+	}
+	if len(selector) == 0 {
+		return errors.New("empty selector")
+	}
+	for key, value := range selector {
+		switch key {
+		case "$and", "$or":
+			list, ok := value.([]interface{})
+			if ok == false || len(list) == 0 {
+				return fmt.Errorf("%s needs a non empty array of selectors", key)
+			}
+			for _, item := range list {
+				sub, ok := item.(map[string]interface{})
+				if ok == false {
+					return fmt.Errorf("%s needs a non empty array of selectors", key)
+				}
+				if err := ValidateSelector(sub, depth+1); err != nil {
+					return err
+				}
+			}
+		case "$not":
+			sub, ok := value.(map[string]interface{})
+			if ok == false {
+				return errors.New("$not needs a selector")
+			}
+			if err := ValidateSelector(sub, depth+1); err != nil {
+				return err
+			}
+		default:
+			if queryFields[key] == false {
+				return fmt.Errorf("field %s can't be queried", key)
+			}
+			if err := validateCondition(key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateCondition(field string, condition interface{}) error {
+	operators, ok := condition.(map[string]interface{})
+	if ok == false {
+		if isScalar(condition) == false {
+			return fmt.Errorf("value of %s should be a string, number, bool or null", field)
+		}
+		return nil
+	}
+	if len(operators) == 0 {
+		return fmt.Errorf("empty condition for %s", field)
+	}
+	for op, value := range operators {
+		if fieldOperators[op] == false {
+			return fmt.Errorf("operator %s is not allowed", op)
+		}
+		switch op {
+		case "$in", "$nin":
+			list, ok := value.([]interface{})
+			if ok == false {
+				return fmt.Errorf("%s of %s needs an array", op, field)
+			}
+			for _, item := range list {
+				if isScalar(item) == false {
+					return fmt.Errorf("%s of %s needs an array of scalar values", op, field)
+				}
+			}
+		case "$exists":
+			if _, ok := value.(bool); ok == false {
+				return fmt.Errorf("$exists of %s needs a bool", field)
+			}
+		default:
+			if isScalar(value) == false {
+				return fmt.Errorf("%s of %s needs a string, number, bool or null", op, field)
+			}
+		}
+	}
+	return nil
+}
+
+func isScalar(v interface{}) bool {
+	switch v.(type) {
+	case string, float64, bool, nil:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+/*
+A MockStub that runs the Mango selectors of richQuery on its state like CouchDB,
+which MockStub doesn't implement. The handlers are called on it directly.
+*/
+type couchStub struct {
+	*shim.MockStub
+}
+
+func (stub couchStub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	resultsIterator, _, err := stub.GetQueryResultWithPagination(query, 0, "")
+	return resultsIterator, err
+}
+
+func (stub couchStub) GetQueryResultWithPagination(query string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *sc.QueryResponseMetadata, error) {
+	q := struct{ Selector map[string]interface{} }{}
+	if err := json.Unmarshal([]byte(query), &q); err != nil {
+		return nil, nil, err
+	}
+	resultsIterator, err := stub.GetStateByRange("", "")
+	if err != nil {
+		return nil, nil, err
+	}
+	kvs := []*queryresult.KV{}
+	for resultsIterator.HasNext() {
+		queryResponse, _ := resultsIterator.Next()
+		doc := map[string]interface{}{}
+		if json.Unmarshal(queryResponse.Value, &doc) != nil {
+			continue
+		}
+		doc["_id"] = queryResponse.Key
+		if matchTestSelector(doc, q.Selector) {
+			kvs = append(kvs, queryResponse)
+		}
+	}
+	return testPageOf(kvs, pageSize, bookmark)
+}
+
+//the operators of ValidateSelector on the JSON numbers and strings of the assets.
+func matchTestSelector(doc map[string]interface{}, selector map[string]interface{}) bool {
+	for key, value := range selector {
+		switch key {
+		case "$and", "$or":
+			matched := 0
+			for _, sub := range value.([]interface{}) {
+				if matchTestSelector(doc, sub.(map[string]interface{})) {
+					matched++
+				}
+			}
+			if (key == "$and" && matched < len(value.([]interface{}))) || (key == "$or" && matched == 0) {
+				return false
+			}
+		case "$not":
+			if matchTestSelector(doc, value.(map[string]interface{})) {
+				return false
+			}
+		default:
+			field, found := testField(doc, key)
+			operators, ok := value.(map[string]interface{})
+			if ok == false {
+				operators = map[string]interface{}{"$eq": value}
+			}
+			for op, operand := range operators {
+				if matchTestOperator(op, field, found, operand) == false {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+//the value of a field such as AD.Owner.
+func testField(doc map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = doc
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if ok == false {
+			return nil, false
+		}
+		if value, ok = object[name]; ok == false {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func matchTestOperator(op string, field interface{}, found bool, operand interface{}) bool {
+	switch op {
+	case "$exists":
+		return found == operand.(bool)
+	case "$in", "$nin":
+		in := false
+		for _, item := range operand.([]interface{}) {
+			in = in || (found && field == item)
+		}
+		return in == (op == "$in")
+	case "$ne":
+		return found == false || field != operand
+	}
+	if found == false {
+		return false
+	}
+	cmp := 0
+	switch f := field.(type) {
+	case float64:
+		o, ok := operand.(float64)
+		if ok == false {
+			return false
+		}
+		if f < o {
+			cmp = -1
+		} else if f > o {
+			cmp = 1
+		}
+	case string:
+		o, ok := operand.(string)
+		if ok == false {
+			return false
+		}
+		cmp = strings.Compare(f, o)
+	default:
+		return op == "$eq" && field == operand
+	}
+	switch op {
+	case "$eq":
+		return cmp == 0
+	case "$lt":
+		return cmp < 0
+	case "$lte":
+		return cmp <= 0
+	case "$gt":
+		return cmp > 0
+	case "$gte":
+		return cmp >= 0
+	}
+	return false
+}
+//the selector is limited to the keys of the type and the pages follow each other.
+func TestRichQuery(t *testing.T) {
+	stub := couchStub{newTestLedger(t, testLineage)}
+	cases := []struct {
+		name     string
+		args     []string
+		keys     []string
+		bookmark string
+	}{
+		{"by type of fuel", []string{"Fuel", `{"Type":"diesel"}`}, []string{"Fuel1", "Fuel3"}, ""},
+		{"by density", []string{"Fuel", `{"Density":{"$lt":0.8}}`}, []string{"Fuel2"}, ""},
+		{"by owner", []string{"Crude", `{"AD.Owner":"org1"}`}, []string{"Crude2"}, ""},
+		{"by quantity", []string{"FuelOrder", `{"AD.Quantity":{"$gte":10,"$lte":20}}`}, []string{"FuelOrder2"}, ""},
+		{"by state", []string{"FuelOrder", `{"AD.State":{"$ne":"ON_WAY"}}`}, []string{"FuelOrder2"}, ""},
+		{"by time", []string{"Crude", `{"Timestamp":{"$gte":"2019-05-02T00:00:00Z"}}`}, []string{"Crude2"}, ""},
+		{"or", []string{"Fuel", `{"$or":[{"Type":"diesel"},{"Density":{"$lt":0.75}}]}`}, []string{"Fuel1", "Fuel2", "Fuel3"}, ""},
+		{"not", []string{"FuelOrder", `{"$not":{"Dest":"org5"}}`}, []string{"FuelOrder2"}, ""},
+		{"field of a crude", []string{"FuelOrder", `{"DD.Delay":{"$exists":true}}`}, []string{}, ""},
+		{"field of a fuel", []string{"Fuel", `{"CrudeID":{"$exists":true}}`}, []string{"Fuel1", "Fuel2", "Fuel3"}, ""},
+		//the orders have a Dest, but the query reads only the fuels.
+		{"only the type", []string{"Fuel", `{"Dest":{"$in":["org5","org6"]}}`}, []string{}, ""},
+		{"first page", []string{"FuelOrder", `{"Dest":{"$in":["org5","org6"]}}`, "1", ""}, []string{"FuelOrder1"}, "FuelOrder2"},
+		{"last page", []string{"FuelOrder", `{"Dest":{"$in":["org5","org6"]}}`, "1", "FuelOrder2"}, []string{"FuelOrder2"}, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			keys, bookmark := testQueryKeys(t, new(SmartContract).richQuery(stub, c.args))
+			if reflect.DeepEqual(keys, c.keys) == false || bookmark != c.bookmark {
+				t.Fatalf("Query should return %v with bookmark '%s' and not %v with bookmark '%s'", c.keys, c.bookmark, keys, bookmark)
+			}
+		})
+	}
+	invalid := [][]string{
+		{"Plan", `{"Veh.Type":"Truck"}`},
+		{"Fuel", `diesel`},
+		{"Fuel", `{"Color":"red"}`},
+		{"Fuel", `{"Type":{"$regex":"^d"}}`},
+		{"Fuel", `{"Type":"diesel"}`, "1"},
+	}
+	for _, args := range invalid {
+		if res := new(SmartContract).richQuery(stub, args); res.Status == shim.OK {
+			t.Fatalf("Query %v should fail", args)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+/*
+Role model of the supply chain.
+
+Every organization is identified by the MSP ID found in the certificate of the
+client that submits a transaction. The registry of the participants (see participants.go)
+maps each MSP ID to exactly one role and to the account/owner name used throughout
+the ledger (e.g. Org1MSP -> org1).
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	RoleDriller     = "driller"
+	RoleShipper     = "shipper"
+	RoleRefiner     = "refiner"
+	RoleDistributor = "distributor"
+	RoleRetailer    = "retailer"
+)
+
+/*
+The organization that submitted the current transaction.
+Org is the name used for owners and accounts (e.g. 'org3').
+*/
+type Caller struct {
+	MSPID string
+	Org   string
+	Role  string
+}
+
+//MSP ID of the creator's certificate. Tests replace it since MockStub has no creator.
+var getMSPID = cid.GetMSPID
+
+//find out who is calling based on the MSP ID of the creator's certificate.
+//Only an ACTIVE participant can call.
+func GetCaller(stub shim.ChaincodeStubInterface) (Caller, error) {
+	mspid, err := getMSPID(stub)
+	if err != nil {
+		return Caller{}, errors.New("Failed to get the MSP ID of the caller")
+	}
+	p, err := GetParticipant(stub, mspid)
+	if err != nil {
+		return Caller{}, err
+	}
+	if p == nil {
+		return Caller{}, fmt.Errorf("MSP ID %s has no role in the supply chain", mspid)
+	}
+	if p.Status != ParticipantActive {
+		return Caller{}, fmt.Errorf("%s is %s and can't submit transactions", p.Org, p.Status)
+	}
+	return Caller{mspid, p.Org, p.Role}, nil
+}
+
+//get the caller and ensure that it has one of the given roles.
+func RequireRole(stub shim.ChaincodeStubInterface, roles ...string) (Caller, error) {
+	caller, err := GetCaller(stub)
+	if err != nil {
+		return Caller{}, err
+	}
+	for _, role := range roles {
+		if caller.Role == role {
+			return caller, nil
+		}
+	}
+	return Caller{}, fmt.Errorf("%s (%s) is not allowed to perform this action. Allowed roles: %s",
+		caller.Org, caller.Role, strings.Join(roles, ","))
+}
+
+//ensure that the caller is the org it claims to be.
+func (c Caller) IsOrg(org string) error {
+	if c.Org != org {
+		return fmt.Errorf("Owner %s doesn't match the caller's organization %s", org, c.Org)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+/*
+State machine of the assets.
+
+Every change of the state of a Crude, Fuel or FuelOrder is a transition of the table below.
+A transition is triggered by a function (its action) and is allowed only from its From state
+and only to the callers that have one of its Roles or are one of its Parties for the asset.
+Transitions with an empty From create the asset. Transitions with From == To don't change
+the state but use the asset (e.g. refining a Crude) and are checked the same way.
+The handlers check the rest of the preconditions, which are described in Precondition.
+
+	Crude:     deliverCrude -> ON_WAY -arrive-> ARRIVED -transfer-> DELIVERED (-refine-> DELIVERED)
+	           ARRIVED -rejectDelivery-> REJECTED
+	Fuel:      refine -> REFINED (-addFuelOrder-> REFINED)
+	FuelOrder: addFuelOrder -> OFFERED -acceptFuelOrder-> READY_FOR_DISTRIBUTION -deliverFuel-> ON_WAY -arrive-> ARRIVED -transfer-> DELIVERED
+	           OFFERED or READY_FOR_DISTRIBUTION -cancelFuelOrder-> CANCELLED
+	           ON_WAY -reportFailedDelivery-> FAILED
+	           READY_FOR_DISTRIBUTION -addPlanOrders-> ON_WAY -removePlanOrder-> READY_FOR_DISTRIBUTION
+	           ARRIVED -rejectDelivery-> REJECTED
+
+A Crude or FuelOrder that has ARRIVED or is DELIVERED becomes DISPUTED when a dispute is opened
+and gets back its state when the dispute is resolved (see disputes.go). A DISPUTED asset
+has no transitions, so it's frozen until then.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	StateOnWay     = "ON_WAY"
+	StateArrived   = "ARRIVED"
+	StateDelivered = "DELIVERED"
+	StateRefined   = "REFINED"
+	StateOffered   = "OFFERED"
+	StateReady     = "READY_FOR_DISTRIBUTION"
+	StateCancelled = "CANCELLED"
+	StateFailed    = "FAILED"
+	StateRejected  = "REJECTED"
+	StateDisputed  = "DISPUTED"
+)
+
+//parties of an asset that may trigger a transition regardless of their role.
+const (
+	PartyOwner       = "owner"
+	PartyDestination = "destination"
+)
+
+type Transition struct {
+	Action       string
+	From         string
+	To           string
+	Roles        []string `json:",omitempty"`
+	Parties      []string `json:",omitempty"`
+	Precondition string   `json:",omitempty"`
+}
+
+var transitions = map[string][]Transition{
+	"Crude": {
+		{"deliverCrude", "", StateOnWay, []string{RoleDriller}, nil,
+			"the owner is the caller and the destination is a refiner"},
+		{"arrive", StateOnWay, StateArrived, []string{RoleShipper}, nil,
+			"the delivered quantity doesn't exceed the quantity"},
+		{"transfer", StateArrived, StateDelivered, nil, []string{PartyDestination},
+			"the destination pays the driller and the shipper"},
+		{"rejectDelivery", StateArrived, StateRejected, nil, []string{PartyDestination},
+			"a reason is given"},
+		{"refine", StateDelivered, StateDelivered, nil, []string{PartyOwner},
+			"enough crude remains for the fuel"},
+	},
+	"Fuel": {
+		{"refine", "", StateRefined, []string{RoleRefiner}, nil,
+			"the crude is DELIVERED to the caller"},
+		{"addFuelOrder", StateRefined, StateRefined, nil, []string{PartyOwner},
+			"the order doesn't exceed the remaining quantity"},
+	},
+	"FuelOrder": {
+		{"addFuelOrder", "", StateOffered, []string{RoleRefiner}, nil,
+			"the fuel is REFINED and owned by the caller and the destination is a retailer"},
+		{"acceptFuelOrder", StateOffered, StateReady, nil, []string{PartyDestination},
+			"the destination can pay the order, which is locked in escrow"},
+		{"deliverFuel", StateReady, StateOnWay, []string{RoleDistributor}, nil,
+			"the plan matches the order (see plans.go)"},
+		{"addPlanOrders", StateReady, StateOnWay, []string{RoleDistributor}, nil,
+			"the plan is open, the caller made it and it matches the order"},
+		{"cancelFuelOrder", StateOffered, StateCancelled, nil, []string{PartyOwner, PartyDestination},
+			"the quantity goes back to the fuel"},
+		{"cancelFuelOrder", StateReady, StateCancelled, nil, []string{PartyOwner, PartyDestination},
+			"the escrow is refunded"},
+		{"arrive", StateOnWay, StateArrived, []string{RoleDistributor}, nil,
+			"the order is in the given plan and the delivered quantity doesn't exceed the quantity"},
+		{"transfer", StateArrived, StateDelivered, nil, []string{PartyDestination},
+			"the order is in the given plan"},
+		{"rejectDelivery", StateArrived, StateRejected, nil, []string{PartyDestination},
+			"a reason is given and the escrow is refunded"},
+		{"reportFailedDelivery", StateOnWay, StateFailed, []string{RoleDistributor}, []string{PartyDestination},
+			"a distributor made the plan of the order and the escrow is refunded"},
+		{"removePlanOrder", StateOnWay, StateReady, []string{RoleDistributor}, nil,
+			"the plan is open and the caller made it"},
+	},
+}
+
+/*
+Find the transition of action for an asset of type typ in state from (empty for a new asset)
+and check that the caller may trigger it. Owner and dest are the parties of the asset.
+*/
+func CheckTransition(caller Caller, typ, action, from, owner, dest string) (Transition, error) {
+	found := false
+	for _, t := range transitions[typ] {
+		if t.Action != action {
+			continue
+		}
+		found = true
+		if t.From != from {
+			continue
+		}
+		if t.Allows(caller, owner, dest) == false {
+			return Transition{}, fmt.Errorf("%s (%s) is not allowed to %s a %s. Allowed: %s",
+				caller.Org, caller.Role, action, typ, t.allowed(owner, dest))
+		}
+		return t, nil
+	}
+	if found == false {
+		return Transition{}, fmt.Errorf("%s is not an action of a %s", action, typ)
+	}
+	return Transition{}, fmt.Errorf("Cannot %s a %s that is %s", action, typ, from)
+}
+
+//get the caller and the transition that creates an asset of type typ with action.
+func RequireCreation(stub shim.ChaincodeStubInterface, typ, action string) (Caller, Transition, error) {
+	caller, err := GetCaller(stub)
+	if err != nil {
+		return Caller{}, Transition{}, err
+	}
+	t, err := CheckTransition(caller, typ, action, "", "", "")
+	if err != nil {
+		return Caller{}, Transition{}, err
+	}
+	return caller, t, nil
+}
+
+func (t Transition) Allows(caller Caller, owner, dest string) bool {
+	for _, role := range t.Roles {
+		if caller.Role == role {
+			return true
+		}
+	}
+	for _, party := range t.Parties {
+		if party == PartyOwner && caller.Org == owner {
+			return true
+		}
+		if party == PartyDestination && caller.Org == dest {
+			return true
+		}
+	}
+	return false
+}
+
+//who may trigger the transition, e.g. 'distributor, the destination (org5)'.
+func (t Transition) allowed(owner, dest string) string {
+	who := append([]string{}, t.Roles...)
+	for _, party := range t.Parties {
+		switch party {
+		case PartyOwner:
+			who = append(who, fmt.Sprintf("the owner (%s)", owner))
+		case PartyDestination:
+			who = append(who, fmt.Sprintf("the destination (%s)", dest))
+		}
+	}
+	return strings.Join(who, ", ")
+}
+
+//the parties and the state of an asset as it's stored in db.
+func assetParties(value []byte) (owner, dest, state string, err error) {
+	v := filterView{}
+	if err = json.Unmarshal(value, &v); err != nil {
+		return "", "", "", err
+	}
+	dest = v.Dest
+	if dest == "" {
+		dest = v.DD.Destination
+	}
+	return v.AD.Owner, dest, v.AD.State, nil
+}
+
+/*
+args[0] = ID of a Crude, Fuel or FuelOrder, or one of the types {Crude,Fuel,FuelOrder}
+For an ID, the transitions that the caller may trigger in the current state of the asset are returned.
+For a type, all its transitions are returned.
+*/
+func (s *SmartContract) queryAllowedTransitions(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if table, ok := transitions[args[0]]; ok {
+		tableAsBytes, _ := json.Marshal(table)
+		return shim.Success(tableAsBytes)
+	}
+	typ := AssetType(args[0])
+	if _, ok := transitions[typ]; ok == false {
+		return shim.Error("Arg should be the ID or the type of a Crude, Fuel or FuelOrder")
+	}
+	caller, err := GetCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	assetAsBytes, err := stub.GetState(args[0])
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to get %s: %s", args[0], err.Error()))
+	}
+	if assetAsBytes == nil {
+		return shim.Error(fmt.Sprintf("Could not locate asset %s", args[0]))
+	}
+	owner, dest, state, err := assetParties(assetAsBytes)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to decode %s", args[0]))
+	}
+	allowed := []Transition{}
+	for _, t := range transitions[typ] {
+		if t.From == state && t.Allows(caller, owner, dest) {
+			allowed = append(allowed, t)
+		}
+	}
+	allowedAsBytes, _ := json.Marshal(allowed)
+	return shim.Success(allowedAsBytes)
+}
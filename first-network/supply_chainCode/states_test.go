@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCheckTransition(t *testing.T) {
+	driller := Caller{"Org1MSP", "org1", RoleDriller}
+	refiner := Caller{"Org3MSP", "org3", RoleRefiner}
+	carrier := Caller{"Org4MSP", "org4", RoleDistributor}
+	retailer := Caller{"Org5MSP", "org5", RoleRetailer}
+	cases := []struct {
+		name   string
+		caller Caller
+		typ    string
+		action string
+		from   string
+		owner  string
+		dest   string
+		to     string
+		err    string
+	}{
+		{"driller creates a crude", driller, "Crude", "deliverCrude", "", "", "", StateOnWay, ""},
+		{"refiner can't create a crude", refiner, "Crude", "deliverCrude", "", "", "", "", "Allowed: driller"},
+		{"destination receives a crude", refiner, "Crude", "transfer", StateArrived, "org1", "org3", StateDelivered, ""},
+		{"only the owner refines a crude", driller, "Crude", "refine", StateDelivered, "org3", "org3", "", "Allowed: the owner (org3)"},
+		{"carrier delivers an order", carrier, "FuelOrder", "deliverFuel", StateReady, "org3", "org5", StateOnWay, ""},
+		{"retailer can't deliver an order", retailer, "FuelOrder", "deliverFuel", StateReady, "org3", "org5", "", "Allowed: distributor"},
+		{"order delivered twice", carrier, "FuelOrder", "deliverFuel", StateOnWay, "org3", "org5", "", "Cannot deliverFuel a FuelOrder that is ON_WAY"},
+		{"buyer reports a failed delivery", retailer, "FuelOrder", "reportFailedDelivery", StateOnWay, "org3", "org5", StateFailed, ""},
+		{"cancelled order is final", retailer, "FuelOrder", "transfer", StateCancelled, "org3", "org5", "", "Cannot transfer a FuelOrder that is CANCELLED"},
+		{"unknown action", refiner, "Fuel", "transfer", StateRefined, "org3", "", "", "transfer is not an action of a Fuel"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tr, err := CheckTransition(c.caller, c.typ, c.action, c.from, c.owner, c.dest)
+			if c.err != "" {
+				if err == nil || strings.Contains(err.Error(), c.err) == false {
+					t.Fatalf("should fail with '%s' but got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tr.To != c.to {
+				t.Fatalf("state should be %s and not %s", c.to, tr.To)
+			}
+		})
+	}
+}
+
+//every transition of the table leads to a state that is known to the table or is final.
+func TestTransitionsTable(t *testing.T) {
+	final := map[string]bool{StateDelivered: true, StateCancelled: true, StateFailed: true, StateRefined: true, StateRejected: true}
+	for typ, table := range transitions {
+		from := map[string]bool{}
+		for _, tr := range table {
+			from[tr.From] = true
+			if len(tr.Roles) == 0 && len(tr.Parties) == 0 {
+				t.Fatalf("nobody can %s a %s", tr.Action, typ)
+			}
+		}
+		for _, tr := range table {
+			if from[tr.To] == false && final[tr.To] == false {
+				t.Fatalf("%s of a %s leads to %s which has no transitions", tr.Action, typ, tr.To)
+			}
+		}
+		if from[""] == false {
+			t.Fatalf("nothing creates a %s", typ)
+		}
+	}
+}
+
+func TestQueryAllowedTransitions(t *testing.T) {
+	stub, ids := newTestPlan(t)
+	allowed := func(msp, id string) []string {
+		actions := []string{}
+		table := []Transition{}
+		if err := json.Unmarshal([]byte(mustInvoke(t, stub, msp, "queryAllowedTransitions", id)), &table); err != nil {
+			t.Fatal(err)
+		}
+		for _, tr := range table {
+			actions = append(actions, tr.Action)
+		}
+		return actions
+	}
+	if actions := allowed("Org1MSP", "FuelOrder"); len(actions) != len(transitions["FuelOrder"]) {
+		t.Fatalf("table of FuelOrder is %v", actions)
+	}
+	cases := []struct {
+		msp     string
+		id      string
+		actions string
+	}{
+		{"Org5MSP", ids.FuelOrder, "reportFailedDelivery"},
+		{"Org4MSP", ids.FuelOrder, "arrive,reportFailedDelivery,removePlanOrder"},
+		{"Org3MSP", ids.FuelOrder, ""},
+		{"Org3MSP", ids.Crude, "refine"},
+		{"Org3MSP", ids.Fuel, "addFuelOrder"},
+		{"Org1MSP", ids.Fuel, ""},
+	}
+	for _, c := range cases {
+		if actions := strings.Join(allowed(c.msp, c.id), ","); actions != c.actions {
+			t.Fatalf("%s should be allowed to %q on %s and not %q", c.msp, c.actions, c.id, actions)
+		}
+	}
+	runErrorCases(t, stub, []errorCase{
+		{"not an asset", "Org1MSP", []string{"queryAllowedTransitions", ids.Plan}, "ID or the type"},
+		{"asset doesn't exist", "Org1MSP", []string{"queryAllowedTransitions", "Crude99999999"}, "Could not locate"},
+	})
+}
+
+//a carrier can only pick up orders that are ready.
+func TestDeliverFuelStates(t *testing.T) {
+	stub, ids := newTestPlan(t)
+	now := testNow()
+	est := testLater()
+	cancelled := mustOrder(t, stub, "10", "10", "org3", "org5", ids.Fuel, now)
+	mustInvoke(t, stub, "Org5MSP", "cancelFuelOrder", cancelled)
+	ready := mustOrder(t, stub, "10", "10", "org3", "org5", ids.Fuel, now)
+	offered := mustInvoke(t, stub, "Org3MSP", "addFuelOrder", "10", "10", "org3", "org5", ids.Fuel, now)
+	runErrorCases(t, stub, []errorCase{
+		{"order on its way", "Org4MSP", []string{"deliverFuel", "T2", ids.FuelOrder, est, "org3", "org5"},
+			ids.FuelOrder + ": Cannot deliverFuel a FuelOrder that is ON_WAY"},
+		{"cancelled order", "Org4MSP", []string{"deliverFuel", "T2", cancelled, est, "org3", "org5"},
+			"Cannot deliverFuel a FuelOrder that is CANCELLED"},
+		{"order not accepted", "Org4MSP", []string{"deliverFuel", "T2", offered, est, "org3", "org5"},
+			"Cannot deliverFuel a FuelOrder that is OFFERED"},
+		{"not a carrier", "Org3MSP", []string{"deliverFuel", "T2", ready, est, "org3", "org5"},
+			"org3 (refiner) is not allowed to deliverFuel a FuelOrder"},
+	})
+}
@@ -0,0 +1,220 @@
+/*
+Provenance of assets.
+
+traceAsset follows the parent IDs of an asset up to the original Crude
+(FuelOrder -> Fuel -> Crude, plus the Plan that carried the order) and
+collects every asset that was produced from it (Crude -> Fuels -> FuelOrders).
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+//an asset as it is stored in the db.
+type TraceNode struct {
+	ID     string
+	Record json.RawMessage
+}
+
+//a node of the downstream tree. Plan is set only for FuelOrders that were put in a Plan.
+type TraceTree struct {
+	TraceNode
+	Plan     string `json:",omitempty"`
+	Children []*TraceTree
+}
+
+/*
+Upstream starts with the parent of the traced asset and ends with the Crude.
+Plan is the delivery plan of the traced FuelOrder (if any).
+Downstream contains the children of the traced asset.
+*/
+type Trace struct {
+	Asset      TraceNode
+	Upstream   []TraceNode
+	Plan       *TraceNode `json:",omitempty"`
+	Downstream []*TraceTree
+}
+
+/*
+args[0] = ID of a Crude, Fuel or FuelOrder
+*/
+func (s *SmartContract) traceAsset(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	id := args[0]
+	typ := AssetType(id)
+	if typ != "Crude" && typ != "Fuel" && typ != "FuelOrder" {
+		return shim.Error("Only a Crude, Fuel or FuelOrder can be traced")
+	}
+	assetAsBytes, err := stub.GetState(id)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to get %s: %s", id, err.Error()))
+	}
+	if assetAsBytes == nil {
+		return shim.Error(fmt.Sprintf("Could not locate asset %s", id))
+	}
+	trace := Trace{Asset: TraceNode{id, assetAsBytes}}
+
+	//walk upstream following the parent IDs.
+	parentID := ""
+	switch typ {
+	case "FuelOrder":
+		fuelOrder := FuelOrder{}
+		if err = json.Unmarshal(assetAsBytes, &fuelOrder); err != nil {
+			return shim.Error(fmt.Sprintf("Failed to decode %s", id))
+		}
+		parentID = fuelOrder.FuelID
+		planID, planAsBytes, err := findPlanOfOrder(stub, id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if planAsBytes != nil {
+			trace.Plan = &TraceNode{planID, planAsBytes}
+		}
+	case "Fuel":
+		fuel := Fuel{}
+		if err = json.Unmarshal(assetAsBytes, &fuel); err != nil {
+			return shim.Error(fmt.Sprintf("Failed to decode %s", id))
+		}
+		parentID = fuel.CrudeID
+	}
+	for parentID != "" {
+		parentAsBytes, err := stub.GetState(parentID)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Failed to get %s: %s", parentID, err.Error()))
+		}
+		if parentAsBytes == nil {
+			return shim.Error(fmt.Sprintf("Parent %s of the lineage doesn't exist", parentID))
+		}
+		trace.Upstream = append(trace.Upstream, TraceNode{parentID, parentAsBytes})
+		if AssetType(parentID) != "Fuel" {
+			break
+		}
+		fuel := Fuel{}
+		if err = json.Unmarshal(parentAsBytes, &fuel); err != nil {
+			return shim.Error(fmt.Sprintf("Failed to decode %s", parentID))
+		}
+		parentID = fuel.CrudeID
+	}
+
+	//build the downstream tree.
+	children, err := findChildren(stub, id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, child := range children {
+		if AssetType(child.ID) == "Fuel" {
+			if child.Children, err = findChildren(stub, child.ID); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+	}
+	trace.Downstream = children
+
+	traceAsBytes, _ := json.Marshal(trace)
+	return shim.Success(traceAsBytes)
+}
+
+/*
+Children of a Crude are the Fuels refined from it and
+children of a Fuel are the FuelOrders sold from it.
+FuelOrders have no children. They are found through the crude~fuel and fuel~order indexes (see index.go).
+*/
+func findChildren(stub shim.ChaincodeStubInterface, id string) ([]*TraceTree, error) {
+	children := []*TraceTree{}
+	var index string
+	switch AssetType(id) {
+	case "Crude":
+		index = FuelIndex
+	case "Fuel":
+		index = OrderIndex
+	default:
+		return children, nil
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(index, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, keyParts, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return nil, err
+		}
+		childID := keyParts[1]
+		childAsBytes, err := stub.GetState(childID)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get %s: %s", childID, err.Error())
+		}
+		if childAsBytes == nil {
+			continue
+		}
+		child := &TraceTree{TraceNode: TraceNode{childID, childAsBytes}}
+		if index == OrderIndex {
+			if child.Plan, _, err = findPlanOfOrder(stub, childID); err != nil {
+				return nil, err
+			}
+		}
+		children = append(children, child)
+	}
+	return children, nil
+}
+
+//returns the plan that contains the FuelOrder or a nil value if the order isn't in any plan yet.
+func findPlanOfOrder(stub shim.ChaincodeStubInterface, orderID string) (string, []byte, error) {
+	planID, err := PlanOfOrder(stub, orderID)
+	if err != nil || planID == "" {
+		return "", nil, err
+	}
+	planAsBytes, err := stub.GetState(planID)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to get %s: %s", planID, err.Error())
+	}
+	return planID, planAsBytes, nil
+}
+
+//call fn for every asset of type typ (one of Crude,Fuel,FuelOrder,Plan).
+func forEachAsset(stub shim.ChaincodeStubInterface, typ string, fn func(key string, value []byte) error) error {
+	startKey, endKey := AssetRange(typ)
+	resultsIterator, err := stub.GetStateByRange(startKey, endKey)
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		//keep only the keys of the requested type.
+		if AssetType(queryResponse.Key) != typ {
+			continue
+		}
+		if err = fn(queryResponse.Key, queryResponse.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//returns the type of an asset based on its ID (e.g. 'FuelOrder12' -> FuelOrder) or an empty string.
+func AssetType(id string) string {
+	//FuelOrder should be checked before Fuel.
+	for _, typ := range []string{"Crude", "FuelOrder", "Fuel", "Plan"} {
+		if strings.HasPrefix(id, typ) {
+			return typ
+		}
+	}
+	return ""
+}
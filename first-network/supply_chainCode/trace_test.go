@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//a ledger with the given assets put in db with their indexes, for the queries that don't check the caller.
+func newTestLedger(t *testing.T, assets map[string]string) *shim.MockStub {
+	t.Helper()
+	stub := shim.NewMockStub("supplychain", new(SmartContract))
+	stub.MockTransactionStart("seed")
+	defer stub.MockTransactionEnd("seed")
+	for id, value := range assets {
+		if err := PutAsset(stub, id, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return stub
+}
+
+//two fuels refined from Crude1 and two orders of Fuel1, the first of them in Plan1.
+var testLineage = map[string]string{
+	"Crude1":     `{"AD":{"Owner":"org3","State":"DELIVERED"},"DD":{"Destination":"org3"},"Timestamp":"2019-05-01T10:00:00Z"}`,
+	"Crude2":     `{"AD":{"Owner":"org1","State":"ON_WAY"},"DD":{"Destination":"org3"},"Timestamp":"2019-05-02T10:00:00Z"}`,
+	"Fuel1":      `{"AD":{"Owner":"org3","State":"REFINED"},"CrudeID":"Crude1","Type":"diesel","Density":0.83}`,
+	"Fuel2":      `{"AD":{"Owner":"org3","State":"REFINED"},"CrudeID":"Crude1","Type":"gasoline","Density":0.72}`,
+	"Fuel3":      `{"AD":{"Owner":"org3","State":"REFINED"},"CrudeID":"Crude2","Type":"diesel","Density":0.84}`,
+	"FuelOrder1": `{"AD":{"Owner":"org3","State":"ON_WAY","Quantity":30},"Dest":"org5","FuelID":"Fuel1"}`,
+	"FuelOrder2": `{"AD":{"Owner":"org3","State":"READY_FOR_DISTRIBUTION","Quantity":10},"Dest":"org6","FuelID":"Fuel1"}`,
+	"Plan1":      `{"Veh":{"Type":"Truck","ID":"T1"},"Plan":{"FuelOrder1":{"Destination":"org5"}}}`,
+}
+
+//the downstream tree as paths of IDs, e.g. Fuel1/FuelOrder1@Plan1.
+func traceTestPaths(trees []*TraceTree, prefix string) []string {
+	paths := []string{}
+	for _, tree := range trees {
+		path := prefix + tree.ID
+		if tree.Plan != "" {
+			path += "@" + tree.Plan
+		}
+		paths = append(paths, path)
+		paths = append(paths, traceTestPaths(tree.Children, path+"/")...)
+	}
+	return paths
+}
+
+//the lineage of every asset reaches the Crude upstream and the orders downstream.
+func TestTraceAsset(t *testing.T) {
+	stub := newTestLedger(t, testLineage)
+	cases := []struct {
+		id         string
+		upstream   []string
+		plan       string
+		downstream []string
+	}{
+		{"Crude1", []string{}, "", []string{"Fuel1", "Fuel1/FuelOrder1@Plan1", "Fuel1/FuelOrder2", "Fuel2"}},
+		{"Crude2", []string{}, "", []string{"Fuel3"}},
+		{"Fuel1", []string{"Crude1"}, "", []string{"FuelOrder1@Plan1", "FuelOrder2"}},
+		{"Fuel2", []string{"Crude1"}, "", []string{}},
+		{"FuelOrder1", []string{"Fuel1", "Crude1"}, "Plan1", []string{}},
+		{"FuelOrder2", []string{"Fuel1", "Crude1"}, "", []string{}},
+	}
+	for _, c := range cases {
+		t.Run(c.id, func(t *testing.T) {
+			res := new(SmartContract).traceAsset(stub, []string{c.id})
+			if res.Status != shim.OK {
+				t.Fatalf("traceAsset failed: %s", res.Message)
+			}
+			trace := Trace{}
+			if err := json.Unmarshal(res.Payload, &trace); err != nil {
+				t.Fatal(err)
+			}
+			if trace.Asset.ID != c.id || string(trace.Asset.Record) != testLineage[c.id] {
+				t.Fatalf("Trace should start with %s: %+v", c.id, trace.Asset)
+			}
+			upstream := []string{}
+			for _, node := range trace.Upstream {
+				upstream = append(upstream, node.ID)
+			}
+			if reflect.DeepEqual(upstream, c.upstream) == false {
+				t.Fatalf("Upstream should be %v and not %v", c.upstream, upstream)
+			}
+			plan := ""
+			if trace.Plan != nil {
+				plan = trace.Plan.ID
+			}
+			if plan != c.plan {
+				t.Fatalf("Plan should be '%s' and not '%s'", c.plan, plan)
+			}
+			if downstream := traceTestPaths(trace.Downstream, ""); reflect.DeepEqual(downstream, c.downstream) == false {
+				t.Fatalf("Downstream should be %v and not %v", c.downstream, downstream)
+			}
+		})
+	}
+	for _, id := range []string{"Plan1", "Crude9"} {
+		if res := new(SmartContract).traceAsset(stub, []string{id}); res.Status == shim.OK {
+			t.Fatalf("traceAsset of %s should fail", id)
+		}
+	}
+}
+
+//the children are found through the crude~fuel and fuel~order indexes, so assets put without them are found after rebuildIndexes.
+func TestTraceIndexedChildren(t *testing.T) {
+	stub := newTestLedger(t, testLineage)
+	stub.MockTransactionStart("raw")
+	stub.PutState("Fuel4", []byte(`{"AD":{"Owner":"org3","State":"REFINED"},"CrudeID":"Crude2","Type":"diesel"}`))
+	stub.PutState("FuelOrder3", []byte(`{"AD":{"Owner":"org3","State":"OFFERED"},"Dest":"org5","FuelID":"Fuel3"}`))
+	stub.MockTransactionEnd("raw")
+	downstream := func() []string {
+		t.Helper()
+		res := new(SmartContract).traceAsset(stub, []string{"Crude2"})
+		if res.Status != shim.OK {
+			t.Fatalf("traceAsset failed: %s", res.Message)
+		}
+		trace := Trace{}
+		if err := json.Unmarshal(res.Payload, &trace); err != nil {
+			t.Fatal(err)
+		}
+		return traceTestPaths(trace.Downstream, "")
+	}
+	if paths := downstream(); reflect.DeepEqual(paths, []string{"Fuel3"}) == false {
+		t.Fatalf("Assets without indexes shouldn't be traced: %v", paths)
+	}
+	stub.MockTransactionStart("rebuild")
+	res := new(SmartContract).rebuildIndexes(stub, []string{})
+	stub.MockTransactionEnd("rebuild")
+	if res.Status != shim.OK {
+		t.Fatalf("rebuildIndexes failed: %s", res.Message)
+	}
+	if paths := downstream(); reflect.DeepEqual(paths, []string{"Fuel3", "Fuel3/FuelOrder3", "Fuel4"}) == false {
+		t.Fatalf("Downstream should be [Fuel3 Fuel3/FuelOrder3 Fuel4] and not %v", paths)
+	}
+	stub.MockTransactionStart("raw")
+	stub.PutState("FuelOrder9", []byte(`"diesel"`))
+	stub.MockTransactionEnd("raw")
+	if res := new(SmartContract).traceAsset(stub, []string{"FuelOrder9"}); res.Status == shim.OK || strings.Contains(res.Message, "Failed to decode FuelOrder9") == false {
+		t.Fatalf("traceAsset of a broken order should fail to decode it and not '%s'", res.Message)
+	}
+}
@@ -0,0 +1,53 @@
+/*
+Times of the events are taken from the timestamp of the transaction and not from the args,
+so delays and penalties are computed from the same time for all the endorsers.
+*/
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TxTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Failed to get the timestamp of the transaction: %s", err.Error())
+	}
+	txTime, err := ptypes.Timestamp(txTimestamp)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid timestamp of the transaction: %s", err.Error())
+	}
+	return txTime, nil
+}
+
+/*
+Clients still send the time of the event. It's rejected if it differs from the
+transaction time by more than MaxClockDrift seconds, otherwise the transaction time is returned.
+*/
+func TrustedTime(stub shim.ChaincodeStubInterface, rfc string) (time.Time, error) {
+	clientTime, err := RFCtoTime(rfc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	txTime, err := TxTime(stub)
+	if err != nil {
+		return time.Time{}, err
+	}
+	config, err := GetConfig(stub)
+	if err != nil {
+		return time.Time{}, err
+	}
+	drift := clientTime.Sub(txTime)
+	if drift < 0 {
+		drift = -drift
+	}
+	if drift > time.Duration(config.MaxClockDrift)*time.Second {
+		return time.Time{}, fmt.Errorf("Time %s differs from the transaction time %s by more than %d seconds",
+			rfc, txTime.Format(time.RFC3339), config.MaxClockDrift)
+	}
+	return txTime, nil
+}
@@ -0,0 +1,79 @@
+/*
+Yield of the refining process per type of fuel.
+Quantity of fuel produced = quantity of crude consumed * ratio.
+The ratios are stored in the db with key YieldRatios. Types of fuel
+without a ratio use the DefaultYieldRatio.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const YieldRatiosKey = "YieldRatios"
+const DefaultYieldRatio = 1.0
+
+/*
+Only the refiner can set the yield of its process.
+args[0] = type_of_fuel, args[1] = ratio in (0,1]
+*/
+func (s *SmartContract) setYieldRatio(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if _, err := RequireRole(stub, RoleRefiner); err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	ratio, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || ratio <= 0 || ratio > 1 {
+		return shim.Error("Ratio should be a float number in (0,1]")
+	}
+	ratios, err := getYieldRatios(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ratios[args[0]] = ratio
+	ratiosAsBytes, _ := json.Marshal(ratios)
+	if err = stub.PutState(YieldRatiosKey, ratiosAsBytes); err != nil {
+		return shim.Error("Failed to put yield ratios in db")
+	}
+	return shim.Success(nil)
+}
+
+func GetYieldRatio(stub shim.ChaincodeStubInterface, fuelType string) (float64, error) {
+	ratios, err := getYieldRatios(stub)
+	if err != nil {
+		return 0, err
+	}
+	if ratio, ok := ratios[fuelType]; ok {
+		return ratio, nil
+	}
+	return DefaultYieldRatio, nil
+}
+
+func getYieldRatios(stub shim.ChaincodeStubInterface) (map[string]float64, error) {
+	ratios := make(map[string]float64)
+	ratiosAsBytes, err := stub.GetState(YieldRatiosKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get yield ratios: %s", err.Error())
+	}
+	if ratiosAsBytes == nil {
+		return ratios, nil
+	}
+	if err = json.Unmarshal(ratiosAsBytes, &ratios); err != nil {
+		return nil, fmt.Errorf("Failed to decode yield ratios: %s", err.Error())
+	}
+	return ratios, nil
+}
+
+//quantity of crude that has to be consumed in order to produce quantity of fuel.
+func CrudeNeeded(quantity int, ratio float64) int {
+	//ignore the float error of the division (e.g. 7/0.7 = 10.000000000000002)
+	return int(math.Ceil(float64(quantity)/ratio - 1e-9))
+}